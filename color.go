@@ -0,0 +1,39 @@
+package main
+
+import (
+	"io"
+	"os"
+	"strconv"
+)
+
+// colorCounts is set when -color resolves to coloring the output.
+var colorCounts bool
+
+// useColor resolves the -color mode for output: always and never as they
+// say, and auto only on a terminal, unless NO_COLOR is set to anything or
+// TERM is dumb.
+func useColor(mode string, output io.Writer) bool {
+	switch mode {
+	case "always":
+		return true
+	case "never":
+		return false
+	}
+	if os.Getenv("NO_COLOR") != "" || os.Getenv("TERM") == "dumb" {
+		return false
+	}
+	file, ok := output.(*os.File)
+	if !ok {
+		return false
+	}
+	info, err := file.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// highlight prints a count in bold when colors are on.
+func highlight(count int) string {
+	if !colorCounts {
+		return strconv.Itoa(count)
+	}
+	return "\x1b[1m" + strconv.Itoa(count) + "\x1b[0m"
+}
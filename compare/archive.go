@@ -0,0 +1,153 @@
+package compare
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// archiveFormats are the values accepted by Options.Archive, with the
+// extension of the archive they write.
+var archiveFormats = map[string]string{
+	"zip":    ".zip",
+	"tar.gz": ".tar.gz",
+}
+
+// archiveWriter adds files to an archive of either format.
+type archiveWriter interface {
+	add(name string, info os.FileInfo, content io.Reader) error
+	Close() error
+}
+
+// writeDiffArchive packs the diffs directory of outputDir, under diffs/ with
+// the subdirectories of a recursive comparison, into diffs.zip or
+// diffs.tar.gz in outputDir, so a CI job has a single artifact to upload.
+// With withCSVs the CSVs of outputDir are added at the top of the archive.
+// It returns the path of the archive, which is removed again on error.
+func writeDiffArchive(outputDir, format string, withCSVs bool) (archive string, err error) {
+	archive = filepath.Join(outputDir, "diffs"+archiveFormats[format])
+	file, err := os.Create(archive)
+	if err != nil {
+		return "", err
+	}
+	defer func() {
+		if closeErr := file.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			os.Remove(archive)
+			archive = ""
+		}
+	}()
+
+	var writer archiveWriter
+	if format == "zip" {
+		writer = zipArchive{zip.NewWriter(file)}
+	} else {
+		writer = newTarArchive(file)
+	}
+
+	if withCSVs {
+		names, err := filepath.Glob(filepath.Join(outputDir, "*.csv"))
+		if err != nil {
+			return "", err
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			if err := addArchiveFile(writer, filepath.Base(name), name); err != nil {
+				return "", err
+			}
+		}
+	}
+
+	diffDir := filepath.Join(outputDir, "diffs")
+	err = filepath.WalkDir(diffDir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil || path == diffDir || !entry.Type().IsRegular() {
+			return err
+		}
+		rel, err := filepath.Rel(outputDir, path)
+		if err != nil {
+			return err
+		}
+		return addArchiveFile(writer, filepath.ToSlash(rel), path)
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return archive, writer.Close()
+}
+
+// addArchiveFile adds the file at path to writer as name.
+func addArchiveFile(writer archiveWriter, name, path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	if err := writer.add(name, info, file); err != nil {
+		return fmt.Errorf("adding %s to the archive: %v", path, err)
+	}
+	return nil
+}
+
+type zipArchive struct {
+	*zip.Writer
+}
+
+func (a zipArchive) add(name string, info os.FileInfo, content io.Reader) error {
+	header, err := zip.FileInfoHeader(info)
+	if err != nil {
+		return err
+	}
+	header.Name = name
+	header.Method = zip.Deflate
+	w, err := a.CreateHeader(header)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(w, content)
+	return err
+}
+
+type tarArchive struct {
+	*tar.Writer
+	gzip *gzip.Writer
+}
+
+func newTarArchive(w io.Writer) tarArchive {
+	compressed := gzip.NewWriter(w)
+	return tarArchive{tar.NewWriter(compressed), compressed}
+}
+
+func (a tarArchive) add(name string, info os.FileInfo, content io.Reader) error {
+	header, err := tar.FileInfoHeader(info, "")
+	if err != nil {
+		return err
+	}
+	header.Name = name
+	if err := a.WriteHeader(header); err != nil {
+		return err
+	}
+	_, err = io.Copy(a.Writer, content)
+	return err
+}
+
+// Close ends the tar stream, then the gzip stream around it.
+func (a tarArchive) Close() error {
+	if err := a.Writer.Close(); err != nil {
+		return err
+	}
+	return a.gzip.Close()
+}
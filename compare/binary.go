@@ -0,0 +1,89 @@
+package compare
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+)
+
+// sniffBytes is how much of the compared content isBinary looks at, as much
+// as diff and git do.
+const sniffBytes = 8000
+
+// isBinary reports whether the first sniffBytes bytes of the compared
+// content of filePath hold a NUL byte.
+func (c *comparison) isBinary(filePath string) (bool, error) {
+	file, err := c.openContent(filePath)
+	if err != nil {
+		return false, err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return false, err
+	}
+	start, length := c.contentRange(info.Size())
+
+	head := make([]byte, min(length, sniffBytes))
+	if _, err := io.ReadFull(io.NewSectionReader(file, start, length), head); err != nil {
+		return false, err
+	}
+	return bytes.IndexByte(head, 0) >= 0, nil
+}
+
+// binaryDiff returns the .diff of two binary files: a note with their
+// checksums and sizes, or with -binary-mode hexdump a unified diff of their
+// hex dumps when both are within the size limit.
+func (c *comparison) binaryDiff(file1 string, info1 os.FileInfo, checksum1 string, file2 string, info2 os.FileInfo, checksum2 string, sizeLimit int) ([]byte, error) {
+	if c.binaryMode == "hexdump" && info1.Size() <= int64(sizeLimit) && info2.Size() <= int64(sizeLimit) {
+		content1, err := c.readComparedContent(file1)
+		if err != nil {
+			return nil, err
+		}
+		content2, err := c.readComparedContent(file2)
+		if err != nil {
+			return nil, err
+		}
+		output := c.unifiedDiff(file1, info1.ModTime(), hexdump(content1), file2, info2.ModTime(), hexdump(content2))
+		if output != nil {
+			return output, nil
+		}
+	}
+
+	var out bytes.Buffer
+	fmt.Fprintf(&out, "Binary files %s and %s differ\n", file1, file2)
+	fmt.Fprintf(&out, "%s: %s, %d bytes\n", file1, checksum1, info1.Size())
+	fmt.Fprintf(&out, "%s: %s, %d bytes\n", file2, checksum2, info2.Size())
+	return out.Bytes(), nil
+}
+
+// hexdump formats data like hexdump -C: the offset, 16 bytes in hex and the
+// same bytes as ASCII on each line.
+func hexdump(data []byte) []byte {
+	var out bytes.Buffer
+	for offset := 0; offset < len(data); offset += 16 {
+		row := data[offset:min(offset+16, len(data))]
+		fmt.Fprintf(&out, "%08x ", offset)
+		for i := 0; i < 16; i++ {
+			if i == 8 {
+				out.WriteByte(' ')
+			}
+			if i < len(row) {
+				fmt.Fprintf(&out, " %02x", row[i])
+			} else {
+				out.WriteString("   ")
+			}
+		}
+		out.WriteString("  |")
+		for _, c := range row {
+			if c < 0x20 || c > 0x7e {
+				c = '.'
+			}
+			out.WriteByte(c)
+		}
+		out.WriteString("|\n")
+	}
+	return out.Bytes()
+}
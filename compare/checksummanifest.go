@@ -0,0 +1,116 @@
+package compare
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// isChecksumManifest reports whether input is a checksum CSV to compare
+// against rather than a directory.
+func isChecksumManifest(input string) bool {
+	if !strings.HasSuffix(strings.ToLower(input), ".csv") {
+		return false
+	}
+	info, err := os.Stat(input)
+	return err == nil && info.Mode().IsRegular()
+}
+
+// loadChecksumManifest reads a checksum CSV written by an earlier run, such
+// as a saved <dir>-checksums.csv, as the checksums of dir2. Rows hold the
+// name and checksum of a file, followed by its size, mtime, permission bits
+// and owner when the CSV has them. Files left out by the selection options
+// are dropped, as they would be when listing a directory.
+func (c *comparison) loadChecksumManifest(path string) (map[string]fileEntry, error) {
+	checksums := make(map[string]fileEntry)
+
+	listed := make(map[string]bool)
+	for _, name := range c.fileList {
+		listed[name] = true
+	}
+
+	_, err := c.readCSVFile(path, 2, func(record []string) error {
+		name := filepath.FromSlash(record[0])
+		if !filepath.IsLocal(name) {
+			return fmt.Errorf("path %q is not relative to the compared directory", record[0])
+		}
+		if !c.manifestSelected(name, listed) || record[1] == "" {
+			return nil
+		}
+
+		entry := fileEntry{checksum: record[1]}
+		if len(record) >= 4 {
+			size, err := strconv.ParseInt(record[2], 10, 64)
+			if err != nil {
+				return fmt.Errorf("invalid size %q", record[2])
+			}
+			modTime, err := strconv.ParseInt(record[3], 10, 64)
+			if err != nil {
+				return fmt.Errorf("invalid mtime %q", record[3])
+			}
+			entry.size, entry.modTime = size, time.Unix(0, modTime)
+		}
+		if len(record) >= 5 {
+			mode, err := strconv.ParseUint(record[4], 8, 32)
+			if err != nil {
+				return fmt.Errorf("invalid permission bits %q", record[4])
+			}
+			entry.mode = os.FileMode(mode)
+		}
+		if len(record) >= 6 {
+			entry.owner = record[5]
+		}
+		checksums[name] = entry
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	c.manifestEntries = checksums
+	c.logf("# Checksums for %s read (%d files)\n", path, len(checksums))
+	return checksums, nil
+}
+
+// manifestSelected reports whether a row of the checksum manifest would have
+// been listed from a directory: it passes the patterns and -files-from, and
+// without -recursive only top-level files are, or with -max-depth those
+// within the depth.
+func (c *comparison) manifestSelected(name string, listed map[string]bool) bool {
+	if c.fileList != nil {
+		return listed[name] && c.selected(name)
+	}
+	depth := strings.Count(name, string(filepath.Separator))
+	if (!c.recursive && depth > 0) || (c.maxDepth >= 0 && depth > c.maxDepth) {
+		return false
+	}
+	return c.selected(name)
+}
+
+// reportManifestDifference prints a row of diff.csv listed in the checksum
+// manifest, which has no file to copy or diff: a file missing from dir1, or
+// one whose checksum or permission bits are not those expected.
+func (c *comparison) reportManifestDifference(record []string, file1 string) {
+	switch {
+	case record[1] == "":
+		c.itemf(" - missing: %s is listed in %s but not found\n", file1, c.checksumManifest)
+	case record[1] == record[2]:
+		c.itemf(" - permissions differ for %s and its entry in %s\n", file1, c.checksumManifest)
+	default:
+		c.itemf(" - checksum mismatch for %s: %s, expected %s\n", file1, record[1], record[2])
+	}
+}
+
+// checkManifestOptions rejects the options that need the files of dir2 when
+// it is a checksum manifest.
+func checkManifestOptions(o Options) error {
+	name := o.firstSet([]string{"-compare-mtime-as-tiebreak", "-dedup-stats", "-emit-sync", "-fail-fast", "-ignore-case",
+		"-low-memory", "-quick-hash", "-semver", "-signature-cmd", "-structure-only"})
+	if name != "" {
+		return fmt.Errorf("a checksum CSV cannot be compared with %s", name)
+	}
+	return nil
+}
@@ -0,0 +1,68 @@
+package compare
+
+import (
+	"bytes"
+	"strconv"
+)
+
+// ANSI escape sequences of the colors used.
+const (
+	colorReset  = "\x1b[0m"
+	colorBold   = "\x1b[1m"
+	colorRed    = "\x1b[31m"
+	colorGreen  = "\x1b[32m"
+	colorYellow = "\x1b[33m"
+	colorCyan   = "\x1b[36m"
+)
+
+// colored wraps text in color when colorOutput is set.
+func (c *comparison) colored(color, text string) string {
+	if !c.colorOutput {
+		return text
+	}
+	return color + text + colorReset
+}
+
+// coloredCount is colored for a count of the summary, left plain when it is
+// zero so the counts that matter stand out.
+func (c *comparison) coloredCount(color string, count int) string {
+	if count == 0 {
+		return strconv.Itoa(count)
+	}
+	return c.colored(color, strconv.Itoa(count))
+}
+
+// colorDiff colors a unified diff line by line when colorOutput is set: the
+// ---/+++ header bold, hunk headers cyan, removed lines red and added lines
+// green. Other lines, such as the notes of large or binary files, are left
+// as they are.
+func (c *comparison) colorDiff(diff []byte) []byte {
+	if !c.colorOutput {
+		return diff
+	}
+	var out bytes.Buffer
+	for _, line := range bytes.SplitAfter(diff, []byte("\n")) {
+		color := ""
+		switch {
+		case bytes.HasPrefix(line, []byte("--- ")), bytes.HasPrefix(line, []byte("+++ ")):
+			color = colorBold
+		case bytes.HasPrefix(line, []byte("@@ ")):
+			color = colorCyan
+		case bytes.HasPrefix(line, []byte("-")):
+			color = colorRed
+		case bytes.HasPrefix(line, []byte("+")):
+			color = colorGreen
+		}
+		if color == "" {
+			out.Write(line)
+			continue
+		}
+		// The reset goes before the newline, so a cut line cannot bleed
+		text := bytes.TrimSuffix(line, []byte("\n"))
+		out.WriteString(color)
+		out.Write(text)
+		out.WriteString(colorReset)
+		out.Write(line[len(text):])
+	}
+	return out.Bytes()
+}
@@ -0,0 +1,3215 @@
+// Package compare compares two directories, or container images, by file
+// checksums and writes the differences as CSV files and unified diffs.
+package compare
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"io/fs"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// comparison is the state of one run, set up from its Options by
+// newComparison, so that runs in the same process share nothing.
+type comparison struct {
+	chunkHashSize    int64
+	extraColumns     []string
+	checkPerms       bool
+	ignoreModeBits   os.FileMode
+	detectTruncate   bool
+	sortOrder        string
+	failFast         bool
+	pruneEmpty       bool
+	caseCollisions   string
+	collapseDirs     bool
+	resultsDB        string
+	lowMemory        bool
+	unordered        []string
+	ignoreHead       int64
+	ignoreTail       int64
+	ignoreEOL        bool
+	followSymlinks   bool
+	dryRun           bool
+	noCombinedCSV    bool
+	checkOwner       bool
+	fileList         []string
+	maxDepth         int
+	showIdentical    bool
+	showStats        bool
+	linesAdded       int
+	linesRemoved     int
+	identicalCount   int
+	structureOnly    bool
+	skipExisting     bool
+	noClobber        bool
+	semverMode       bool
+	recursive        bool
+	newHash          func() hash.Hash
+	workers          int
+	diffTool         string
+	quiet            bool
+	skipSizeMismatch bool
+	excludes         []string
+	extensions       []string
+	skipExtensions   []string
+	detectRenames    bool
+	includes         []string
+	printDigest      bool
+
+	// binaryMode is how generateDiff handles binary files, set by -binary-mode:
+	// skip, note or hexdump.
+	binaryMode string
+
+	// checksumManifest is the checksum CSV compared in place of dir2, whose
+	// files are only known by their rows, or empty when dir2 is a directory.
+	checksumManifest string
+	// manifestEntries holds the rows of checksumManifest by file name.
+	manifestEntries map[string]fileEntry
+
+	// colorOutput adds terminal colors to the diffs printed for two files and to
+	// the counts of the summary, set by -color.
+	colorOutput bool
+
+	// output receives the human-readable report of a comparison.
+	output io.Writer
+	// outputPath is the output directory of the run, which listFiles skips should
+	// it still turn up in a compared tree, such as through a symbolic link.
+	outputPath string
+	// checksumNames maps each compared directory to the base name of its checksum
+	// CSV.
+	checksumNames map[string]string
+	// hashBufferSize is the read buffer of hashing, set by -buffer-size.
+	hashBufferSize int64
+	// ignoreFinalNewline treats files with and without a newline at the end as
+	// equal, set by -ignore-final-newline.
+	ignoreFinalNewline bool
+
+	// csvDelimiter separates the fields of every CSV file written and read back,
+	// set by -delimiter.
+	csvDelimiter rune
+
+	// decompress makes .gz files compare by their decompressed content, set
+	// by -decompress.
+	decompress   bool
+	decompressMu sync.Mutex
+	// decompressed maps each .gz file decompressed so far to its copy.
+	decompressed map[string]string
+	// decompressDir holds the decompressed copies, created on first use and
+	// removed with the other temporary directories.
+	decompressDir string
+
+	// zips holds the .zip inputs, read in place and closed by cleanup.
+	zips []*zipInput
+	// extracted maps each zip entry extracted so far to its copy, kept in
+	// extractDir like the decompressed ones.
+	extracted  map[string]string
+	extractDir string
+
+	// useCache reuses the checksums of the checksum CSVs of an earlier run,
+	// set by -use-cache.
+	useCache bool
+	// sizeLimit is the size in MB above which files are only diffed by their
+	// last lineLimit lines, set by -size and -lines.
+	sizeLimit, lineLimit int
+	// emitSync, signatureCmd and manifestPath are the -emit-sync script, the
+	// -signature-cmd command and the -manifest CSV, empty when not asked for.
+	emitSync, signatureCmd, manifestPath string
+	// dedupStats and mtimeTiebreak are set by -dedup-stats and
+	// -compare-mtime-as-tiebreak.
+	dedupStats, mtimeTiebreak bool
+
+	// maxDiffBytes caps the size of each .diff, set by -max-diff-bytes. Zero
+	// leaves them whole.
+	maxDiffBytes int64
+	// truncatedDiffs holds the names of the files whose .diff was cut.
+	truncatedDiffs map[string]bool
+
+	// comparisonDigest is the -digest fingerprint of the run, empty unless
+	// the flag is set.
+	comparisonDigest string
+
+	// events is set by Options.Events.
+	events *eventWriter
+	// onFile is Options.OnFile.
+	onFile func(FileResult)
+
+	// useGitignore leaves the files ignored by the .gitignore files of the
+	// compared directories out, set by -use-gitignore.
+	useGitignore bool
+
+	// ignoreCase pairs file names that only differ in case, set by -ignore-case.
+	ignoreCase bool
+
+	// ignoreBlankLines leaves the lines holding nothing but white space out
+	// of the diffs, set by -ignore-blank-lines.
+	ignoreBlankLines bool
+	// commentPrefix leaves the lines starting with it, after any
+	// indentation, out of the diffs, set by -comment-prefix.
+	commentPrefix []byte
+
+	// tempDirs holds directories created for the run, removed by removeTempDirs.
+	tempDirs []string
+
+	// fullLarge makes generateDiff look for the first difference of files over
+	// the size limit instead of diffing their last lines, set by -full-large.
+	fullLarge bool
+
+	// meter is set by -progress.
+	meter *progressMeter
+
+	// mmapThreshold is the size from which files are memory-mapped for hashing,
+	// set by -mmap-threshold. Zero always reads them through a buffer.
+	mmapThreshold int64
+
+	// onlyStatuses holds the statuses of the rows kept in diff.csv, set by
+	// -only, or is nil to keep every row.
+	onlyStatuses map[string]bool
+	// leftOutCount is the number of differing files -only left out.
+	leftOutCount int
+
+	// progress is the server of -progress-socket.
+	progress *progressServer
+
+	// quickHash hashes the size and both ends of files instead of their
+	// whole content, set by -quick-hash.
+	quickHash bool
+	// confirmQuick hashes files whose quick checksums match in full before
+	// they are reported identical, set by -quick-hash-confirm.
+	confirmQuick bool
+
+	// renamedFrom maps the dir2 name of each file found renamed by
+	// -detect-renames to its dir1 name.
+	renamedFrom map[string]string
+
+	// retries is how many more times a transient error is retried, set by
+	// -retries.
+	retries int
+	// retriedCount is the number of transient errors retried, counted from
+	// the hashing workers.
+	retriedCount atomic.Int64
+
+	// chunkSlots bounds the -chunk-hash chunks hashed at once, across all the
+	// files the hashing workers hash, to -workers.
+	chunkSlots chan struct{}
+
+	// dir2Aliases maps the dir1 name a paired artifact, or with -ignore-case a
+	// file named in another case, is reported under to its actual name in dir2.
+	dir2Aliases map[string]string
+
+	// similarityThreshold is the similarity from which a modified file is a
+	// minor change, set by -similarity-threshold. Zero measures nothing.
+	similarityThreshold float64
+	// similarities holds the measured similarity of modified files by name.
+	similarities map[string]float64
+
+	// continueOnError is set by -continue-on-error.
+	continueOnError bool
+	skipMu          sync.Mutex
+	// fileErrors holds the errors of the files skipped so far, in the order
+	// they occurred.
+	fileErrors []error
+	// skippedFiles holds the names of the skipped files, which are left out
+	// of diff.csv on both sides.
+	skippedFiles map[string]bool
+
+	// listedInfos holds what the listing of generateChecksums found about each
+	// file, by its path joined to its directory, so the diff phase reuses it
+	// instead of stating every differing file again. -low-memory, which keeps
+	// nothing per file, leaves it empty.
+	listedInfos map[string]os.FileInfo
+
+	// printTreeHashes is set by -tree-hash.
+	printTreeHashes bool
+	// treeHashes are the -tree-hash hashes of both inputs.
+	treeHashes [2]string
+
+	// diffContext is the number of unchanged lines shown around each change, 3 by
+	// default as with diff -u, set by -context.
+	diffContext int
+	// ignoreWhitespace makes lines that only differ in white space equal, as
+	// with diff -w, set by -ignore-whitespace.
+	ignoreWhitespace bool
+
+	// verbosity is the level of diagnostics printed, set by -v, -vv or -vvv.
+	verbosity int
+	// diagnostics receives them, Options.Diagnostics or else Options.Output.
+	diagnostics   io.Writer
+	diagnosticsMu sync.Mutex
+}
+
+// hashAlgorithms are the -hash choices for file checksums.
+var hashAlgorithms = map[string]func() hash.Hash{
+	"md5":    md5.New,
+	"sha1":   sha1.New,
+	"sha256": sha256.New,
+	"crc32":  func() hash.Hash { return crc32.NewIEEE() },
+}
+
+func hashNames() map[string]bool {
+	names := make(map[string]bool)
+	for name := range hashAlgorithms {
+		names[name] = true
+	}
+	return names
+}
+
+// optionalColumns lists the extra diff.csv columns that can be requested with -columns.
+var optionalColumns = map[string]bool{
+	"mtime":    true,
+	"mode":     true,
+	"owner":    true,
+	"diffhash": true,
+}
+
+// fileEntry holds what is known about a scanned file.
+type fileEntry struct {
+	checksum string
+	size     int64
+	modTime  time.Time
+	mode     os.FileMode
+	// owner is uid:gid, or empty where it is not known
+	owner string
+}
+
+func (c *comparison) logf(format string, args ...any) {
+	fmt.Fprintf(c.output, format, args...)
+}
+
+// itemf prints a per-file line of output unless -quiet is set.
+func (c *comparison) itemf(format string, args ...any) {
+	if !c.quiet {
+		c.logf(format, args...)
+	}
+}
+
+// Result is the outcome of a comparison.
+type Result struct {
+	// Dir1 and Dir2 are the compared directories, which for container image
+	// inputs are the temporary directories the images were extracted to.
+	Dir1, Dir2 string
+	// OutputDir holds the CSVs and diffs, unless Options.OutputDir was empty
+	// or two files were compared, which only prints their diff.
+	OutputDir string
+	// Files lists every row of diff.csv. It is empty with StructureOnly and
+	// FailFast, which do not produce one.
+	Files []FileResult
+	// Differences is the number of differences found: files present on one
+	// side or with a non-empty diff, or directories with StructureOnly.
+	Differences int
+	// Identical is the number of files present on both sides with the same
+	// content, which are not listed in Files.
+	Identical int
+	// Digest is the comparison fingerprint requested with Options.Digest.
+	Digest string
+	// TreeHash1 and TreeHash2 are the hashes of Dir1 and Dir2 requested
+	// with Options.TreeHash.
+	TreeHash1, TreeHash2 string
+	// Errors lists the files skipped with Options.ContinueOnError, each
+	// error naming its file.
+	Errors []error
+	// Archive is the path of the archive written with Options.Archive.
+	Archive string
+}
+
+// FileResult describes one differing file.
+type FileResult struct {
+	Name string
+	// Status is added, removed, modified, mode or renamed.
+	Status string
+	// Checksums and sizes are empty and zero on the side missing the file.
+	Checksum1, Checksum2 string
+	Size1, Size2         int64
+	// RenamedFrom is the dir1 name of a renamed file.
+	RenamedFrom string
+	// Output is the path below the diffs directory of the .diff, or of the
+	// copy of a file present on one side. It is empty when there is none.
+	Output string
+	// Diff is the content of the .diff when Options.OutputDir is empty or
+	// two files were compared, as its file is removed before the comparison
+	// returns. It is nil otherwise, and for files without a .diff.
+	Diff []byte
+	// Truncated is set when the .diff was cut at Options.MaxDiffBytes.
+	Truncated bool
+	// Similarity is the share of lines a modified file kept, measured with
+	// Options.SimilarityThreshold, and Change is minor from the threshold on
+	// or major below it. Change is empty when it was not measured.
+	Similarity float64
+	Change     string
+}
+
+// Compare compares dir1 with dir2, either of which may be a docker:// image
+// reference. When both are regular files they are diffed directly. Each
+// comparison has a state of its own, so several can run at once.
+func Compare(dir1, dir2 string, opts Options) (Result, error) {
+	return CompareContext(context.Background(), dir1, dir2, opts)
+}
+
+// CompareContext is Compare stopping as soon as ctx is done. The file being
+// written at that point is removed, along with all temporary files, and the
+// error tells whether ctx was canceled or timed out.
+func CompareContext(ctx context.Context, dir1, dir2 string, opts Options) (Result, error) {
+	if err := opts.Validate(); err != nil {
+		return Result{}, err
+	}
+	return opts.newComparison().compare(ctx, dir1, dir2, opts)
+}
+
+// compare is CompareContext with the state c set up from opts.
+func (c *comparison) compare(ctx context.Context, dir1, dir2 string, opts Options) (result Result, err error) {
+	defer c.cleanup()
+	defer func() {
+		err = interrupted(ctx, err)
+	}()
+
+	if c.isFilePair(dir1, dir2) {
+		return c.compareFilePair(ctx, dir1, dir2, c.sizeLimit, c.lineLimit)
+	}
+
+	if opts.Archive != "" && opts.OutputDir == "" {
+		return Result{}, fmt.Errorf("-archive needs an output directory to write to")
+	}
+
+	outputDir := opts.OutputDir
+	if outputDir == "" {
+		tempDir, err := os.MkdirTemp("", "inline-compare-*")
+		if err != nil {
+			return Result{}, err
+		}
+		defer os.RemoveAll(tempDir)
+		outputDir = tempDir
+		c.verbosef(verboseDetails, "// temporary output directory %s\n", outputDir)
+	}
+
+	if opts.ProgressSocket != "" {
+		server, err := startProgressServer(opts.ProgressSocket)
+		if err != nil {
+			return Result{}, fmt.Errorf("starting progress socket: %v", err)
+		}
+		c.progress = server
+	}
+
+	result.OutputDir = opts.OutputDir
+	result.Dir1, err = c.prepareInput(ctx, dir1)
+	if err != nil {
+		return result, fmt.Errorf("preparing %s: %v", dir1, err)
+	}
+	result.Dir2, err = c.prepareInput(ctx, dir2)
+	if err != nil {
+		return result, fmt.Errorf("preparing %s: %v", dir2, err)
+	}
+	if isChecksumManifest(result.Dir2) {
+		if err := checkManifestOptions(opts); err != nil {
+			return result, err
+		}
+		c.checksumManifest = result.Dir2
+	}
+	for _, dir := range []string{result.Dir1, result.Dir2} {
+		if sameDir(outputDir, dir) {
+			return result, fmt.Errorf("output directory %s is the input directory %s, choose another with -out", outputDir, dir)
+		}
+		// Its CSVs and copies would be compared by the next run
+		if insideDir(outputDir, dir) {
+			return result, fmt.Errorf("output directory %s is inside the input directory %s, choose another with -out", outputDir, dir)
+		}
+	}
+	c.outputPath = outputDir
+	c.checksumNames = checksumBaseNames(result.Dir1, result.Dir2)
+	if c.checksumManifest != "" && sameDir(c.checksumManifest, c.checksumCSV(outputDir, result.Dir1)) {
+		return result, fmt.Errorf("checksum CSV %s would be overwritten by the checksums of %s, choose another output directory with -out", c.checksumManifest, result.Dir1)
+	}
+
+	var records [][]string
+	result.Differences, records, err = c.run(ctx, result.Dir1, result.Dir2, outputDir)
+	if err != nil {
+		return result, err
+	}
+	result.Digest = c.comparisonDigest
+	result.TreeHash1, result.TreeHash2 = c.treeHashes[0], c.treeHashes[1]
+	result.Errors = c.fileErrors
+
+	if !c.structureOnly && !c.failFast {
+		result.Files, err = c.fileResults(records, result.Dir1, result.Dir2, outputDir, opts.OutputDir == "")
+		if err != nil {
+			return result, err
+		}
+		result.Identical = c.identicalCount
+		c.logSummary(result)
+	}
+
+	if opts.HTMLReport {
+		indexFile, err := writeHTMLReport(outputDir, result)
+		if err != nil {
+			return result, fmt.Errorf("writing HTML report: %v", err)
+		}
+		c.logf("# HTML report generated at %s\n", indexFile)
+	}
+
+	if opts.MarkdownReport {
+		reportFile, err := writeMarkdownReport(outputDir, result)
+		if err != nil {
+			return result, fmt.Errorf("writing Markdown report: %v", err)
+		}
+		c.logf("# Markdown report generated at %s\n", reportFile)
+	}
+
+	if !opts.KeepChecksums {
+		for _, dir := range []string{result.Dir1, result.Dir2} {
+			// A checksum CSV compared with was not written by this run
+			if dir == c.checksumManifest {
+				continue
+			}
+			if err := os.Remove(c.checksumCSV(outputDir, dir)); err != nil && !os.IsNotExist(err) {
+				return result, err
+			}
+		}
+	}
+
+	if opts.Archive != "" {
+		result.Archive, err = writeDiffArchive(outputDir, opts.Archive, opts.ArchiveCSVs)
+		if err != nil {
+			return result, fmt.Errorf("writing archive: %v", err)
+		}
+		c.logf("# Archive of the differences written to %s\n", result.Archive)
+	}
+
+	return result, nil
+}
+
+// interrupted replaces err with the reason ctx ended, when it has.
+func interrupted(ctx context.Context, err error) error {
+	if err == nil {
+		return nil
+	}
+	switch ctx.Err() {
+	case context.DeadlineExceeded:
+		return fmt.Errorf("timed out: %w", ctx.Err())
+	case context.Canceled:
+		return fmt.Errorf("interrupted: %w", ctx.Err())
+	}
+	return err
+}
+
+// sameDir reports whether two paths name the same directory, or file.
+func sameDir(path1, path2 string) bool {
+	info1, err1 := os.Stat(path1)
+	info2, err2 := os.Stat(path2)
+	if err1 == nil && err2 == nil {
+		return os.SameFile(info1, info2)
+	}
+	abs1, err1 := filepath.Abs(path1)
+	abs2, err2 := filepath.Abs(path2)
+	return err1 == nil && err2 == nil && abs1 == abs2
+}
+
+// insideDir reports whether path is below dir, once both are made absolute
+// and their symbolic links resolved. path need not exist yet.
+func insideDir(path, dir string) bool {
+	rel, err := filepath.Rel(resolvePath(dir), resolvePath(path))
+	return err == nil && rel != "." && filepath.IsLocal(rel)
+}
+
+// resolvePath returns path made absolute with the symbolic links of its
+// longest existing part resolved.
+func resolvePath(path string) string {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return path
+	}
+	missing := ""
+	for dir := abs; ; dir = filepath.Dir(dir) {
+		if resolved, err := filepath.EvalSymlinks(dir); err == nil {
+			return filepath.Join(resolved, missing)
+		}
+		if dir == filepath.Dir(dir) {
+			return abs
+		}
+		missing = filepath.Join(filepath.Base(dir), missing)
+	}
+}
+
+// isOutputDir reports whether the directory described by info is outputPath.
+func (c *comparison) isOutputDir(info os.FileInfo) bool {
+	output, err := os.Stat(c.outputPath)
+	return err == nil && os.SameFile(info, output)
+}
+
+// checksumBaseNames names the checksum CSVs of dir1 and dir2 after their base
+// names, without the extension of a .zip input, numbered when the two are
+// the same so neither overwrites the other.
+func checksumBaseNames(dir1, dir2 string) map[string]string {
+	name1, name2 := checksumBaseName(dir1), checksumBaseName(dir2)
+	if name1 == name2 && dir1 != dir2 {
+		name1, name2 = name1+"-1", name2+"-2"
+	}
+	return map[string]string{dir1: name1, dir2: name2}
+}
+
+// checksumBaseName is the base name of dir for checksumBaseNames.
+func checksumBaseName(dir string) string {
+	name := filepath.Base(dir)
+	if isZipInput(dir) {
+		name = name[:len(name)-len(".zip")]
+	}
+	return name
+}
+
+// checksumCSV returns the path of the checksum CSV of dir in outputDir.
+func (c *comparison) checksumCSV(outputDir, dir string) string {
+	name, ok := c.checksumNames[dir]
+	if !ok {
+		name = checksumBaseName(dir)
+	}
+	return filepath.Join(outputDir, name+"-checksums.csv")
+}
+
+// DefaultOutputDir is the output directory the command line uses for a
+// comparison of dir1 and dir2, in the working directory and named after the
+// base names of the inputs.
+func DefaultOutputDir(dir1, dir2 string) string {
+	return inputName(dir1) + "-" + inputName(dir2)
+}
+
+// fileResults turns the rows of diff.csv into FileResults, with the content
+// of their .diff files when withDiffs is set.
+func (c *comparison) fileResults(records [][]string, dir1, dir2, outputDir string, withDiffs bool) ([]FileResult, error) {
+	outputs, err := c.readOutputIndex(outputDir)
+	if err != nil {
+		return nil, err
+	}
+
+	files := []FileResult{}
+	for _, record := range records {
+		file := c.fileResult(record, dir1, dir2)
+		file.Truncated = c.truncatedDiffs[record[0]]
+		if similarity, ok := c.similarities[record[0]]; ok {
+			file.Similarity, file.Change = similarity, c.changeClass(similarity)
+		}
+		if output, ok := outputs[record[0]]; ok {
+			path := filepath.Join(outputDir, "diffs", output)
+			if _, err := os.Stat(path); err == nil {
+				file.Output = output
+			}
+			if withDiffs && file.Output != "" && file.Status != "added" && file.Status != "removed" {
+				if file.Diff, err = os.ReadFile(path); err != nil {
+					return nil, err
+				}
+			}
+		}
+		files = append(files, file)
+	}
+
+	return files, nil
+}
+
+// fileResult describes a row of diff.csv with the sizes of its files.
+func (c *comparison) fileResult(record []string, dir1, dir2 string) FileResult {
+	file := FileResult{
+		Name:      record[0],
+		Checksum1: record[1],
+		Checksum2: record[2],
+	}
+	name1 := record[0]
+	file.Status = c.recordStatus(record)
+	if file.Status == "renamed" {
+		file.RenamedFrom = c.renamedFrom[record[0]]
+		name1 = file.RenamedFrom
+	}
+	file.Size1 = c.fileSize(filepath.Join(dir1, name1), record[1])
+	file.Size2 = c.fileSize(filepath.Join(dir2, c.dir2Name(record[0])), record[2])
+	if c.checksumManifest != "" {
+		file.Size2 = c.manifestEntries[record[0]].size
+	}
+	return file
+}
+
+// logSummary prints how many files were compared and how they compare.
+func (c *comparison) logSummary(result Result) {
+	counts := make(map[string]int)
+	for _, file := range result.Files {
+		counts[file.Status]++
+	}
+	summary := fmt.Sprintf("# Summary: %d files, %d identical, %s modified, %s added, %s removed",
+		result.Identical+len(result.Files)+c.leftOutCount, result.Identical, c.coloredCount(colorYellow, counts["modified"]),
+		c.coloredCount(colorGreen, counts["added"]), c.coloredCount(colorRed, counts["removed"]))
+	if counts["mode"] > 0 {
+		summary += fmt.Sprintf(", %s permissions changed", c.coloredCount(colorYellow, counts["mode"]))
+	}
+	if counts["renamed"] > 0 {
+		summary += fmt.Sprintf(", %s renamed", c.coloredCount(colorYellow, counts["renamed"]))
+	}
+	if c.showStats {
+		summary += fmt.Sprintf("; %d lines added, %d lines removed", c.linesAdded, c.linesRemoved)
+	}
+	c.logf("%s\n", summary)
+	if count := c.retriedCount.Load(); count > 0 {
+		c.logf("# %d transient errors retried\n", count)
+	}
+	if c.leftOutCount > 0 {
+		c.logf("# %d other differing files left out by -only\n", c.leftOutCount)
+	}
+
+	if c.similarityThreshold > 0 {
+		c.logf("# %d minor changes (similarity of at least %g), %d major changes\n", countChanges(result.Files, "minor"), c.similarityThreshold, countChanges(result.Files, "major"))
+	}
+
+	if len(c.truncatedDiffs) > 0 {
+		c.logf("# %d diffs truncated at %d bytes (-max-diff-bytes):\n", len(c.truncatedDiffs), c.maxDiffBytes)
+		for _, file := range result.Files {
+			if file.Truncated {
+				c.logf(" - %s\n", file.Name)
+			}
+		}
+	}
+}
+
+// countIdentical records a file whose two sides are identical, which is
+// listed with -show-identical.
+func (c *comparison) countIdentical(fileName string) {
+	c.identicalCount++
+	if c.showIdentical {
+		c.itemf(" - identical: %s\n", fileName)
+	}
+}
+
+// recordStatus returns the FileResult status of a diff.csv row.
+func (c *comparison) recordStatus(record []string) string {
+	if _, renamed := c.renamedFrom[record[0]]; renamed {
+		return "renamed"
+	}
+	switch {
+	case record[1] == "":
+		return "added"
+	case record[2] == "":
+		return "removed"
+	case record[1] == record[2]:
+		return "mode"
+	default:
+		return "modified"
+	}
+}
+
+// readOutputIndex reads index.csv back as a map from compared file names to
+// their output names in the diffs directory. Without a diff phase, as with
+// -dry-run, there is no index.csv and no outputs.
+func (c *comparison) readOutputIndex(outputDir string) (map[string]string, error) {
+	records, err := c.readCSVFile(filepath.Join(outputDir, "index.csv"), 2, nil)
+	if os.IsNotExist(err) {
+		return map[string]string{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	outputs := make(map[string]string)
+	for i, record := range records {
+		if i == 0 {
+			continue
+		}
+		outputs[record[0]] = record[1]
+	}
+	return outputs, nil
+}
+
+// fileSize returns the size of a file listed with checksum, or 0 when the
+// file is absent on that side.
+func (c *comparison) fileSize(filePath, checksum string) int64 {
+	if checksum == "" {
+		return 0
+	}
+	info, err := c.listedStat(filePath)
+	if err != nil {
+		return 0
+	}
+	return info.Size()
+}
+
+// cleanup releases what the run set up outside the output directory.
+func (c *comparison) cleanup() {
+	c.progress.phase("done")
+	if c.progress != nil {
+		c.progress.close()
+		c.verbosef(verboseDetails, "// progress socket %s closed\n", c.progress.path)
+	}
+	c.meter.finish()
+	for _, archive := range c.zips {
+		archive.reader.Close()
+	}
+	c.removeTempDirs()
+}
+
+func (c *comparison) run(ctx context.Context, dir1, dir2, outputDir string) (int, [][]string, error) {
+	// Create the output directory
+	err := os.MkdirAll(outputDir, 0755)
+	if err != nil {
+		return 0, nil, fmt.Errorf("creating output directory: %v", err)
+	}
+
+	c.logf("# Compare %s and %s\n", dir1, dir2)
+
+	if c.structureOnly {
+		count, err := c.compareStructure(dir1, dir2, outputDir)
+		if err != nil {
+			return 0, nil, fmt.Errorf("comparing directory structure: %v", err)
+		}
+		return count, nil, nil
+	}
+
+	if c.lowMemory {
+		rows, err := c.generateCombinedCSVLowMemory(ctx, dir1, dir2, c.useCache, outputDir)
+		if err != nil {
+			return 0, nil, fmt.Errorf("generating combined CSV: %v", err)
+		}
+		c.logf("# Combined CSV generated at %s\n", filepath.Join(outputDir, "diff.csv"))
+		return c.runDiffPhaseLowMemory(ctx, rows, dir1, dir2, outputDir, c.sizeLimit, c.lineLimit, c.emitSync)
+	}
+
+	checksums1, err := c.generateChecksums(ctx, dir1, c.useCache, outputDir, nil)
+	if err != nil {
+		return 0, nil, fmt.Errorf("generating checksums for %s: %v", dir1, err)
+	}
+
+	if c.failFast {
+		fileName, reason, err := c.firstDifference(ctx, dir2, checksums1)
+		if err != nil {
+			return 0, nil, fmt.Errorf("comparing %s: %v", dir2, err)
+		}
+		if fileName == "" {
+			return 0, nil, nil
+		}
+		c.logf("# Fail-fast: %s (%s)\n", fileName, reason)
+		return 1, nil, nil
+	}
+
+	var reference map[string]fileEntry
+	if c.skipSizeMismatch {
+		reference = checksums1
+	}
+	var checksums2 map[string]fileEntry
+	if c.checksumManifest != "" {
+		checksums2, err = c.loadChecksumManifest(c.checksumManifest)
+	} else {
+		checksums2, err = c.generateChecksums(ctx, dir2, c.useCache, outputDir, reference)
+	}
+	if err != nil {
+		return 0, nil, fmt.Errorf("generating checksums for %s: %v", dir2, err)
+	}
+
+	if c.printTreeHashes {
+		c.reportTreeHashes(dir1, dir2, checksums1, checksums2)
+	}
+
+	// A file skipped on one side is left out on the other as well, rather
+	// than reported as added or removed
+	for name := range c.skippedFiles {
+		delete(checksums1, name)
+		delete(checksums2, name)
+	}
+
+	if c.confirmQuick {
+		if err := c.confirmQuickMatches(dir1, dir2, checksums1, checksums2); err != nil {
+			return 0, nil, fmt.Errorf("confirming quick hashes: %v", err)
+		}
+	}
+
+	combined2 := checksums2
+	if c.semverMode {
+		var changes []versionChange
+		combined2, changes = c.pairVersions(checksums1, checksums2)
+		err = c.reportVersionChanges(changes, dir1, dir2, outputDir)
+		if err != nil {
+			return 0, nil, fmt.Errorf("reporting version changes: %v", err)
+		}
+	}
+	if c.ignoreCase {
+		combined2 = c.pairIgnoringCase(checksums1, checksums2)
+	}
+
+	records, err := c.generateCombinedCSV(checksums1, combined2, dir1, dir2, outputDir)
+	if err != nil {
+		return 0, nil, fmt.Errorf("generating combined CSV: %v", err)
+	}
+	if c.noCombinedCSV {
+		c.logf("# Combined comparison of %d files kept in memory, diff.csv not written\n", len(records))
+	} else {
+		c.logf("# Combined CSV generated at %s\n", filepath.Join(outputDir, "diff.csv"))
+	}
+
+	if c.printDigest {
+		c.comparisonDigest = c.computeDigest(checksums1, combined2)
+	}
+
+	if c.manifestPath != "" {
+		err = c.generateManifest(checksums1, checksums2, dir1, dir2, c.manifestPath)
+		if err != nil {
+			return 0, nil, fmt.Errorf("generating manifest: %v", err)
+		}
+		c.logf("# Manifest generated at %s\n", c.manifestPath)
+	}
+
+	if c.mtimeTiebreak {
+		err = c.generateIdenticalCSV(checksums1, checksums2, dir1, dir2, outputDir)
+		if err != nil {
+			return 0, nil, fmt.Errorf("generating identical CSV: %v", err)
+		}
+	}
+
+	if c.dedupStats {
+		err = c.reportDedupStats(checksums1, checksums2, dir1, dir2)
+		if err != nil {
+			return 0, nil, fmt.Errorf("computing dedup stats: %v", err)
+		}
+	}
+
+	if c.signatureCmd != "" {
+		err = c.generateSignatureReport(checksums1, checksums2, dir1, dir2, outputDir, c.signatureCmd)
+		if err != nil {
+			return 0, nil, fmt.Errorf("generating signature report: %v", err)
+		}
+	}
+
+	count, records, err := c.runDiffPhase(ctx, records, dir1, dir2, outputDir, c.sizeLimit, c.lineLimit, c.emitSync)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	// Written after the diffs, which measure the similarity of each file
+	if c.resultsDB != "" {
+		err = c.writeResultsDB(checksums1, checksums2, dir1, dir2, c.resultsDB)
+		if err != nil {
+			return 0, nil, fmt.Errorf("writing results database: %v", err)
+		}
+	}
+
+	return count, records, nil
+}
+
+// runDiffPhase works from the rows of diff.csv alone: it writes the sync
+// script and the per-file diffs, or with -dry-run only lists the rows. It
+// returns the number of differences along with the rows.
+func (c *comparison) runDiffPhase(ctx context.Context, records [][]string, dir1, dir2, outputDir string, sizeLimit, lineLimit int, emitSync string) (int, [][]string, error) {
+	if c.dryRun {
+		count := c.reportDryRun(records, dir2, outputDir)
+		return count, records, nil
+	}
+
+	c.progress.phase("diff")
+	if emitSync != "" {
+		err := c.generateSyncScript(records, dir1, dir2, emitSync)
+		if err != nil {
+			return 0, nil, fmt.Errorf("generating sync script: %v", err)
+		}
+		c.logf("# Sync script generated at %s (review it before running)\n", emitSync)
+	}
+
+	diffCount, err := c.compareFilesInCSV(ctx, records, dir1, dir2, sizeLimit, lineLimit, outputDir)
+	if err != nil {
+		return 0, nil, fmt.Errorf("comparing files: %v", err)
+	}
+
+	return diffCount, records, nil
+}
+
+func (c *comparison) hasColumn(name string) bool {
+	for _, column := range c.extraColumns {
+		if column == name {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *comparison) generateChecksums(ctx context.Context, dir string, useCache bool, outputDir string, reference map[string]fileEntry) (map[string]fileEntry, error) {
+	checksums := make(map[string]fileEntry)
+	_, err := c.scanChecksums(ctx, dir, useCache, outputDir, reference, func(fileName string, entry fileEntry) {
+		checksums[fileName] = entry
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return checksums, nil
+}
+
+// scanChecksums fills the checksum CSV of dir and hands every entry to emit
+// unless emit is nil. With -use-cache, files whose size and mtime still match
+// the existing CSV keep their cached checksum and only the others are hashed.
+// Files whose compared size differs from their reference entry are not
+// hashed. It returns the CSV path.
+func (c *comparison) scanChecksums(ctx context.Context, dir string, useCache bool, outputDir string, reference map[string]fileEntry, emit func(string, fileEntry)) (string, error) {
+	csvFile := c.checksumCSV(outputDir, dir)
+
+	var cached map[string]cachedChecksum
+	if useCache {
+		var err error
+		cached, err = c.readChecksumCache(csvFile)
+		if err != nil {
+			return "", fmt.Errorf("reading the -use-cache checksums: %v", err)
+		}
+	} else {
+		// Delete existing checksum file if it exists
+		if err := os.Remove(csvFile); err != nil && !os.IsNotExist(err) {
+			return "", err
+		}
+	}
+
+	files, err := c.listFiles(dir)
+	if err != nil {
+		return "", err
+	}
+
+	c.progress.phase("checksums " + dir)
+	// The checksum CSV is written in this order, whatever the walk order
+	// and -workers, so the same files always give the same bytes
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].path < files[j].path
+	})
+	known := make([]string, len(files))
+	reused := 0
+	for i, file := range files {
+		if entry, ok := cached[file.path]; ok && entry.current(file, c.quickHash) {
+			known[i] = entry.checksum
+			reused++
+		}
+	}
+
+	c.meter.start("Hashing "+dir, len(files))
+	checksums, err := c.hashFiles(ctx, dir, files, reference, known)
+	c.meter.finish()
+	if err != nil {
+		return "", err
+	}
+	files, checksums = c.withoutSkipped(files, checksums)
+
+	for i, file := range files {
+		if emit != nil {
+			c.listedInfos[filepath.Join(dir, file.path)] = file.FileInfo
+			emit(file.path, fileEntry{checksum: checksums[i], size: file.Size(), modTime: file.ModTime(), mode: file.Mode(), owner: fileOwner(file)})
+		}
+		// Print the file checksum
+		c.itemf(" - %s: %s\n", filepath.Join(dir, file.path), checksums[i])
+	}
+
+	err = c.writeChecksumCSV(csvFile, files, checksums)
+	if err != nil {
+		return "", err
+	}
+
+	if useCache {
+		c.logf("# Checksums for %s generated (%s, %d of %d reused from the cache)\n", dir, csvFile, reused, len(files))
+	} else {
+		c.logf("# Checksums for %s generated (%s)\n", dir, csvFile)
+	}
+
+	return csvFile, nil
+}
+
+// cachedChecksum is a row of a checksum CSV read back by -use-cache.
+type cachedChecksum struct {
+	checksum string
+	size     int64
+	modTime  int64
+}
+
+// current reports whether the cached checksum still holds for file. Size
+// placeholders of -skip-size-mismatch depend on the other side and are
+// never reused, and neither are quick checksums without -quick-hash or full
+// ones with it.
+func (c cachedChecksum) current(file listedFile, quick bool) bool {
+	return c.size == file.Size() && c.modTime == file.ModTime().UnixNano() && !strings.HasPrefix(c.checksum, "size:") &&
+		strings.HasPrefix(c.checksum, quickPrefix) == quick
+}
+
+// readChecksumCache reads the checksum CSV written by an earlier run. A
+// missing CSV, or rows of a CSV from before sizes and mtimes were recorded,
+// only mean that the files are hashed again. Any other row without a valid
+// size and mtime is an error naming its line, as the CSV was edited or only
+// partly written.
+func (c *comparison) readChecksumCache(csvFile string) (map[string]cachedChecksum, error) {
+	cached := make(map[string]cachedChecksum)
+
+	_, err := c.readCSVFile(csvFile, 2, func(record []string) error {
+		entry, ok, err := parseCachedChecksum(record)
+		if ok {
+			cached[record[0]] = entry
+		}
+		return err
+	})
+	if os.IsNotExist(err) {
+		return cached, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return cached, nil
+}
+
+// parseCachedChecksum parses a row of a checksum CSV, which has at least two
+// fields. ok is false for a row from before sizes and mtimes were recorded.
+func parseCachedChecksum(record []string) (entry cachedChecksum, ok bool, err error) {
+	if len(record) == 2 {
+		return cachedChecksum{}, false, nil
+	}
+	if len(record) < 4 {
+		return cachedChecksum{}, false, fmt.Errorf("expected a size and mtime after the checksum")
+	}
+	size, err := strconv.ParseInt(record[2], 10, 64)
+	if err != nil {
+		return cachedChecksum{}, false, fmt.Errorf("invalid size %q", record[2])
+	}
+	modTime, err := strconv.ParseInt(record[3], 10, 64)
+	if err != nil {
+		return cachedChecksum{}, false, fmt.Errorf("invalid mtime %q", record[3])
+	}
+	return cachedChecksum{checksum: record[1], size: size, modTime: modTime}, true, nil
+}
+
+// hashFiles checksums files across -workers goroutines and returns the
+// checksums in the order of files. Checksums already in known are kept, and a
+// file whose compared size differs from its entry in reference gets a size
+// placeholder instead of being read. The first error, or ctx being done,
+// stops the files not yet started and is returned, unless -continue-on-error
+// skips the file and leaves its checksum empty.
+func (c *comparison) hashFiles(ctx context.Context, dir string, files []listedFile, reference map[string]fileEntry, known []string) ([]string, error) {
+	checksums := make([]string, len(files))
+	jobs := make(chan int)
+	stop := make(chan struct{})
+	var (
+		wg       sync.WaitGroup
+		once     sync.Once
+		firstErr error
+	)
+
+	for w := 0; w < c.workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				select {
+				case <-stop:
+					continue
+				case <-ctx.Done():
+					continue
+				default:
+				}
+				if known != nil && known[i] != "" {
+					checksums[i] = known[i]
+					c.verbosef(verboseFiles, "// checksum of %s reused from the cache\n", filepath.Join(dir, files[i].path))
+					c.events.checksum(dir, files[i].path, files[i].Size(), checksums[i])
+					c.meter.step()
+					continue
+				}
+				if entry, ok := reference[files[i].path]; ok && !c.sameComparedSize(entry.size, files[i].Size()) {
+					checksums[i] = sizeChecksum(files[i].Size())
+					c.events.checksum(dir, files[i].path, files[i].Size(), checksums[i])
+					c.meter.step()
+					continue
+				}
+				filePath := filepath.Join(dir, files[i].path)
+				checksum, err := c.fileChecksum(filePath)
+				if err != nil && ctx.Err() == nil && c.skipFile(files[i].path, filePath, err) {
+					c.meter.step()
+					continue
+				}
+				if err != nil {
+					once.Do(func() {
+						firstErr = err
+						close(stop)
+					})
+					continue
+				}
+				checksums[i] = checksum
+				c.verbosef(verboseFiles, "// hashed %s (%s)\n", filePath, humanReadableSize(files[i].Size()))
+				c.progress.fileHashed(filePath)
+				c.events.checksum(dir, files[i].path, files[i].Size(), checksum)
+				c.meter.step()
+			}
+		}()
+	}
+
+feed:
+	for i := range files {
+		select {
+		case jobs <- i:
+		case <-stop:
+			break feed
+		case <-ctx.Done():
+			break feed
+		}
+	}
+	close(jobs)
+	wg.Wait()
+
+	if firstErr == nil {
+		firstErr = ctx.Err()
+	}
+	return checksums, firstErr
+}
+
+// sameComparedSize reports whether two files have the same size once the
+// -ignore-head-bytes and -ignore-tail-bytes are left out. With -ignore-eol,
+// -ignore-final-newline or -decompress the size says nothing about the
+// content, so any sizes may match.
+func (c *comparison) sameComparedSize(size1, size2 int64) bool {
+	if c.ignoreEOL || c.ignoreFinalNewline || c.decompress {
+		return true
+	}
+	_, length1 := c.contentRange(size1)
+	_, length2 := c.contentRange(size2)
+	return length1 == length2
+}
+
+// sizeChecksum is the checksum recorded by -skip-size-mismatch for a file
+// that is known to differ by its size alone.
+func sizeChecksum(size int64) string {
+	return "size:" + strconv.FormatInt(size, 10)
+}
+
+// listedFile is a file found by listFiles, with its path relative to the
+// listed directory.
+type listedFile struct {
+	path string
+	os.FileInfo
+}
+
+// listFiles returns the files walkFiles visits in dir, in its order.
+func (c *comparison) listFiles(dir string) ([]listedFile, error) {
+	var files []listedFile
+	err := c.walkFiles(dir, func(file listedFile) error {
+		files = append(files, file)
+		return nil
+	})
+	return files, err
+}
+
+// walkFiles hands visit the files directly inside dir, sorted by name, or
+// with -recursive every file below dir in walk order. Symbolic links are
+// skipped unless -follow-symlinks is set, and with -use-gitignore the files
+// the .gitignore files ignore. A .zip input has all of its entries visited,
+// at any depth. An error from visit stops the walk.
+func (c *comparison) walkFiles(dir string, visit func(listedFile) error) error {
+	if c.fileList != nil {
+		return c.walkNamedFiles(dir, visit)
+	}
+	if archive, name, ok := c.zipPath(dir); ok && name == "" {
+		return c.walkZip(archive, visit)
+	}
+
+	if c.recursive && c.followSymlinks {
+		root, err := os.Stat(dir)
+		if err != nil {
+			return err
+		}
+		return c.walkFollowingLinks(dir, "", []os.FileInfo{root}, c.newGitignores(dir), visit)
+	}
+
+	if c.recursive {
+		ignores := c.newGitignores(dir)
+		return filepath.WalkDir(dir, func(path string, entry fs.DirEntry, err error) error {
+			if err != nil && path != dir && c.skipFile("", path, err) {
+				if entry != nil && entry.IsDir() {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			if err == nil && entry.IsDir() && path != dir && c.beyondMaxDepth(dir, path) {
+				return filepath.SkipDir
+			}
+			if err == nil && entry.IsDir() && path != dir {
+				if info, err := entry.Info(); err == nil && c.isOutputDir(info) {
+					c.logf("# Skipping the output directory %s\n", path)
+					return filepath.SkipDir
+				}
+			}
+			if err != nil || entry.Type()&fs.ModeSymlink != 0 {
+				return err
+			}
+			rel, err := filepath.Rel(dir, path)
+			if err != nil {
+				return err
+			}
+			if entry.IsDir() {
+				if path != dir && ignores.ignored(rel, true) {
+					return filepath.SkipDir
+				}
+				return ignores.load(rel)
+			}
+			info, err := entry.Info()
+			if err != nil {
+				return err
+			}
+			if c.selected(rel) && !ignores.ignored(rel, false) {
+				return visit(listedFile{path: rel, FileInfo: info})
+			}
+			return nil
+		})
+	}
+
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	ignores := c.newGitignores(dir)
+	if err := ignores.load("."); err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		if entry.Mode()&os.ModeSymlink != 0 {
+			if !c.followSymlinks {
+				continue
+			}
+			target, ok := c.symlinkTarget(filepath.Join(dir, entry.Name()))
+			if !ok {
+				continue
+			}
+			entry = target
+		}
+		if !entry.IsDir() && c.selected(entry.Name()) && !ignores.ignored(entry.Name(), false) {
+			if err := visit(listedFile{path: entry.Name(), FileInfo: entry}); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// walkNamedFiles hands visit the files of -files-from that exist in dir. A
+// path missing from dir is left out, so it compares as added or removed.
+func (c *comparison) walkNamedFiles(dir string, visit func(listedFile) error) error {
+	for _, name := range c.fileList {
+		path := filepath.Join(dir, name)
+		info, inZip, err := c.statZipEntry(path)
+		if !inZip {
+			info, err = os.Lstat(path)
+		}
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if info.Mode()&os.ModeSymlink != 0 {
+			if !c.followSymlinks {
+				continue
+			}
+			target, ok := c.symlinkTarget(path)
+			if !ok {
+				continue
+			}
+			info = target
+		}
+		if !info.IsDir() && c.selected(name) {
+			if err := visit(listedFile{path: name, FileInfo: info}); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// uniqueCleanPaths returns paths cleaned, without duplicates, in their order.
+func uniqueCleanPaths(paths []string) []string {
+	seen := make(map[string]bool)
+	cleaned := []string{}
+	for _, path := range paths {
+		path = filepath.Clean(path)
+		if !seen[path] {
+			seen[path] = true
+			cleaned = append(cleaned, path)
+		}
+	}
+	return cleaned
+}
+
+// walkFollowingLinks hands visit the files below dir/rel in walk order,
+// following symbolic links. A link to a directory among ancestors, which
+// holds the directories leading down to rel, would loop and is skipped.
+func (c *comparison) walkFollowingLinks(dir, rel string, ancestors []os.FileInfo, ignores *gitignores, visit func(listedFile) error) error {
+	entries, err := os.ReadDir(filepath.Join(dir, rel))
+	if err != nil {
+		return err
+	}
+	if err := ignores.load(rel); err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		relPath := filepath.Join(rel, entry.Name())
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		if info.Mode()&os.ModeSymlink != 0 {
+			target, ok := c.symlinkTarget(filepath.Join(dir, relPath))
+			if !ok {
+				continue
+			}
+			info = target
+		}
+
+		if info.IsDir() {
+			if c.beyondMaxDepth(dir, filepath.Join(dir, relPath)) {
+				continue
+			}
+			if visited(ancestors, info) {
+				c.logf("# Skipping symlink loop %s\n", filepath.Join(dir, relPath))
+				continue
+			}
+			if c.isOutputDir(info) {
+				c.logf("# Skipping the output directory %s\n", filepath.Join(dir, relPath))
+				continue
+			}
+			if ignores.ignored(relPath, true) {
+				continue
+			}
+			err = c.walkFollowingLinks(dir, relPath, append(ancestors, info), ignores, visit)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		if c.selected(relPath) && !ignores.ignored(relPath, false) {
+			if err := visit(listedFile{path: relPath, FileInfo: info}); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// beyondMaxDepth reports whether the directory at path below root is deeper
+// than -max-depth, counting the directories directly in root as depth 1.
+func (c *comparison) beyondMaxDepth(root, path string) bool {
+	if c.maxDepth < 0 {
+		return false
+	}
+	rel, err := filepath.Rel(root, path)
+	if err != nil {
+		return false
+	}
+	return strings.Count(rel, string(filepath.Separator))+1 > c.maxDepth
+}
+
+// visited reports whether dir is one of ancestors, compared by device and
+// inode.
+func visited(ancestors []os.FileInfo, dir os.FileInfo) bool {
+	for _, ancestor := range ancestors {
+		if os.SameFile(ancestor, dir) {
+			return true
+		}
+	}
+	return false
+}
+
+// symlinkTarget returns what the symbolic link at path points to. A broken
+// link is reported and skipped rather than failing the run.
+func (c *comparison) symlinkTarget(path string) (os.FileInfo, bool) {
+	info, err := c.statRetried(path)
+	if err != nil {
+		c.logf("# Skipping broken symlink %s\n", path)
+		return nil, false
+	}
+	return info, true
+}
+
+// firstDifference hashes the files of dir one at a time and returns the name
+// of the first one that does not match checksums, or an empty name when the
+// directory matches completely.
+func (c *comparison) firstDifference(ctx context.Context, dir string, checksums map[string]fileEntry) (string, string, error) {
+	files, err := c.listFiles(dir)
+	if err != nil {
+		return "", "", err
+	}
+
+	seen := make(map[string]bool)
+	for _, file := range files {
+		if err := ctx.Err(); err != nil {
+			return "", "", err
+		}
+		entry, ok := checksums[file.path]
+		if !ok {
+			return file.path, "only in " + dir, nil
+		}
+		seen[file.path] = true
+
+		if !c.sameComparedSize(entry.size, file.Size()) {
+			return file.path, "size differs", nil
+		}
+		checksum, err := c.fileChecksum(filepath.Join(dir, file.path))
+		if err != nil {
+			return "", "", err
+		}
+		if checksum != entry.checksum {
+			return file.path, "content differs", nil
+		}
+		if c.permsDiffer(entry, fileEntry{checksum: checksum, mode: file.Mode(), owner: fileOwner(file)}) {
+			return file.path, "permissions differ", nil
+		}
+	}
+
+	var missing []string
+	for fileName := range checksums {
+		if !seen[fileName] {
+			missing = append(missing, fileName)
+		}
+	}
+	if len(missing) > 0 {
+		sort.Strings(missing)
+		return missing[0], "missing from " + dir, nil
+	}
+
+	return "", "", nil
+}
+
+func (c *comparison) fileChecksum(filePath string) (string, error) {
+	return c.checksumFile(filePath, c.quickHash)
+}
+
+// checksumFile is fileChecksum, only hashing the size and both ends of the
+// file with quick.
+func (c *comparison) checksumFile(filePath string, quick bool) (checksum string, err error) {
+	// A read failing halfway is retried from the start, with a new hash
+	err = c.retried(func() error {
+		checksum, err = c.hashFile(filePath, quick)
+		return err
+	})
+	return checksum, err
+}
+
+// hashFile is a single attempt of checksumFile, which opens the file itself
+// so that its retries are not multiplied by those of openContent.
+func (c *comparison) hashFile(filePath string, quick bool) (string, error) {
+	if archive, name, ok := c.zipPath(filePath); ok && name != "" && !c.decompresses(filePath) {
+		return c.hashZipEntry(archive, name, filePath, quick)
+	}
+
+	defer c.releaseContent(filePath)
+	path, err := c.contentPath(filePath)
+	if err != nil {
+		return "", err
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return "", err
+	}
+	start, length := c.contentRange(info.Size())
+	if quick {
+		return c.quickChecksum(file, start, length)
+	}
+	content := io.NewSectionReader(file, start, length)
+
+	if c.hashesNormalized(filePath) {
+		return c.normalizedChecksum(filePath, content, length)
+	}
+
+	if c.chunkHashSize > 0 {
+		return c.fileTreeChecksum(content, length)
+	}
+
+	hash := c.newHash()
+	mapped, err := c.hashMapped(hash, file, start, length)
+	if err != nil {
+		return "", err
+	}
+	if !mapped {
+		if err := c.copyHashed(hash, content, length); err != nil {
+			return "", err
+		}
+	}
+
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// hashesNormalized reports whether the content of filePath is normalized
+// before it is hashed, by -unordered, -ignore-eol or -ignore-final-newline.
+func (c *comparison) hashesNormalized(filePath string) bool {
+	return c.sortsLines(filePath) || c.ignoreEOL || c.ignoreFinalNewline
+}
+
+// normalizedChecksum hashes the length bytes of content, the compared part of
+// filePath, as hashesNormalized requires.
+func (c *comparison) normalizedChecksum(filePath string, content io.Reader, length int64) (string, error) {
+	if c.sortsLines(filePath) {
+		data, err := io.ReadAll(content)
+		if err != nil {
+			return "", err
+		}
+		hash := c.newHash()
+		hash.Write(c.normalizeContent(filePath, data))
+		return hex.EncodeToString(hash.Sum(nil)), nil
+	}
+
+	hash := c.newHash()
+	var w io.Writer = hash
+	final := &finalNewlineWriter{w: w}
+	if c.ignoreFinalNewline {
+		w = final
+	}
+	eol := &crlfWriter{w: w}
+	if c.ignoreEOL {
+		w = eol
+	}
+	if err := c.copyHashed(w, content, length); err != nil {
+		return "", err
+	}
+	if err := eol.flush(); err != nil {
+		return "", err
+	}
+	if err := final.flush(); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// copyHashed copies the length bytes of content to w, a hash, through a
+// buffer of hashBufferSize, or of length for a shorter content so that
+// small files do not each allocate a large buffer.
+func (c *comparison) copyHashed(w io.Writer, content io.Reader, length int64) error {
+	buf := make([]byte, max(1, min(c.hashBufferSize, length)))
+	_, err := io.CopyBuffer(w, content, buf)
+	return err
+}
+
+// contentRange returns the offset and length of the part of a file of the
+// given size that is compared, after -ignore-head-bytes and -ignore-tail-bytes.
+func (c *comparison) contentRange(size int64) (int64, int64) {
+	length := size - c.ignoreHead - c.ignoreTail
+	if length < 0 {
+		return 0, 0
+	}
+	return c.ignoreHead, length
+}
+
+// trimTail cuts the ignored tail bytes from the last lines of a large file.
+// The ignored head is not part of the compared tail and is left alone.
+func (c *comparison) trimTail(data []byte) []byte {
+	if int64(len(data)) <= c.ignoreTail {
+		return data[:0]
+	}
+	return data[:int64(len(data))-c.ignoreTail]
+}
+
+// needsNormalization reports whether the content of filePath is rewritten by
+// diffContent before it is diffed.
+func (c *comparison) needsNormalization(filePath string) bool {
+	return c.ignoreEOL || c.ignoreFinalNewline || c.sortsLines(filePath) || c.stripsLines()
+}
+
+// sortsLines reports whether filePath matches -unordered, in which case it
+// has to be hashed from memory.
+func (c *comparison) sortsLines(filePath string) bool {
+	return matchesAny(c.unordered, filepath.Base(filePath))
+}
+
+// normalizeContent applies the content rewrites requested on the command line
+// to an in-memory copy of a file, identically for hashing and diffing.
+func (c *comparison) normalizeContent(filePath string, data []byte) []byte {
+	if c.ignoreEOL {
+		data = bytes.ReplaceAll(data, []byte("\r\n"), []byte("\n"))
+	}
+	if c.ignoreFinalNewline && len(data) > 0 && data[len(data)-1] != '\n' {
+		data = append(data[:len(data):len(data)], '\n')
+	}
+	if c.sortsLines(filePath) {
+		data = sortLines(data)
+	}
+	return data
+}
+
+// crlfWriter writes to w with every \r\n turned into \n, so -ignore-eol can
+// hash files without holding them in memory. A \r at the end of one write is
+// held back until the next shows whether a \n follows; flush writes it out.
+type crlfWriter struct {
+	w  io.Writer
+	cr bool
+}
+
+func (c *crlfWriter) Write(p []byte) (int, error) {
+	out := make([]byte, 0, len(p)+1)
+	if c.cr && len(p) > 0 {
+		if p[0] != '\n' {
+			out = append(out, '\r')
+		}
+		c.cr = false
+	}
+	for i, b := range p {
+		if b == '\r' {
+			if i == len(p)-1 {
+				c.cr = true
+				continue
+			}
+			if p[i+1] == '\n' {
+				continue
+			}
+		}
+		out = append(out, b)
+	}
+	if _, err := c.w.Write(out); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (c *crlfWriter) flush() error {
+	if !c.cr {
+		return nil
+	}
+	c.cr = false
+	_, err := c.w.Write([]byte{'\r'})
+	return err
+}
+
+// finalNewlineWriter writes to w and adds a \n on flush when what was
+// written does not end with one, so -ignore-final-newline can hash files
+// without holding them in memory. Nothing is added to an empty file.
+type finalNewlineWriter struct {
+	w       io.Writer
+	missing bool
+}
+
+func (f *finalNewlineWriter) Write(p []byte) (int, error) {
+	if len(p) > 0 {
+		f.missing = p[len(p)-1] != '\n'
+	}
+	return f.w.Write(p)
+}
+
+func (f *finalNewlineWriter) flush() error {
+	if !f.missing {
+		return nil
+	}
+	f.missing = false
+	_, err := f.w.Write([]byte{'\n'})
+	return err
+}
+
+// selected reports whether a file, given by its path relative to the
+// compared directory, passes -include, -exclude, -ext and -skip-ext.
+// Patterns containing a separator match the relative path, others the base
+// name at any depth.
+func (c *comparison) selected(relPath string) bool {
+	if len(c.includes) > 0 && !matchesPath(c.includes, relPath) {
+		return false
+	}
+	if len(c.extensions) > 0 && !hasExtension(c.extensions, relPath) {
+		return false
+	}
+	return !matchesPath(c.excludes, relPath) && !hasExtension(c.skipExtensions, relPath)
+}
+
+// hasExtension reports whether the base name of relPath ends in one of exts,
+// which are lower case and without their leading dot, ignoring case. An
+// extension such as tar.gz matches over several dots.
+func hasExtension(exts []string, relPath string) bool {
+	name := strings.ToLower(filepath.Base(relPath))
+	for _, ext := range exts {
+		if strings.HasSuffix(name, "."+ext) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchesPath(patterns []string, relPath string) bool {
+	for _, pattern := range patterns {
+		name := filepath.Base(relPath)
+		if strings.ContainsRune(pattern, filepath.Separator) {
+			name = relPath
+		}
+		if matched, _ := filepath.Match(pattern, name); matched {
+			return true
+		}
+	}
+	return false
+}
+
+func matchesAny(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		if matched, _ := filepath.Match(pattern, name); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// sortLines treats data as a set of newline-terminated records and returns
+// them in sorted order, so reordered records compare equal.
+func sortLines(data []byte) []byte {
+	if len(data) == 0 {
+		return data
+	}
+	lines := strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+	sort.Strings(lines)
+	return []byte(strings.Join(lines, "\n") + "\n")
+}
+
+// fileTreeChecksum splits the file into chunkHashSize chunks, hashes them in
+// parallel and returns the -hash digest of the chunk digests. The result only
+// matches digests produced with the same chunk size.
+func (c *comparison) fileTreeChecksum(file io.ReaderAt, size int64) (string, error) {
+	chunks := int((size + c.chunkHashSize - 1) / c.chunkHashSize)
+	if chunks == 0 {
+		chunks = 1
+	}
+
+	sums := make([][]byte, chunks)
+	errs := make([]error, chunks)
+	var wg sync.WaitGroup
+
+	for i := 0; i < chunks; i++ {
+		wg.Add(1)
+		c.chunkSlots <- struct{}{}
+		go func(i int) {
+			defer wg.Done()
+			defer func() { <-c.chunkSlots }()
+
+			hash := c.newHash()
+			section := io.NewSectionReader(file, int64(i)*c.chunkHashSize, c.chunkHashSize)
+			if err := c.copyHashed(hash, section, c.chunkHashSize); err != nil {
+				errs[i] = err
+				return
+			}
+			sums[i] = hash.Sum(nil)
+		}(i)
+	}
+	wg.Wait()
+
+	tree := c.newHash()
+	for i, sum := range sums {
+		if errs[i] != nil {
+			return "", errs[i]
+		}
+		tree.Write(sum)
+	}
+
+	return hex.EncodeToString(tree.Sum(nil)), nil
+}
+
+// streamTreeChecksum is fileTreeChecksum for content that can only be read
+// in order, whose chunks are hashed one after the other.
+func (c *comparison) streamTreeChecksum(content io.Reader, size int64) (string, error) {
+	chunks := max((size+c.chunkHashSize-1)/c.chunkHashSize, 1)
+	tree := c.newHash()
+	for i := int64(0); i < chunks; i++ {
+		hash := c.newHash()
+		if err := c.copyHashed(hash, io.LimitReader(content, c.chunkHashSize), c.chunkHashSize); err != nil {
+			return "", err
+		}
+		tree.Write(hash.Sum(nil))
+	}
+	return hex.EncodeToString(tree.Sum(nil)), nil
+}
+
+// writeChecksumCSV writes the checksum CSV of a directory in one go, once all
+// files are hashed, through one buffered writer in the order of files, which
+// are sorted by path. Each row holds the name, checksum, size, mtime,
+// permission bits and owner of a file.
+func (c *comparison) writeChecksumCSV(csvFile string, files []listedFile, checksums []string) error {
+	file, err := os.Create(csvFile)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	writer := c.newCSVWriter(file)
+	for i, f := range files {
+		err = writer.Write(checksumRow(f, checksums[i]))
+		if err != nil {
+			return err
+		}
+	}
+	writer.Flush()
+	if err := writer.Error(); err != nil {
+		return err
+	}
+
+	// A failed write back to disk only shows when the file is closed
+	return file.Close()
+}
+
+// checksumRow is the row of file in a checksum CSV.
+func checksumRow(file listedFile, checksum string) []string {
+	return []string{file.path, checksum, strconv.FormatInt(file.Size(), 10), strconv.FormatInt(file.ModTime().UnixNano(), 10),
+		fmt.Sprintf("%04o", file.Mode().Perm()), fileOwner(file)}
+}
+
+// generateCombinedCSV returns the rows of diff.csv for the files that differ
+// and writes them below a header row, unless -no-combined-csv keeps them in
+// memory only.
+func (c *comparison) generateCombinedCSV(checksums1, checksums2 map[string]fileEntry, dir1, dir2, outputDir string) ([][]string, error) {
+	if c.detectRenames {
+		c.detectRenamedFiles(checksums1, checksums2)
+	}
+	oldNames := c.renamedOldNames()
+
+	var records [][]string
+	for _, fileName := range c.allFileNames(checksums1, checksums2) {
+		if oldNames[fileName] {
+			continue
+		}
+		entry1 := checksums1[fileName]
+		if oldName, ok := c.renamedFrom[fileName]; ok {
+			entry1 = checksums1[oldName]
+		}
+		record, differs := c.combinedRecord(fileName, entry1, checksums2[fileName])
+		if !differs {
+			c.countIdentical(fileName)
+			continue
+		}
+		if !c.keptByOnly(record) {
+			continue
+		}
+		records = append(records, record)
+	}
+
+	if c.noCombinedCSV {
+		// A diff.csv left by an earlier run would no longer match
+		if err := os.Remove(filepath.Join(outputDir, "diff.csv")); err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		return records, nil
+	}
+	return records, c.writeCombinedCSV(outputDir, c.combinedHeaders(dir1, dir2), records)
+}
+
+// writeCombinedCSV writes diff.csv with headers and records.
+func (c *comparison) writeCombinedCSV(outputDir string, headers []string, records [][]string) error {
+	outputFile, err := os.Create(filepath.Join(outputDir, "diff.csv"))
+	if err != nil {
+		return err
+	}
+	defer outputFile.Close()
+
+	writer := c.newCSVWriter(outputFile)
+	if err := writer.Write(headers); err != nil {
+		return err
+	}
+	if err := writer.WriteAll(records); err != nil {
+		return err
+	}
+
+	return outputFile.Close()
+}
+
+func (c *comparison) combinedHeaders(dir1, dir2 string) []string {
+	headers := []string{"File Name", "Checksum " + dir1, "Checksum " + dir2}
+	if c.hasColumn("mtime") {
+		headers = append(headers, "mtime1", "mtime2")
+	}
+	if c.hasColumn("mode") {
+		headers = append(headers, "mode1", "mode2")
+	}
+	if c.hasColumn("owner") {
+		headers = append(headers, "owner1", "owner2")
+	}
+	if c.detectRenames {
+		headers = append(headers, "Status", "Renamed From")
+	} else if c.checkPerms || c.checkOwner {
+		headers = append(headers, "Status")
+	}
+	return headers
+}
+
+// combinedRecord builds the diff.csv row for a file and reports whether the
+// two sides differ, i.e. whether the row belongs in diff.csv at all.
+func (c *comparison) combinedRecord(fileName string, entry1, entry2 fileEntry) ([]string, bool) {
+	oldName, renamed := c.renamedFrom[fileName]
+	if !renamed && entry1.checksum == entry2.checksum && !c.permsDiffer(entry1, entry2) {
+		return nil, false
+	}
+
+	record := []string{fileName, entry1.checksum, entry2.checksum}
+	if c.hasColumn("mtime") {
+		record = append(record, formatModTime(entry1.modTime), formatModTime(entry2.modTime))
+	}
+	if c.hasColumn("mode") {
+		record = append(record, formatMode(entry1), formatMode(entry2))
+	}
+	if c.hasColumn("owner") {
+		record = append(record, entry1.owner, entry2.owner)
+	}
+	if c.detectRenames {
+		status := c.comparisonStatus(entry1, entry2)
+		if renamed {
+			status = "renamed"
+		}
+		record = append(record, status, oldName)
+	} else if c.checkPerms || c.checkOwner {
+		record = append(record, c.comparisonStatus(entry1, entry2))
+	}
+	return record, true
+}
+
+// allFileNames returns the union of the file names on both sides, sorted
+// according to -sort.
+func (c *comparison) allFileNames(checksums1, checksums2 map[string]fileEntry) []string {
+	fileNames := make(map[string]bool)
+	for fileName := range checksums1 {
+		fileNames[fileName] = true
+	}
+	for fileName := range checksums2 {
+		fileNames[fileName] = true
+	}
+
+	var sortedFileNames []string
+	for fileName := range fileNames {
+		sortedFileNames = append(sortedFileNames, fileName)
+	}
+	c.sortFileNames(sortedFileNames)
+
+	return sortedFileNames
+}
+
+// generateManifest writes every file from both directories with both
+// checksums and where it is present, whether or not the checksums match.
+func (c *comparison) generateManifest(checksums1, checksums2 map[string]fileEntry, dir1, dir2, manifestFile string) error {
+	outputFile, err := os.Create(manifestFile)
+	if err != nil {
+		return err
+	}
+	defer outputFile.Close()
+
+	writer := c.newCSVWriter(outputFile)
+
+	err = writer.Write([]string{"File Name", "Checksum " + dir1, "Checksum " + dir2, "Present"})
+	if err != nil {
+		return err
+	}
+
+	for _, fileName := range c.allFileNames(checksums1, checksums2) {
+		entry1, ok1 := checksums1[fileName]
+		entry2, ok2 := checksums2[fileName]
+		present := "both"
+		if !ok1 {
+			present = "dir2"
+		} else if !ok2 {
+			present = "dir1"
+		}
+		err = writer.Write([]string{fileName, entry1.checksum, entry2.checksum, present})
+		if err != nil {
+			return err
+		}
+	}
+
+	writer.Flush()
+	if err := writer.Error(); err != nil {
+		return err
+	}
+	return outputFile.Close()
+}
+
+// generateIdenticalCSV lists files with the same content on both sides and
+// notes which side was modified more recently. This is informational only and
+// never counts as a difference.
+func (c *comparison) generateIdenticalCSV(checksums1, checksums2 map[string]fileEntry, dir1, dir2, outputDir string) error {
+	identicalFile := filepath.Join(outputDir, "identical.csv")
+	outputFile, err := os.Create(identicalFile)
+	if err != nil {
+		return err
+	}
+	defer outputFile.Close()
+
+	writer := c.newCSVWriter(outputFile)
+
+	err = writer.Write([]string{"File Name", "Checksum", "Newer"})
+	if err != nil {
+		return err
+	}
+
+	for _, fileName := range c.allFileNames(checksums1, checksums2) {
+		entry1, ok1 := checksums1[fileName]
+		entry2, ok2 := checksums2[fileName]
+		if !ok1 || !ok2 || entry1.checksum != entry2.checksum {
+			continue
+		}
+		newer := "same"
+		if entry1.modTime.After(entry2.modTime) {
+			newer = dir1
+		} else if entry2.modTime.After(entry1.modTime) {
+			newer = dir2
+		}
+		err = writer.Write([]string{fileName, entry1.checksum, newer})
+		if err != nil {
+			return err
+		}
+	}
+
+	writer.Flush()
+	if err := writer.Error(); err != nil {
+		return err
+	}
+	if err := outputFile.Close(); err != nil {
+		return err
+	}
+
+	c.logf("# Identical files listed in %s\n", identicalFile)
+
+	return nil
+}
+
+// sortFileNames orders names according to -sort. dir-then-name keeps the
+// files of each parent directory together instead of interleaving them.
+func (c *comparison) sortFileNames(names []string) {
+	sort.Slice(names, func(i, j int) bool {
+		return c.fileNameLess(names[i], names[j])
+	})
+}
+
+func (c *comparison) fileNameLess(a, b string) bool {
+	if c.semverMode {
+		if less, ok := semverLess(a, b); ok {
+			return less
+		}
+	}
+	if c.sortOrder != "dir-then-name" {
+		return a < b
+	}
+	dirA, dirB := filepath.Dir(a), filepath.Dir(b)
+	if dirA != dirB {
+		return dirA < dirB
+	}
+	return filepath.Base(a) < filepath.Base(b)
+}
+
+// formatModTime renders a modification time as ISO 8601, or an empty string
+// when the file is missing on that side.
+func formatModTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.UTC().Format(time.RFC3339)
+}
+
+// permsDiffer reports whether -check-mode or -check-owner should flag the
+// pair, ignoring the bits selected by -ignore-mode-bits. Files missing on one
+// side never count. Windows only has a read-only attribute, so only the owner
+// write bit is compared there, and an unknown owner never differs.
+func (c *comparison) permsDiffer(entry1, entry2 fileEntry) bool {
+	if entry1.checksum == "" || entry2.checksum == "" {
+		return false
+	}
+	if c.checkOwner && entry1.owner != "" && entry2.owner != "" && entry1.owner != entry2.owner {
+		return true
+	}
+	if !c.checkPerms {
+		return false
+	}
+	mask := os.ModePerm &^ c.ignoreModeBits
+	if runtime.GOOS == "windows" {
+		mask &= 0200
+	}
+	return entry1.mode.Perm()&mask != entry2.mode.Perm()&mask
+}
+
+// comparisonStatus classifies a file from its entries on both sides. A
+// missing side has an empty checksum.
+func (c *comparison) comparisonStatus(entry1, entry2 fileEntry) string {
+	switch {
+	case entry1.checksum == "":
+		return "added"
+	case entry2.checksum == "":
+		return "removed"
+	case entry1.checksum != entry2.checksum:
+		return "modified"
+	case c.permsDiffer(entry1, entry2):
+		return "mode"
+	}
+	return "identical"
+}
+
+func formatMode(entry fileEntry) string {
+	if entry.checksum == "" {
+		return ""
+	}
+	return fmt.Sprintf("%04o", entry.mode.Perm())
+}
+
+// readCombinedCSV returns the rows of diff.csv without the header.
+func (c *comparison) readCombinedCSV(outputDir string) ([][]string, error) {
+	records, err := c.readCSVFile(filepath.Join(outputDir, "diff.csv"), 3, nil)
+	if err != nil {
+		return nil, err
+	}
+	if len(records) == 0 {
+		return nil, nil
+	}
+
+	return records[1:], nil
+}
+
+// compareFilesInCSV copies or diffs the files of records, the rows of
+// diff.csv, into the diffs directory and returns the number of differences.
+func (c *comparison) compareFilesInCSV(ctx context.Context, records [][]string, dir1, dir2 string, sizeLimit int, lineLimit int, outputDir string) (int, error) {
+	p, err := c.startDiffPhase(dir1, dir2, sizeLimit, lineLimit, outputDir, len(records))
+	if err != nil {
+		return 0, err
+	}
+	defer c.meter.finish()
+	if err := c.compareBatch(ctx, p, records); err != nil {
+		return 0, err
+	}
+	return c.finishDiffPhase(p)
+}
+
+// diffPhase is what compareFilesInCSV carries from one batch of rows of
+// diff.csv to the next: where the outputs go and the names they were given,
+// the values of the columns filled in from the diffs, and the counts.
+type diffPhase struct {
+	dir1, dir2, outputDir, diffDir string
+	sizeLimitInBytes, lineLimit    int
+	manifest                       *diffManifest
+	namer                          *outputNamer
+	collapsed                      *collapsedDirs
+	annotations                    map[string][]string
+	diffCount                      int
+	addedCount, removedCount       int
+}
+
+// startDiffPhase prepares the diffs directory for total rows of diff.csv,
+// handed to compareBatch in one or more batches.
+func (c *comparison) startDiffPhase(dir1, dir2 string, sizeLimit, lineLimit int, outputDir string, total int) (*diffPhase, error) {
+	diffDir := filepath.Join(outputDir, "diffs")
+	err := os.MkdirAll(diffDir, 0755)
+	if err != nil {
+		return nil, err
+	}
+
+	manifest, err := c.loadDiffManifest(filepath.Join(outputDir, "diffs-manifest.csv"))
+	if err != nil {
+		return nil, err
+	}
+
+	p := &diffPhase{
+		dir1: dir1, dir2: dir2, outputDir: outputDir, diffDir: diffDir,
+		sizeLimitInBytes: sizeLimit * 1024 * 1024, lineLimit: lineLimit,
+		manifest: manifest, namer: c.newOutputNamer(), collapsed: c.newCollapsedDirs(),
+		annotations: make(map[string][]string),
+	}
+	c.logf("# Start comparing files\n")
+	c.meter.start("Comparing", total)
+	return p, nil
+}
+
+// compareBatch copies or diffs the files of records, the next rows of
+// diff.csv.
+func (c *comparison) compareBatch(ctx context.Context, p *diffPhase, records [][]string) error {
+	var err error
+
+	// Name every output up front, in the order of diff.csv, so the diffs can
+	// be generated by the pool while the loop below reports them in order
+	steps := make([]diffStep, len(records))
+	var tasks []*diffTask
+	for i, record := range records {
+		step := &steps[i]
+		step.file1 = filepath.Join(p.dir1, record[0])
+		step.file2 = filepath.Join(p.dir2, c.dir2Name(record[0]))
+		if _, ok := c.renamedFrom[record[0]]; ok {
+			continue
+		}
+
+		step.info1, step.err1 = c.listedStat(step.file1)
+		if c.checksumManifest != "" {
+			// Only the files of dir1 exist, to be copied when the CSV
+			// does not list them
+			if record[2] == "" {
+				step.err2 = fs.ErrNotExist
+				step.output = filepath.Join(p.diffDir, p.namer.nameIn(removedDir, record[0], ""))
+			}
+			continue
+		}
+		step.info2, step.err2 = c.listedStat(step.file2)
+		step.err1, step.err2 = notAFile(step.info1, step.err1), notAFile(step.info2, step.err2)
+		if os.IsNotExist(step.err1) {
+			step.output = filepath.Join(p.diffDir, p.namer.nameIn(addedDir, record[0], ""))
+		} else if os.IsNotExist(step.err2) {
+			step.output = filepath.Join(p.diffDir, p.namer.nameIn(removedDir, record[0], ""))
+		} else if record[1] != record[2] {
+			step.output = filepath.Join(p.diffDir, p.namer.name(record[0], ".diff"))
+			if _, err := os.Stat(step.output); err == nil && (c.noClobber || c.skipExisting && p.manifest.current(record[0], step.info1, step.info2)) {
+				continue
+			}
+			step.task = c.newDiffTask(step.file1, step.file2, record[1], record[2], step.output)
+			tasks = append(tasks, step.task)
+		}
+	}
+	stopDiffs := c.startDiffPool(ctx, tasks, p.sizeLimitInBytes, p.lineLimit)
+	defer stopDiffs()
+
+	for i, record := range records {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		c.meter.step()
+		step := steps[i]
+		file1, file2 := step.file1, step.file2
+		c.progress.difference(record[0])
+
+		if oldName, ok := c.renamedFrom[record[0]]; ok {
+			c.itemf(" - renamed %s -> %s\n", filepath.Join(p.dir1, oldName), file2)
+			c.fileHandled(record, p.dir1, p.dir2, p.diffDir, step.output, false)
+			p.diffCount++
+			continue
+		}
+
+		if c.checksumManifest != "" && record[2] != "" {
+			c.reportManifestDifference(record, file1)
+			c.fileHandled(record, p.dir1, p.dir2, p.diffDir, step.output, false)
+			p.diffCount++
+			continue
+		}
+
+		info1, info2 := step.info1, step.info2
+
+		if os.IsNotExist(step.err1) {
+			// file1 does not exist, copy file2 to diffs directory
+			dst := step.output
+			err = c.copyFile(file2, dst)
+			if err != nil && c.skipFile(record[0], file2, err) {
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			c.reportCopy(p.collapsed.add("added", record[0], p.dir1), file2, dst)
+			c.fileHandled(record, p.dir1, p.dir2, p.diffDir, step.output, false)
+			p.diffCount++
+			p.addedCount++
+		} else if os.IsNotExist(step.err2) {
+			// file2 does not exist, copy file1 to diffs directory
+			dst := step.output
+			err = c.copyFile(file1, dst)
+			if err != nil && c.skipFile(record[0], file1, err) {
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			c.reportCopy(p.collapsed.add("removed", record[0], p.dir2), file1, dst)
+			c.fileHandled(record, p.dir1, p.dir2, p.diffDir, step.output, false)
+			p.diffCount++
+			p.removedCount++
+		} else if record[1] == record[2] {
+			// Same content, only the permission bits differ
+			c.itemf(" - permissions differ for %s and %s\n", file1, file2)
+			c.fileHandled(record, p.dir1, p.dir2, p.diffDir, step.output, false)
+			p.diffCount++
+		} else {
+			// Both files exist, compare them
+			diffFile := step.output
+			differs := true
+			if step.task == nil && c.noClobber {
+				c.itemf(" - existing diff kept for %s and %s (-no-clobber)\n", file1, file2)
+			} else if step.task == nil {
+				c.itemf(" - diff kept for %s and %s (sources unchanged)\n", file1, file2)
+			} else {
+				<-step.task.done
+				step.task.log.flush()
+				differs, err = step.task.differs, step.task.err
+				if err != nil && ctx.Err() == nil && c.skipFile(record[0], file1+" - "+file2, err) {
+					os.Remove(diffFile)
+					continue
+				}
+				if err != nil {
+					return err
+				}
+				if !differs {
+					c.fileHandled(record, p.dir1, p.dir2, p.diffDir, step.output, false)
+					continue
+				}
+				err = p.manifest.record(record[0], info1, info2)
+				if err != nil {
+					return err
+				}
+			}
+			// Fresh and kept diffs alike are read as they are on disk, cut
+			// at -max-diff-bytes, so both hash and count the same
+			_, statErr := os.Stat(diffFile)
+			if statErr == nil && c.hasColumn("diffhash") {
+				hash, err := diffHash(diffFile)
+				if err != nil {
+					return err
+				}
+				p.annotations[record[0]] = append(p.annotations[record[0]], hash)
+			}
+			if statErr == nil && c.showStats {
+				added, removed, err := diffStats(diffFile)
+				if err != nil {
+					return err
+				}
+				c.linesAdded += added
+				c.linesRemoved += removed
+				p.annotations[record[0]] = append(p.annotations[record[0]], strconv.Itoa(added), strconv.Itoa(removed))
+			}
+			// Kept diffs were cut when they were generated
+			if step.task != nil && step.task.log.truncated {
+				c.truncatedDiffs[record[0]] = true
+				c.itemf(" - diff truncated at %d bytes: %s\n", c.maxDiffBytes, diffFile)
+			}
+			if c.similarityThreshold > 0 {
+				similarity := ""
+				if step.task != nil && step.task.log.measured {
+					c.similarities[record[0]] = step.task.log.similarity
+					similarity = formatSimilarity(step.task.log.similarity)
+				}
+				p.annotations[record[0]] = append(p.annotations[record[0]], similarity)
+			}
+			c.fileHandled(record, p.dir1, p.dir2, p.diffDir, step.output, true)
+			p.diffCount++
+		}
+	}
+
+	return nil
+}
+
+// notAFile turns the stat result of a listed file into fs.ErrNotExist when a
+// path is a file on one side and a directory on the other, such as x in dir1
+// and x/y in dir2: the directory, or the file in place of a parent, is no
+// file of that name.
+func notAFile(info os.FileInfo, err error) error {
+	if err == nil && info.IsDir() || errors.Is(err, syscall.ENOTDIR) {
+		return fs.ErrNotExist
+	}
+	return err
+}
+
+// finishDiffPhase reports the collapsed directories, writes what is only
+// known once every row is handled and returns the number of differences.
+func (c *comparison) finishDiffPhase(p *diffPhase) (int, error) {
+	p.collapsed.report()
+
+	var annotated []string
+	if c.hasColumn("diffhash") {
+		annotated = append(annotated, "Diff Hash")
+	}
+	if c.showStats {
+		annotated = append(annotated, "Lines Added", "Lines Removed")
+	}
+	if c.similarityThreshold > 0 {
+		annotated = append(annotated, "Similarity")
+	}
+	if len(annotated) > 0 && !c.noCombinedCSV {
+		if err := c.annotateCombinedCSV(p.outputDir, annotated, p.annotations); err != nil {
+			return 0, err
+		}
+	}
+
+	if err := p.namer.writeIndex(filepath.Join(p.outputDir, "index.csv")); err != nil {
+		return 0, err
+	}
+
+	if c.pruneEmpty {
+		if err := c.pruneEmptyDirs(p.diffDir); err != nil {
+			return 0, err
+		}
+	}
+
+	c.logf("# Files compared and differences stored in %s\n", p.diffDir)
+	if p.addedCount > 0 || p.removedCount > 0 {
+		c.logf("# %d added files copied to %s, %d removed files to %s\n",
+			p.addedCount, filepath.Join(p.diffDir, addedDir), p.removedCount, filepath.Join(p.diffDir, removedDir))
+	}
+
+	return p.diffCount, nil
+}
+
+// addedDir and removedDir are the subdirectories of the diffs directory
+// holding the copies of the files only in dir2 and only in dir1, with their
+// relative paths, so the side a copy comes from shows in its path. The .diff
+// files of modified files stay at the top.
+const (
+	addedDir   = "added"
+	removedDir = "removed"
+)
+
+// diffStep is what compareFilesInCSV found for a row of diff.csv before
+// reporting it: the files and their stat results, the path of its copy or
+// .diff, and the task generating the diff, if any.
+type diffStep struct {
+	file1, file2 string
+	info1, info2 os.FileInfo
+	err1, err2   error
+	output       string
+	task         *diffTask
+}
+
+// diffHash returns the MD5 of a .diff without its ---/+++ header, which
+// holds file names and timestamps, so the same difference hashes
+// the same across runs. A note line before the header, as written for large
+// files, is dropped with it.
+func diffHash(diffFile string) (string, error) {
+	data, err := os.ReadFile(diffFile)
+	if err != nil {
+		return "", err
+	}
+	rest := data
+	for i := 0; i < 3; i++ {
+		n := bytes.IndexByte(rest, '\n')
+		if n < 0 {
+			break
+		}
+		line := rest[:n]
+		rest = rest[n+1:]
+		if bytes.HasPrefix(line, []byte("+++ ")) {
+			data = rest
+			break
+		}
+	}
+	sum := md5.Sum(data)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// diffStats counts the lines a unified .diff adds and removes. The ---/+++
+// header and any note before the first hunk are not counted, so other
+// .diff contents count as nothing.
+func diffStats(diffFile string) (int, int, error) {
+	data, err := os.ReadFile(diffFile)
+	if err != nil {
+		return 0, 0, err
+	}
+	added, removed := countDiffLines(data)
+	return added, removed, nil
+}
+
+// countDiffLines counts the lines a unified diff adds and removes. The
+// ---/+++ header and any note before the first hunk are not counted, so other
+// contents count as nothing.
+func countDiffLines(diff []byte) (added, removed int) {
+	inHunk := false
+	for _, line := range bytes.Split(diff, []byte("\n")) {
+		switch {
+		case bytes.HasPrefix(line, []byte("@@ ")):
+			inHunk = true
+		case !inHunk:
+		case bytes.HasPrefix(line, []byte("+")):
+			added++
+		case bytes.HasPrefix(line, []byte("-")):
+			removed++
+		}
+	}
+	return added, removed
+}
+
+// annotateCombinedCSV rewrites diff.csv with the columns named by headers,
+// which can only be filled in once the diffs exist. values holds them by
+// file name, and rows without values get empty columns.
+func (c *comparison) annotateCombinedCSV(outputDir string, headers []string, values map[string][]string) error {
+	records, err := c.readCombinedCSV(outputDir)
+	if err != nil {
+		return err
+	}
+
+	file, err := os.Open(filepath.Join(outputDir, "diff.csv"))
+	if err != nil {
+		return err
+	}
+	existing, err := c.newCSVReader(file).Read()
+	file.Close()
+	if err != nil {
+		return err
+	}
+
+	outputFile, err := os.Create(filepath.Join(outputDir, "diff.csv"))
+	if err != nil {
+		return err
+	}
+	defer outputFile.Close()
+
+	writer := c.newCSVWriter(outputFile)
+
+	err = writer.Write(append(existing, headers...))
+	if err != nil {
+		return err
+	}
+	for _, record := range records {
+		row := values[record[0]]
+		if row == nil {
+			row = make([]string, len(headers))
+		}
+		err = writer.Write(append(record, row...))
+		if err != nil {
+			return err
+		}
+	}
+
+	writer.Flush()
+	if err := writer.Error(); err != nil {
+		return err
+	}
+	return outputFile.Close()
+}
+
+// reportCopy prints a copied one-sided file unless it is folded into a
+// collapsed directory entry, in which case only -v shows it.
+func (c *comparison) reportCopy(collapsedInto bool, src, dst string) {
+	if collapsedInto {
+		c.verbosef(verboseFiles, "// file copied from %s to %s\n", src, dst)
+		return
+	}
+	c.itemf("# File copied from %s to %s\n", src, dst)
+}
+
+// collapsedDirs counts files that belong to subtrees present on only one side,
+// keyed by status and the topmost missing directory.
+type collapsedDirs struct {
+	c      *comparison
+	counts map[string]map[string]int
+}
+
+func (c *comparison) newCollapsedDirs() *collapsedDirs {
+	return &collapsedDirs{c: c, counts: map[string]map[string]int{"added": {}, "removed": {}}}
+}
+
+// add records fileName under the topmost parent directory that does not exist
+// in otherDir and reports whether it was collapsed. Without
+// -collapse-added-dirs nothing is collapsed.
+func (d *collapsedDirs) add(status, fileName, otherDir string) bool {
+	if !d.c.collapseDirs {
+		return false
+	}
+
+	parent := filepath.Dir(fileName)
+	if parent == "." {
+		return false
+	}
+
+	dir := ""
+	for _, part := range strings.Split(parent, string(filepath.Separator)) {
+		dir = filepath.Join(dir, part)
+		if !d.c.pathExists(filepath.Join(otherDir, dir)) {
+			d.counts[status][dir]++
+			return true
+		}
+	}
+
+	return false
+}
+
+func (d *collapsedDirs) report() {
+	for _, status := range []string{"added", "removed"} {
+		dirs := make([]string, 0, len(d.counts[status]))
+		for dir := range d.counts[status] {
+			dirs = append(dirs, dir)
+		}
+		sort.Strings(dirs)
+		for _, dir := range dirs {
+			d.c.itemf(" - %s (directory) %s: %d files\n", status, dir+string(filepath.Separator), d.counts[status][dir])
+		}
+	}
+}
+
+// outputNamer hands out file names inside the diffs directory. Names that
+// differ only in case would overwrite each other on case-insensitive
+// filesystems, so with -case-collisions suffix later ones get a ~N suffix.
+type outputNamer struct {
+	c     *comparison
+	used  map[string]bool
+	index [][]string
+}
+
+func (c *comparison) newOutputNamer() *outputNamer {
+	return &outputNamer{c: c, used: make(map[string]bool)}
+}
+
+func (n *outputNamer) name(fileName, suffix string) string {
+	return n.nameIn("", fileName, suffix)
+}
+
+// nameIn is name for an output in the subdirectory dir of the diffs
+// directory.
+func (n *outputNamer) nameIn(dir, fileName, suffix string) string {
+	base := filepath.Join(dir, fileName)
+	output := base + suffix
+	if n.c.caseCollisions == "suffix" {
+		for i := 1; n.used[strings.ToLower(output)]; i++ {
+			output = fmt.Sprintf("%s~%d%s", base, i, suffix)
+		}
+		if output != base+suffix {
+			n.c.itemf(" - output for %s renamed to %s to avoid a case collision\n", fileName, output)
+		}
+	}
+	n.used[strings.ToLower(output)] = true
+	n.index = append(n.index, []string{fileName, output})
+	return output
+}
+
+// writeIndex records which output file belongs to which compared file.
+func (n *outputNamer) writeIndex(indexFile string) error {
+	file, err := os.Create(indexFile)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	writer := n.c.newCSVWriter(file)
+	err = writer.Write([]string{"File Name", "Output"})
+	if err != nil {
+		return err
+	}
+	err = writer.WriteAll(n.index)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// pruneEmptyDirs removes empty directories below root, deepest first, so a
+// directory emptied by its children's removal goes as well. root is kept.
+func (c *comparison) pruneEmptyDirs(root string) error {
+	var dirs []string
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() && path != root {
+			dirs = append(dirs, path)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for i := len(dirs) - 1; i >= 0; i-- {
+		entries, err := os.ReadDir(dirs[i])
+		if err != nil {
+			return err
+		}
+		if len(entries) == 0 {
+			if err := os.Remove(dirs[i]); err != nil {
+				return err
+			}
+			c.verbosef(verboseFiles, "// removed empty directory %s\n", dirs[i])
+		}
+	}
+
+	return nil
+}
+
+// generateDiff writes the differences of file1 and file2 to diffFile and
+// reports whether there was a real difference to show. Contents that turn
+// out equal after normalization write no .diff, and large files that only
+// differ before their last lines get a note and still count. What it
+// prints is collected in log.
+func (c *comparison) generateDiff(ctx context.Context, log *diffLog, file1, file2, checksum1, checksum2, diffFile string, sizeLimit, lineLimit int) (bool, error) {
+	// Remove a diff file left by an earlier run
+	if err := os.Remove(diffFile); err != nil && !os.IsNotExist(err) {
+		return false, fmt.Errorf("failed to remove existing diff file: %v", err)
+	}
+
+	// Nested files with -recursive keep their relative path under diffs
+	if err := os.MkdirAll(filepath.Dir(diffFile), 0755); err != nil {
+		return false, err
+	}
+
+	info1, err := c.contentInfo(file1)
+	if err != nil {
+		return false, err
+	}
+	info2, err := c.contentInfo(file2)
+	if err != nil {
+		return false, err
+	}
+
+	if c.detectTruncate && info1.Size() != info2.Size() {
+		short, long := file1, file2
+		shortSize, longSize := info1.Size(), info2.Size()
+		if shortSize > longSize {
+			short, long = file2, file1
+			shortSize, longSize = longSize, shortSize
+		}
+		truncated, err := c.isPrefix(short, long, shortSize)
+		if err != nil {
+			return false, err
+		}
+		if truncated {
+			note := fmt.Sprintf("truncated: %s (%d bytes) is a prefix of %s (%d bytes), truncated at offset %d\n", short, shortSize, long, longSize, shortSize)
+			if err := c.writeDiff(log, diffFile, []byte(note)); err != nil {
+				return false, err
+			}
+			log.itemf(" - truncated: %s is a prefix of %s at offset %d\n", short, long, shortSize)
+			return true, nil
+		}
+	}
+
+	binary1, err := c.isBinary(file1)
+	if err != nil {
+		return false, err
+	}
+	binary2, err := c.isBinary(file2)
+	if err != nil {
+		return false, err
+	}
+	if binary1 || binary2 {
+		if c.binaryMode == "skip" {
+			log.itemf(" - binary files %s and %s differ (not diffed)\n", file1, file2)
+			return true, nil
+		}
+		output, err := c.binaryDiff(file1, info1, checksum1, file2, info2, checksum2, sizeLimit)
+		if err != nil {
+			return false, err
+		}
+		if err := c.writeDiff(log, diffFile, output); err != nil {
+			return false, err
+		}
+		c.reportDiff(log, file1, info1, file2, info2)
+		return true, nil
+	}
+
+	var content1, content2 []byte
+
+	log.verbosef(verboseLimits, "// Size limit: %d\n", sizeLimit)
+	log.verbosef(verboseLimits, "// File Size 1: %d\n", info1.Size())
+	log.verbosef(verboseLimits, "// File Size 2: %d\n", info2.Size())
+
+	largeFiles := info1.Size() > int64(sizeLimit) || info2.Size() > int64(sizeLimit)
+	if c.diffTool != "" && !largeFiles {
+		// Stream the files through the external tool instead of loading them
+		differs, err := c.streamExternalDiff(ctx, log, file1, file2, diffFile)
+		if err != nil || !differs {
+			if err == nil {
+				log.itemf(" - no difference left between %s and %s after normalization\n", file1, file2)
+			}
+			return false, err
+		}
+		c.reportDiff(log, file1, info1, file2, info2)
+		return true, nil
+	}
+
+	if largeFiles && c.fullLarge && !c.needsNormalization(file1) && !c.ignoreWhitespace {
+		log.verbosef(verboseLimits, "// large files detected: %s - %s, looking for their first difference\n", file1, file2)
+		output, err := c.largeFileWindow(file1, info1, file2, info2, lineLimit)
+		if err != nil || output == nil {
+			if err == nil {
+				log.itemf(" - no difference left between %s and %s after normalization\n", file1, file2)
+			}
+			return false, err
+		}
+		if err := c.writeDiff(log, diffFile, output); err != nil {
+			return false, err
+		}
+		c.reportDiff(log, file1, info1, file2, info2)
+		return true, nil
+	}
+
+	if largeFiles {
+		log.verbosef(verboseLimits, "// large files detected: %s - %s, comparing last %d lines\n", file1, file2, lineLimit)
+		content1, err = c.readLastLines(file1, lineLimit)
+		if err != nil {
+			return false, err
+		}
+		content2, err = c.readLastLines(file2, lineLimit)
+		if err != nil {
+			return false, err
+		}
+		content1, content2 = c.trimTail(content1), c.trimTail(content2)
+	} else {
+		log.verbosef(verboseLimits, "// comparing entire files %s - %s \n", file1, file2)
+		content1, err = c.readComparedContent(file1)
+		if err != nil {
+			return false, err
+		}
+		content2, err = c.readComparedContent(file2)
+		if err != nil {
+			return false, err
+		}
+	}
+
+	content1 = c.diffContent(file1, content1)
+	content2 = c.diffContent(file2, content2)
+
+	var output []byte
+	if c.diffTool == "" {
+		output = c.unifiedDiff(file1, info1.ModTime(), content1, file2, info2.ModTime(), content2)
+		// Only a diff of whole files tells how much of them changed
+		if c.similarityThreshold > 0 && !largeFiles && len(output) > 0 {
+			log.similarity, log.measured = measureSimilarity(content1, content2, output), true
+		}
+	} else {
+		output, err = c.externalDiff(ctx, content1, content2)
+		if err != nil {
+			return false, err
+		}
+	}
+
+	if len(output) == 0 {
+		if !largeFiles {
+			log.itemf(" - no difference left between %s and %s after normalization\n", file1, file2)
+			return false, nil
+		}
+		if c.ignoreWhitespace || c.stripsLines() {
+			log.itemf(" - no difference left between the last %d lines of %s and %s after normalization\n", lineLimit, file1, file2)
+			return false, nil
+		}
+		// The checksums differ, so an empty tail diff would be misleading
+		output = []byte(fmt.Sprintf("Files %s and %s differ, but their last %d lines are identical.\n"+
+			"The difference lies outside the compared region: files over the size limit are only compared by their last lines.\n"+
+			"Use -full-large to find the first difference instead.\n",
+			file1, file2, lineLimit))
+		log.itemf(" - difference outside the last %d lines of %s and %s\n", lineLimit, file1, file2)
+		return true, c.writeDiff(log, diffFile, output)
+	}
+
+	if largeFiles {
+		// Say so in the .diff, which is read without the console report
+		note := fmt.Sprintf("Only the last %d lines were compared: the files are over the size limit, -full-large compares them whole.\n", lineLimit)
+		output = append([]byte(note), output...)
+	}
+
+	err = c.writeDiff(log, diffFile, output)
+	if err != nil {
+		return false, err
+	}
+
+	c.reportDiff(log, file1, info1, file2, info2)
+
+	return true, nil
+}
+
+func (c *comparison) reportDiff(log *diffLog, file1 string, info1 os.FileInfo, file2 string, info2 os.FileInfo) {
+	log.itemf(" - diff generated for %s (%s) and %s (%s)\n", file1, humanReadableSize(info1.Size()), file2, humanReadableSize(info2.Size()))
+	log.verbosef(verboseLimits, " __________________________________________________________\n")
+}
+
+// streamExternalDiff runs the -diff-tool command on two whole files with its
+// output written straight to diffFile, within -max-diff-bytes, so neither the
+// files nor the diff are held in memory. It reports whether the tool printed
+// anything; an empty diffFile is removed, and so is a partial one when ctx
+// ends the tool.
+func (c *comparison) streamExternalDiff(ctx context.Context, log *diffLog, file1, file2, diffFile string) (bool, error) {
+	path1, cleanup1, err := c.diffInput(file1)
+	if err != nil {
+		return false, err
+	}
+	defer cleanup1()
+	path2, cleanup2, err := c.diffInput(file2)
+	if err != nil {
+		return false, err
+	}
+	defer cleanup2()
+
+	out, err := os.Create(diffFile)
+	if err != nil {
+		return false, err
+	}
+
+	args := c.diffToolArgs(path1, path2)
+	c.verboseCommand(args...)
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	limiter := c.newDiffLimiter(out)
+	cmd.Stdout = limiter
+	cmd.Stderr = limiter
+	runErr := cmd.Run()
+
+	if ctx.Err() != nil {
+		out.Close()
+		os.Remove(diffFile)
+		return false, ctx.Err()
+	}
+	if limiter.size == 0 {
+		out.Close()
+		os.Remove(diffFile)
+		return false, runErr
+	}
+	log.truncated, err = limiter.finish()
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+// diffInput returns a path holding the compared content of filePath for an
+// external diff tool: the file itself when nothing is ignored or normalized,
+// otherwise a temporary copy that the returned function removes.
+func (c *comparison) diffInput(filePath string) (string, func(), error) {
+	if c.ignoreHead == 0 && c.ignoreTail == 0 && !c.needsNormalization(filePath) {
+		path, err := c.contentPath(filePath)
+		if err != nil {
+			return "", nil, err
+		}
+		return path, func() {}, nil
+	}
+
+	tmpFile, err := os.CreateTemp("", "diff-*.tmp")
+	if err != nil {
+		return "", nil, err
+	}
+	defer tmpFile.Close()
+	remove := func() { os.Remove(tmpFile.Name()) }
+	c.verbosef(verboseDetails, "// temporary copy %s of %s\n", tmpFile.Name(), filePath)
+
+	if c.needsNormalization(filePath) {
+		content, err := c.readComparedContent(filePath)
+		if err == nil {
+			_, err = tmpFile.Write(c.diffContent(filePath, content))
+		}
+		if err != nil {
+			remove()
+			return "", nil, err
+		}
+		return tmpFile.Name(), remove, nil
+	}
+
+	file, err := c.openContent(filePath)
+	if err != nil {
+		remove()
+		return "", nil, err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err == nil {
+		start, length := c.contentRange(info.Size())
+		_, err = io.Copy(tmpFile, io.NewSectionReader(file, start, length))
+	}
+	if err != nil {
+		remove()
+		return "", nil, err
+	}
+
+	return tmpFile.Name(), remove, nil
+}
+
+// externalDiff runs the -diff-tool command on temporary copies of the
+// compared contents and returns its output.
+func (c *comparison) externalDiff(ctx context.Context, content1, content2 []byte) ([]byte, error) {
+	tmpFile1, err := os.CreateTemp("", "file1-*.tmp")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(tmpFile1.Name())
+
+	tmpFile2, err := os.CreateTemp("", "file2-*.tmp")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(tmpFile2.Name())
+
+	if _, err := tmpFile1.Write(content1); err != nil {
+		return nil, err
+	}
+	if _, err := tmpFile2.Write(content2); err != nil {
+		return nil, err
+	}
+
+	args := c.diffToolArgs(tmpFile1.Name(), tmpFile2.Name())
+	c.verboseCommand(args...)
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	output, err := cmd.CombinedOutput()
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	if err != nil && len(output) == 0 {
+		return nil, err
+	}
+
+	return output, nil
+}
+
+// diffToolArgs returns the -diff-tool command line for two files. A -context
+// other than the default 3 is passed on as -U N.
+func (c *comparison) diffToolArgs(path1, path2 string) []string {
+	args := strings.Fields(c.diffTool)
+	if c.diffContext != 3 {
+		args = append(args, "-U", strconv.Itoa(c.diffContext))
+	}
+	if c.ignoreWhitespace {
+		args = append(args, "-w")
+	}
+	return append(args, path1, path2)
+}
+
+// isPrefix reports whether the first n bytes of long equal the content of short.
+func (c *comparison) isPrefix(short, long string, n int64) (bool, error) {
+	f1, err := c.openContent(short)
+	if err != nil {
+		return false, err
+	}
+	defer f1.Close()
+
+	f2, err := c.openContent(long)
+	if err != nil {
+		return false, err
+	}
+	defer f2.Close()
+
+	r1 := bufio.NewReader(f1)
+	r2 := bufio.NewReader(io.LimitReader(f2, n))
+	buf1 := make([]byte, 64*1024)
+	buf2 := make([]byte, 64*1024)
+	for {
+		n1, err1 := io.ReadFull(r1, buf1)
+		n2, err2 := io.ReadFull(r2, buf2)
+		if n1 != n2 || !bytes.Equal(buf1[:n1], buf2[:n2]) {
+			return false, nil
+		}
+		if err1 == io.EOF || err1 == io.ErrUnexpectedEOF {
+			return err2 == io.EOF || err2 == io.ErrUnexpectedEOF, nil
+		}
+		if err1 != nil {
+			return false, err1
+		}
+		if err2 != nil && err2 != io.EOF && err2 != io.ErrUnexpectedEOF {
+			return false, err2
+		}
+	}
+}
+
+// readLastLines returns the last n lines of a file like tail -n, reading it
+// backwards in blocks so only the end of a large file is touched. A final
+// line without a trailing newline counts as a line.
+func (c *comparison) readLastLines(filePath string, n int) ([]byte, error) {
+	file, err := c.openContent(filePath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if n <= 0 {
+		return nil, nil
+	}
+
+	const blockSize = 64 * 1024
+	size := info.Size()
+	end := size
+	start := int64(0)
+	newlines := 0
+	block := make([]byte, blockSize)
+
+scan:
+	for end > 0 {
+		offset := end - blockSize
+		if offset < 0 {
+			offset = 0
+		}
+		chunk := block[:end-offset]
+		if _, err := file.ReadAt(chunk, offset); err != nil {
+			return nil, err
+		}
+		for i := len(chunk) - 1; i >= 0; i-- {
+			// The newline ending the last line does not start another one
+			if chunk[i] != '\n' || offset+int64(i) == size-1 {
+				continue
+			}
+			newlines++
+			if newlines == n {
+				start = offset + int64(i) + 1
+				break scan
+			}
+		}
+		end = offset
+	}
+
+	content := make([]byte, size-start)
+	if _, err := file.ReadAt(content, start); err != nil && err != io.EOF {
+		return nil, err
+	}
+	return content, nil
+}
+
+// copyFile copies src to dst, creating the parent directories of dst that
+// nested names such as those of -recursive need.
+func (c *comparison) copyFile(src, dst string) error {
+	local, err := c.localPath(filepath.Clean(src))
+	if err != nil {
+		return err
+	}
+	sourceFile, err := c.openRetried(local)
+	if err != nil {
+		return err
+	}
+	defer sourceFile.Close()
+
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
+
+	destinationFile, err := os.Create(filepath.Clean(dst))
+	if err != nil {
+		return err
+	}
+	defer destinationFile.Close()
+
+	_, err = io.Copy(destinationFile, sourceFile)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func humanReadableSize(size int64) string {
+	const unit = 1024
+	if size < unit {
+		return fmt.Sprintf("%d B", size)
+	}
+	div, exp := int64(unit), 0
+	for n := size / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %cB", float64(size)/float64(div), "KMGTPE"[exp])
+}
+
+// readComparedContent reads the compared part of a file, without the ignored
+// head and tail bytes, into a single buffer of exactly that size.
+func (c *comparison) readComparedContent(filePath string) ([]byte, error) {
+	file, err := c.openContent(filePath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	start, length := c.contentRange(info.Size())
+
+	content := make([]byte, length)
+	if _, err := io.ReadFull(io.NewSectionReader(file, start, length), content); err != nil {
+		return nil, err
+	}
+
+	return content, nil
+}
@@ -0,0 +1,778 @@
+package compare
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/csv"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// writeTree creates the files of tree below dir, by their slash-separated
+// path relative to it.
+func writeTree(t *testing.T, dir string, tree map[string]string) {
+	t.Helper()
+	for name, content := range tree {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// testOptions are the command line defaults, printing nothing.
+func testOptions() Options {
+	opts := DefaultOptions()
+	opts.Output = nil
+	return opts
+}
+
+func TestCompareReturnsDiffsWithoutOutputDir(t *testing.T) {
+	root := t.TempDir()
+	dir1, dir2 := filepath.Join(root, "a"), filepath.Join(root, "b")
+	writeTree(t, dir1, map[string]string{"x.txt": "one\ntwo\n", "gone.txt": "bye\n"})
+	writeTree(t, dir2, map[string]string{"x.txt": "one\nthree\n"})
+
+	result, err := Compare(dir1, dir2, testOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Differences != 2 {
+		t.Fatalf("Differences = %d, want 2", result.Differences)
+	}
+	for _, file := range result.Files {
+		switch file.Name {
+		case "x.txt":
+			if !bytes.Contains(file.Diff, []byte("-two\n+three\n")) {
+				t.Errorf("Diff of x.txt = %q, want the change of its second line", file.Diff)
+			}
+		case "gone.txt":
+			if file.Diff != nil {
+				t.Errorf("Diff of the removed gone.txt = %q, want none", file.Diff)
+			}
+		}
+	}
+}
+
+func TestConcurrentComparesKeepTheirOptions(t *testing.T) {
+	root := t.TempDir()
+	dir1, dir2 := filepath.Join(root, "a"), filepath.Join(root, "b")
+	writeTree(t, dir1, map[string]string{"crlf.txt": "one\r\ntwo\r\n", "x.txt": "x\n"})
+	writeTree(t, dir2, map[string]string{"crlf.txt": "one\ntwo\n", "x.txt": "y\n"})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		ignoreEOL := i%2 == 0
+		var output strings.Builder
+		opts := testOptions()
+		opts.IgnoreEOL = ignoreEOL
+		opts.Output = &output
+		opts.OutputDir = filepath.Join(root, "out", strings.Repeat("x", i+1))
+		want := 2
+		if ignoreEOL {
+			want = 1
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			result, err := Compare(dir1, dir2, opts)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if result.Differences != want {
+				t.Errorf("with IgnoreEOL %v: Differences = %d, want %d", ignoreEOL, result.Differences, want)
+			}
+			if !strings.Contains(output.String(), opts.OutputDir) {
+				t.Errorf("with IgnoreEOL %v: output does not name its own directory %s:\n%s", ignoreEOL, opts.OutputDir, output.String())
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestLargeFilesDifferingBeforeTheirTailsCount(t *testing.T) {
+	root := t.TempDir()
+	dir1, dir2 := filepath.Join(root, "a"), filepath.Join(root, "b")
+	tail := strings.Repeat("same line\n", 200000)
+	writeTree(t, dir1, map[string]string{"big.log": "first\n" + tail})
+	writeTree(t, dir2, map[string]string{"big.log": "other\n" + tail})
+
+	opts := testOptions()
+	opts.SizeLimit = 1
+	result, err := Compare(dir1, dir2, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Differences != 1 {
+		t.Fatalf("Differences = %d, want 1", result.Differences)
+	}
+	if len(result.Files) != 1 || !bytes.Contains(result.Files[0].Diff, []byte("outside the compared region")) {
+		t.Errorf("Files = %+v, want big.log with a note on the difference outside its last lines", result.Files)
+	}
+}
+
+func TestCaseCollisionsGetSuffixedOutputs(t *testing.T) {
+	root := t.TempDir()
+	dir1, dir2, outputDir := filepath.Join(root, "a"), filepath.Join(root, "b"), filepath.Join(root, "out")
+	writeTree(t, dir1, map[string]string{"Foo": "one\n", "foo": "two\n"})
+	writeTree(t, dir2, map[string]string{"Foo": "uno\n", "foo": "dos\n"})
+
+	c := testOptions().newComparison()
+	defer c.cleanup()
+	records := [][]string{{"Foo", "1", "2"}, {"foo", "3", "4"}}
+	count, err := c.compareFilesInCSV(context.Background(), records, dir1, dir2, 100, 50, outputDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 2 {
+		t.Fatalf("count = %d, want 2", count)
+	}
+
+	for name, want := range map[string]string{"Foo.diff": "+uno\n", "foo~1.diff": "+dos\n"} {
+		diff, err := os.ReadFile(filepath.Join(outputDir, "diffs", name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Contains(diff, []byte(want)) {
+			t.Errorf("%s = %q, want it to hold %q", name, diff, want)
+		}
+	}
+
+	file, err := os.Open(filepath.Join(outputDir, "index.csv"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	rows, err := csv.NewReader(file).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := [][]string{{"File Name", "Output"}, {"Foo", "Foo.diff"}, {"foo", "foo~1.diff"}}
+	if !reflect.DeepEqual(rows, want) {
+		t.Errorf("index.csv = %q, want %q", rows, want)
+	}
+}
+
+func TestLowMemoryMatchesInMemory(t *testing.T) {
+	root := t.TempDir()
+	dir1, dir2 := filepath.Join(root, "a"), filepath.Join(root, "b")
+	writeTree(t, dir1, map[string]string{"x.txt": "x\n", "same.txt": "s\n", "sub/deep/q": "1\n", "gone.txt": "g\n"})
+	writeTree(t, dir2, map[string]string{"x.txt": "y\n", "same.txt": "s\n", "sub/deep/q": "2\n", "sub/new": "n\n"})
+
+	outputs := make(map[bool][]byte)
+	for _, lowMemory := range []bool{false, true} {
+		opts := testOptions()
+		opts.Recursive = true
+		opts.KeepChecksums = true
+		opts.LowMemory = lowMemory
+		opts.OutputDir = filepath.Join(root, fmt.Sprint("out-", lowMemory))
+		result, err := Compare(dir1, dir2, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if result.Differences != 4 {
+			t.Errorf("-low-memory=%v: Differences = %d, want 4", lowMemory, result.Differences)
+		}
+		for _, name := range []string{"a-checksums.csv", "b-checksums.csv", "diff.csv"} {
+			data, err := os.ReadFile(filepath.Join(opts.OutputDir, name))
+			if err != nil {
+				t.Fatal(err)
+			}
+			outputs[lowMemory] = append(outputs[lowMemory], data...)
+		}
+	}
+	if !bytes.Equal(outputs[true], outputs[false]) {
+		t.Errorf("-low-memory wrote\n%s\nwant\n%s", outputs[true], outputs[false])
+	}
+}
+
+// writeZip creates a .zip at path holding the files of tree, by their
+// slash-separated names.
+func writeZip(t *testing.T, path string, tree map[string]string) {
+	t.Helper()
+	file, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	w := zip.NewWriter(file)
+	for name, content := range tree {
+		entry, err := w.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := entry.Write([]byte(content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestZipEntriesAreComparedAtAnyDepth(t *testing.T) {
+	root := t.TempDir()
+	zip1, zip2 := filepath.Join(root, "release-1.0.zip"), filepath.Join(root, "release-1.1.zip")
+	writeZip(t, zip1, map[string]string{"top.txt": "same\n", "sub/deep/x.txt": "a\nb\n"})
+	writeZip(t, zip2, map[string]string{"top.txt": "same\n", "sub/deep/x.txt": "a\nc\n"})
+
+	result, err := Compare(zip1, zip2, testOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Differences != 1 || result.Identical != 1 {
+		t.Fatalf("Differences = %d, Identical = %d, want 1 and 1", result.Differences, result.Identical)
+	}
+	file := result.Files[0]
+	name := filepath.Join("sub", "deep", "x.txt")
+	if file.Name != name || !bytes.Contains(file.Diff, []byte("-b\n+c\n")) {
+		t.Fatalf("Files = %+v, want the change of %s", result.Files, name)
+	}
+	label := "--- " + filepath.Join(zip1, name) + "\t"
+	if !bytes.HasPrefix(file.Diff, []byte(label)) || bytes.Contains(file.Diff, []byte("inline-compare-zip-")) {
+		t.Errorf("Diff = %q, want it labeled %q", file.Diff, label)
+	}
+}
+
+func TestMaxDiffBytesCutsDiffsAsTheyAreWritten(t *testing.T) {
+	root := t.TempDir()
+	dir1, dir2 := filepath.Join(root, "a"), filepath.Join(root, "b")
+	long := strings.Repeat("x", 2000)
+	writeTree(t, dir1, map[string]string{
+		"small.txt": "one\n",
+		"lines.txt": strings.Repeat("old line\n", 200),
+		"long.txt":  long + "\n",
+	})
+	writeTree(t, dir2, map[string]string{
+		"small.txt": "two\n",
+		"lines.txt": strings.Repeat("new line\n", 200),
+		"long.txt":  long + "y\n",
+	})
+
+	tests := []struct {
+		name      string
+		truncated bool
+		ending    string
+	}{
+		{"small.txt", false, "+two\n"},
+		{"lines.txt", true, "-old line\n... diff truncated ("},
+		{"long.txt", true, "@@ -1 +1 @@\n... diff truncated ("},
+	}
+
+	var output strings.Builder
+	opts := testOptions()
+	opts.Output = &output
+	opts.MaxDiffBytes = 1000
+	opts.OutputDir = filepath.Join(root, "out")
+	result, err := Compare(dir1, dir2, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := make(map[string]FileResult)
+	for _, file := range result.Files {
+		files[file.Name] = file
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			diff, err := os.ReadFile(filepath.Join(opts.OutputDir, "diffs", tt.name+".diff"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if files[tt.name].Truncated != tt.truncated {
+				t.Errorf("Truncated = %v, want %v", files[tt.name].Truncated, tt.truncated)
+			}
+			kept, marker, cut := strings.Cut(string(diff), "... diff truncated (")
+			if cut != tt.truncated {
+				t.Fatalf("diff = %q, want a marker: %v", diff, tt.truncated)
+			}
+			if !strings.Contains(string(diff), tt.ending) {
+				t.Errorf("diff = %q, want it to hold %q", diff, tt.ending)
+			}
+			if cut && (len(kept) > int(opts.MaxDiffBytes)+1 || !strings.HasSuffix(marker, " bytes omitted)\n")) {
+				t.Errorf("diff = %q, want at most %d bytes before the marker line", diff, opts.MaxDiffBytes)
+			}
+		})
+	}
+	if !strings.Contains(output.String(), "# 2 diffs truncated at 1000 bytes (-max-diff-bytes):\n") {
+		t.Errorf("summary does not list the 2 truncated diffs:\n%s", output.String())
+	}
+}
+
+func TestDiffLimiterCutsAfterTheLastWholeLine(t *testing.T) {
+	tests := []struct {
+		diff  string
+		limit int64
+		want  string
+	}{
+		{"one\ntwo\n", 0, "one\ntwo\n"},
+		{"one\ntwo\n", 8, "one\ntwo\n"},
+		{"one\ntwo", 7, "one\ntwo"},
+		{"one\ntwo\n", 7, "one\n... diff truncated (4 bytes omitted)\n"},
+		{"one\ntwo\nthree\n", 9, "one\ntwo\n... diff truncated (6 bytes omitted)\n"},
+		{"onetwothree\n", 6, "onetwo\n... diff truncated (6 bytes omitted)\n"},
+	}
+	for _, tt := range tests {
+		var out bytes.Buffer
+		l := &diffLimiter{w: &out, limit: tt.limit}
+		// Written a byte at a time, as a -diff-tool may print it
+		for i := range len(tt.diff) {
+			if _, err := l.Write([]byte{tt.diff[i]}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		truncated, err := l.finish()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if out.String() != tt.want || truncated != (tt.want != tt.diff) {
+			t.Errorf("%q within %d bytes = %q, %v, want %q", tt.diff, tt.limit, out.String(), truncated, tt.want)
+		}
+	}
+}
+
+func TestKeptDiffsHashAndCountAsFreshOnes(t *testing.T) {
+	root := t.TempDir()
+	dir1, dir2 := filepath.Join(root, "a"), filepath.Join(root, "b")
+	writeTree(t, dir1, map[string]string{"small.txt": "one\n", "lines.txt": strings.Repeat("old line\n", 200)})
+	writeTree(t, dir2, map[string]string{"small.txt": "two\n", "lines.txt": strings.Repeat("new line\n", 200)})
+
+	opts := testOptions()
+	opts.MaxDiffBytes = 1000
+	opts.Columns = []string{"diffhash"}
+	opts.Stats = true
+	opts.SkipExistingDiffs = true
+	opts.OutputDir = filepath.Join(root, "out")
+
+	// The second run keeps the diffs of the first, sources unchanged
+	var runs [2][]byte
+	for i := range runs {
+		var output strings.Builder
+		opts.Output = &output
+		if _, err := Compare(dir1, dir2, opts); err != nil {
+			t.Fatal(err)
+		}
+		data, err := os.ReadFile(filepath.Join(opts.OutputDir, "diff.csv"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		runs[i] = data
+		if i == 1 && !strings.Contains(output.String(), "diff kept for") {
+			t.Fatalf("second run regenerated the diffs:\n%s", output.String())
+		}
+	}
+	if !bytes.Equal(runs[1], runs[0]) {
+		t.Errorf("diff.csv with kept diffs =\n%s\nwant, as with fresh ones,\n%s", runs[1], runs[0])
+	}
+}
+
+// readTree returns the files below dir by their slash-separated path, with
+// their content and permission bits, and its directories with a trailing
+// slash.
+func readTree(t *testing.T, dir string) map[string]string {
+	t.Helper()
+	tree := make(map[string]string)
+	err := filepath.WalkDir(dir, func(path string, entry os.DirEntry, err error) error {
+		if err != nil || path == dir {
+			return err
+		}
+		name := filepath.ToSlash(path[len(dir)+1:])
+		if entry.IsDir() {
+			tree[name+"/"] = ""
+			return nil
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		content, err := os.ReadFile(path)
+		tree[name] = fmt.Sprintf("%04o %s", info.Mode().Perm(), content)
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tree
+}
+
+func TestSyncScriptMakesDir1MatchDir2(t *testing.T) {
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip("no sh to run the script")
+	}
+	tests := []struct {
+		name       string
+		dir1, dir2 map[string]string
+		renames    bool
+		modes      map[string]os.FileMode
+	}{
+		{
+			name: "changed, added and removed",
+			dir1: map[string]string{"same": "s\n", "changed": "1\n", "gone": "g\n", "old/deep/file": "o\n"},
+			dir2: map[string]string{"same": "s\n", "changed": "2\n", "new/deep/file": "n\n"},
+		},
+		{
+			name: "quoted names",
+			dir1: map[string]string{"it's here": "1\n", "$(touch pwned)": "x\n", "a b/c\nd": "1\n"},
+			dir2: map[string]string{"it's here": "2\n", "`echo hi`; rm -rf x": "y\n", "a b/c\nd": "2\n", "*": "star\n"},
+		},
+		{
+			name: "file replaced by a directory",
+			dir1: map[string]string{"x": "file\n", "keep": "k\n"},
+			dir2: map[string]string{"x/y": "nested\n", "x/z/w": "deeper\n", "keep": "k\n"},
+		},
+		{
+			name: "directory replaced by a file",
+			dir1: map[string]string{"x/y": "nested\n", "x/z/w": "deeper\n"},
+			dir2: map[string]string{"x": "file\n"},
+		},
+		{
+			name:    "renames",
+			dir1:    map[string]string{"from/moved": "same content\n", "kept": "k\n"},
+			dir2:    map[string]string{"to/new place/moved": "same content\n", "kept": "k\n"},
+			renames: true,
+		},
+		{
+			name:  "permissions",
+			dir1:  map[string]string{"run.sh": "#!/bin/sh\n"},
+			dir2:  map[string]string{"run.sh": "#!/bin/sh\n"},
+			modes: map[string]os.FileMode{"run.sh": 0755},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			root := t.TempDir()
+			dir1, dir2 := filepath.Join(root, "a"), filepath.Join(root, "b")
+			writeTree(t, dir1, tt.dir1)
+			writeTree(t, dir2, tt.dir2)
+			for name, mode := range tt.modes {
+				if err := os.Chmod(filepath.Join(dir2, name), mode); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			opts := testOptions()
+			opts.Recursive = true
+			opts.DetectRenames = tt.renames
+			opts.CheckPerms = tt.modes != nil
+			opts.EmitSync = filepath.Join(root, "sync.sh")
+			opts.OutputDir = filepath.Join(root, "out")
+			if _, err := Compare(dir1, dir2, opts); err != nil {
+				t.Fatal(err)
+			}
+			script, err := os.ReadFile(opts.EmitSync)
+			if err != nil {
+				t.Fatal(err)
+			}
+			cmd := exec.Command("sh", opts.EmitSync)
+			cmd.Dir = root
+			if output, err := cmd.CombinedOutput(); err != nil {
+				t.Fatalf("%v: %s\nscript:\n%s", err, output, script)
+			}
+
+			if got, want := readTree(t, dir1), readTree(t, dir2); !reflect.DeepEqual(got, want) {
+				t.Errorf("dir1 after the script = %q, want %q\nscript:\n%s", got, want, script)
+			}
+			if _, err := os.Stat(filepath.Join(root, "pwned")); err == nil {
+				t.Errorf("a file name ran as a command\nscript:\n%s", script)
+			}
+		})
+	}
+}
+
+// comparedNames returns the names of the files result lists, sorted.
+func comparedNames(result Result) []string {
+	var names []string
+	for _, file := range result.Files {
+		names = append(names, file.Name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func TestUseGitignoreLeavesOutIgnoredFiles(t *testing.T) {
+	tests := []struct {
+		name  string
+		tree  map[string]string
+		files []string
+	}{
+		{
+			name:  "name at any depth",
+			tree:  map[string]string{".gitignore": "*.o\n", "main.c": "", "main.o": "", "lib/util.o": "", "lib/util.c": ""},
+			files: []string{".gitignore", "lib/util.c", "main.c"},
+		},
+		{
+			name:  "anchored to its directory",
+			tree:  map[string]string{".gitignore": "/build\ndocs/*.html\n", "build/app": "", "src/build/keep": "", "docs/a.html": "", "docs/sub/b.html": ""},
+			files: []string{".gitignore", "docs/sub/b.html", "src/build/keep"},
+		},
+		{
+			name:  "directories only",
+			tree:  map[string]string{".gitignore": "out/\n", "out/x": "", "src/out": ""},
+			files: []string{".gitignore", "src/out"},
+		},
+		{
+			name:  "negation, last rule wins",
+			tree:  map[string]string{".gitignore": "*.log\n!keep.log\n", "a.log": "", "keep.log": "", "sub/keep.log": ""},
+			files: []string{".gitignore", "keep.log", "sub/keep.log"},
+		},
+		{
+			name:  "no re-including below an ignored directory",
+			tree:  map[string]string{".gitignore": "vendor/\n!vendor/keep\n", "vendor/keep": "", "vendor/drop": ""},
+			files: []string{".gitignore"},
+		},
+		{
+			name:  "double star",
+			tree:  map[string]string{".gitignore": "a/**/gen\n**/tmp\n", "a/gen": "", "a/b/c/gen": "", "b/gen": "", "x/y/tmp": ""},
+			files: []string{".gitignore", "b/gen"},
+		},
+		{
+			name:  "deeper files after their parents",
+			tree:  map[string]string{".gitignore": "*.txt\n", "sub/.gitignore": "!*.txt\n", "a.txt": "", "sub/b.txt": "", "sub/deeper/c.txt": ""},
+			files: []string{".gitignore", "sub/.gitignore", "sub/b.txt", "sub/deeper/c.txt"},
+		},
+		{
+			name:  "comments, blanks and escapes",
+			tree:  map[string]string{".gitignore": "# comment\n\n\\#hash\n\\!bang\ntrailing   \n", "#hash": "", "!bang": "", "trailing": "", "# comment": ""},
+			files: []string{"# comment", ".gitignore"},
+		},
+		{
+			name:  ".git is always left out",
+			tree:  map[string]string{".git/HEAD": "ref\n", "sub/.git/config": "", "file": ""},
+			files: []string{"file"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			root := t.TempDir()
+			dir1, dir2 := filepath.Join(root, "a"), filepath.Join(root, "b")
+			writeTree(t, dir1, tt.tree)
+			if err := os.Mkdir(dir2, 0755); err != nil {
+				t.Fatal(err)
+			}
+
+			// Every file left in dir1 is reported removed
+			opts := testOptions()
+			opts.Recursive = true
+			opts.UseGitignore = true
+			result, err := Compare(dir1, dir2, opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i, name := range tt.files {
+				tt.files[i] = filepath.FromSlash(name)
+			}
+			if got := comparedNames(result); !reflect.DeepEqual(got, tt.files) {
+				t.Errorf("files = %q, want %q", got, tt.files)
+			}
+		})
+	}
+}
+
+func TestFollowSymlinksSkipsLoops(t *testing.T) {
+	tests := []struct {
+		name  string
+		tree  map[string]string
+		links map[string]string
+		files []string
+		loops int
+	}{
+		{
+			name:  "link to a file",
+			tree:  map[string]string{"f": "f\n"},
+			links: map[string]string{"l": "f"},
+			files: []string{"f", "l"},
+		},
+		{
+			name:  "link to a sibling directory",
+			tree:  map[string]string{"real/f": "f\n"},
+			links: map[string]string{"alias": "real"},
+			files: []string{"alias/f", "real/f"},
+		},
+		{
+			name:  "link to its own directory",
+			tree:  map[string]string{"sub/f": "f\n"},
+			links: map[string]string{"sub/self": "."},
+			files: []string{"sub/f"},
+			loops: 1,
+		},
+		{
+			name:  "link to the root",
+			tree:  map[string]string{"sub/deep/f": "f\n"},
+			links: map[string]string{"sub/deep/up": "../.."},
+			files: []string{"sub/deep/f"},
+			loops: 1,
+		},
+		{
+			name:  "links to each other",
+			tree:  map[string]string{"x/f": "f\n", "y/g": "g\n"},
+			links: map[string]string{"x/to-y": "../y", "y/to-x": "../x"},
+			files: []string{"x/f", "x/to-y/g", "y/g", "y/to-x/f"},
+			loops: 2,
+		},
+		{
+			name:  "broken link",
+			tree:  map[string]string{"f": "f\n"},
+			links: map[string]string{"broken": "missing"},
+			files: []string{"f"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			root := t.TempDir()
+			dir1, dir2 := filepath.Join(root, "a"), filepath.Join(root, "b")
+			writeTree(t, dir1, tt.tree)
+			for link, target := range tt.links {
+				if err := os.Symlink(filepath.FromSlash(target), filepath.Join(dir1, filepath.FromSlash(link))); err != nil {
+					t.Skip(err)
+				}
+			}
+			if err := os.Mkdir(dir2, 0755); err != nil {
+				t.Fatal(err)
+			}
+
+			var output strings.Builder
+			opts := testOptions()
+			opts.Output = &output
+			opts.Recursive = true
+			opts.FollowSymlinks = true
+			result, err := Compare(dir1, dir2, opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i, name := range tt.files {
+				tt.files[i] = filepath.FromSlash(name)
+			}
+			if got := comparedNames(result); !reflect.DeepEqual(got, tt.files) {
+				t.Errorf("files = %q, want %q", got, tt.files)
+			}
+			if loops := strings.Count(output.String(), "# Skipping symlink loop "); loops != tt.loops {
+				t.Errorf("%d loops skipped, want %d:\n%s", loops, tt.loops, output.String())
+			}
+		})
+	}
+}
+
+func TestSemverOrdersVersionsNumerically(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want int
+	}{
+		{"1.2.0", "1.10.0", -1},
+		{"1.10.0", "1.9.9", 1},
+		{"1.10", "1.10.0", 0},
+		{"2", "1.99", 1},
+		{"2.0-rc1", "2.0", -1},
+		{"2.0", "2.0-rc1", 1},
+		{"2.0-alpha", "2.0-beta", -1},
+		{"2.0-rc1", "1.9", 1},
+	}
+	for _, tt := range tests {
+		if got := compareVersions(tt.a, tt.b); got != tt.want {
+			t.Errorf("compareVersions(%q, %q) = %d, want %d", tt.a, tt.b, got, tt.want)
+		}
+	}
+
+	names := []struct {
+		name, key, version string
+		ok                 bool
+	}{
+		{"app-1.10.0.jar", "app-*.jar", "1.10.0", true},
+		{"libfoo-v2.3-rc1.tar.gz", "libfoo-*.tar.gz", "2.3-rc1", true},
+		{"my-tool-3", "my-tool-*", "3", true},
+		{"README.md", "", "", false},
+		{"app-latest.jar", "", "", false},
+	}
+	for _, tt := range names {
+		key, version, ok := versionedName(tt.name)
+		if key != tt.key || version != tt.version || ok != tt.ok {
+			t.Errorf("versionedName(%q) = %q, %q, %v, want %q, %q, %v", tt.name, key, version, ok, tt.key, tt.version, tt.ok)
+		}
+	}
+
+	opts := testOptions()
+	opts.Semver = true
+	c := opts.newComparison()
+	defer c.cleanup()
+	sorted := []string{"app-1.10.0.jar", "app-1.2.0.jar", "app-1.9.jar", "app-1.10.0-rc1.jar", "lib-2.jar"}
+	c.sortFileNames(sorted)
+	want := []string{"app-1.2.0.jar", "app-1.9.jar", "app-1.10.0-rc1.jar", "app-1.10.0.jar", "lib-2.jar"}
+	if !reflect.DeepEqual(sorted, want) {
+		t.Errorf("sorted = %q, want %q", sorted, want)
+	}
+}
+
+func TestSemverPairsUpgradesAndDowngrades(t *testing.T) {
+	root := t.TempDir()
+	dir1, dir2 := filepath.Join(root, "a"), filepath.Join(root, "b")
+	writeTree(t, dir1, map[string]string{"app-1.2.0.jar": "old\n", "lib-2.0.jar": "release\n"})
+	writeTree(t, dir2, map[string]string{"app-1.10.0.jar": "new\n", "lib-2.0-rc1.jar": "candidate\n"})
+
+	opts := testOptions()
+	opts.Semver = true
+	opts.OutputDir = filepath.Join(root, "out")
+	if _, err := Compare(dir1, dir2, opts); err != nil {
+		t.Fatal(err)
+	}
+	file, err := os.Open(filepath.Join(opts.OutputDir, "versions.csv"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	rows, err := csv.NewReader(file).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := [][]string{
+		{"Artifact", "Version " + dir1, "Version " + dir2, "Change"},
+		{"app-*.jar", "1.2.0", "1.10.0", "upgrade"},
+		{"lib-*.jar", "2.0", "2.0-rc1", "downgrade"},
+	}
+	if !reflect.DeepEqual(rows, want) {
+		t.Errorf("versions.csv = %q, want %q", rows, want)
+	}
+}
+
+func TestValidateRejectsIncompatibleOptions(t *testing.T) {
+	for _, rule := range incompatibleOptions {
+		for _, name := range append([]string{rule.option}, rule.with...) {
+			if optionSet[name] == nil {
+				t.Fatalf("%s of the incompatible options of %s is missing from optionSet", name, rule.option)
+			}
+		}
+	}
+
+	tests := []struct {
+		name string
+		set  func(*Options)
+		want string
+	}{
+		{"none", func(o *Options) {}, ""},
+		{"low memory alone", func(o *Options) { o.LowMemory = true }, ""},
+		{"low memory", func(o *Options) { o.LowMemory, o.Digest, o.FailFast = true, true, true }, "-low-memory cannot be combined with -digest"},
+		{"quick hash", func(o *Options) { o.QuickHash, o.IgnoreEOL = true, true }, "-quick-hash cannot be combined with -ignore-eol"},
+		{"confirm without quick hash", func(o *Options) { o.ConfirmQuick = true }, "-quick-hash-confirm requires -quick-hash"},
+		{"confirm", func(o *Options) { o.QuickHash, o.ConfirmQuick, o.Semver = true, true, true }, "-quick-hash-confirm cannot be combined with -semver"},
+		{"ignore case", func(o *Options) { o.IgnoreCase, o.EmitSync = true, "sync.sh" }, "-ignore-case cannot be combined with -emit-sync"},
+		{"semver", func(o *Options) { o.Semver, o.FailFast = true, true }, "-semver cannot be combined with -fail-fast"},
+	}
+	for _, tt := range tests {
+		opts := testOptions()
+		tt.set(&opts)
+		err := opts.Validate()
+		if got := fmt.Sprint(err); err == nil && tt.want != "" || err != nil && got != tt.want {
+			t.Errorf("%s: Validate() = %v, want %q", tt.name, err, tt.want)
+		}
+	}
+}
@@ -0,0 +1,55 @@
+package compare
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"os"
+)
+
+func (c *comparison) newCSVReader(r io.Reader) *csv.Reader {
+	reader := csv.NewReader(r)
+	reader.Comma = c.csvDelimiter
+	return reader
+}
+
+func (c *comparison) newCSVWriter(w io.Writer) *csv.Writer {
+	writer := csv.NewWriter(w)
+	writer.Comma = c.csvDelimiter
+	return writer
+}
+
+// readCSVFile returns every record of the CSV file at path, checking that each
+// has at least minFields fields so that callers can index them, and passes
+// check if it is not nil. A hand-edited or partially written file is an error
+// naming the file and line.
+func (c *comparison) readCSVFile(path string, minFields int, check func([]string) error) ([][]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	reader := c.newCSVReader(file)
+	reader.FieldsPerRecord = -1
+	var records [][]string
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			return records, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+		if len(record) < minFields {
+			err = fmt.Errorf("expected at least %d fields, got %d", minFields, len(record))
+		} else if check != nil {
+			err = check(record)
+		}
+		if err != nil {
+			line, _ := reader.FieldPos(0)
+			return nil, fmt.Errorf("%s line %d: %v", path, line, err)
+		}
+		records = append(records, record)
+	}
+}
@@ -0,0 +1,128 @@
+package compare
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// decompresses reports whether filePath is compared by its decompressed
+// content.
+func (c *comparison) decompresses(filePath string) bool {
+	return c.decompress && strings.HasSuffix(filePath, ".gz")
+}
+
+// openContent opens the bytes compared for filePath: the file itself or the
+// decompressed copy of a .gz file with -decompress.
+func (c *comparison) openContent(filePath string) (*os.File, error) {
+	path, err := c.contentPath(filePath)
+	if err != nil {
+		return nil, err
+	}
+	return c.openRetried(path)
+}
+
+// statContent is os.Stat of the bytes compared for filePath. A decompressed
+// copy has the size of the content and the mtime of the .gz file.
+func (c *comparison) statContent(filePath string) (os.FileInfo, error) {
+	path, err := c.contentPath(filePath)
+	if err != nil {
+		return nil, err
+	}
+	return c.statRetried(path)
+}
+
+// contentPath returns the path of the bytes compared for filePath, on disk
+// as localPath puts it. A .gz file with -decompress is decompressed in full
+// by the first call, which the following calls reuse until releaseContent or
+// the end of the comparison. A truncated or corrupt file is an error naming
+// it.
+func (c *comparison) contentPath(filePath string) (string, error) {
+	local, err := c.localPath(filePath)
+	if err != nil || !c.decompresses(filePath) {
+		return local, err
+	}
+
+	c.decompressMu.Lock()
+	path, ok := c.decompressed[filePath]
+	if !ok && c.decompressDir == "" {
+		dir, err := os.MkdirTemp("", "inline-compare-gunzip-*")
+		if err != nil {
+			c.decompressMu.Unlock()
+			return "", err
+		}
+		c.decompressDir = dir
+		c.tempDirs = append(c.tempDirs, dir)
+		c.verbosef(verboseDetails, "// temporary directory %s for decompressed files\n", dir)
+	}
+	c.decompressMu.Unlock()
+	if ok {
+		return path, nil
+	}
+
+	path, err = c.gunzip(local, c.decompressDir)
+	if err != nil {
+		return "", fmt.Errorf("decompressing %s: %v", filePath, err)
+	}
+
+	c.decompressMu.Lock()
+	c.decompressed[filePath] = path
+	c.decompressMu.Unlock()
+	return path, nil
+}
+
+// releaseContent removes the decompressed or extracted copies of filePath,
+// if any, once they are no longer needed.
+func (c *comparison) releaseContent(filePath string) {
+	c.decompressMu.Lock()
+	defer c.decompressMu.Unlock()
+	if path, ok := c.decompressed[filePath]; ok {
+		os.Remove(path)
+		delete(c.decompressed, filePath)
+	}
+	if path, ok := c.extracted[filePath]; ok {
+		os.Remove(path)
+		delete(c.extracted, filePath)
+	}
+}
+
+// gunzip decompresses the gzip file at filePath into a new file in dir and
+// returns its path. The copy keeps the mtime of the original, which labels
+// the diffs.
+func (c *comparison) gunzip(filePath, dir string) (string, error) {
+	src, err := os.Open(filePath)
+	if err != nil {
+		return "", err
+	}
+	defer src.Close()
+	info, err := src.Stat()
+	if err != nil {
+		return "", err
+	}
+
+	reader, err := gzip.NewReader(src)
+	if err != nil {
+		return "", err
+	}
+	defer reader.Close()
+
+	dst, err := os.CreateTemp(dir, "content-*")
+	if err != nil {
+		return "", err
+	}
+	c.verbosef(verboseDetails, "// decompressing %s to %s\n", filePath, dst.Name())
+	_, err = io.Copy(dst, reader)
+	if closeErr := dst.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chtimes(dst.Name(), info.ModTime(), info.ModTime())
+	}
+	if err != nil {
+		os.Remove(dst.Name())
+		return "", err
+	}
+	return dst.Name(), nil
+}
@@ -0,0 +1,124 @@
+package compare
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"io"
+	"path/filepath"
+)
+
+// Content-defined chunking parameters. A chunk boundary is placed where the
+// rolling gear hash has its low bits clear, giving chunks of about 8 KB that
+// stay aligned with the content even when bytes are inserted or removed.
+const (
+	cdcMinSize = 2 * 1024
+	cdcMaxSize = 64 * 1024
+	cdcMask    = 1<<13 - 1
+)
+
+var gearTable = newGearTable()
+
+// newGearTable fills the gear table with a fixed splitmix64 sequence so chunk
+// boundaries are identical between runs and machines.
+func newGearTable() [256]uint64 {
+	var table [256]uint64
+	seed := uint64(0x9e3779b97f4a7c15)
+	for i := range table {
+		seed += 0x9e3779b97f4a7c15
+		z := seed
+		z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+		z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+		table[i] = z ^ (z >> 31)
+	}
+	return table
+}
+
+// chunkStats collects the distinct chunks of one directory.
+type chunkStats struct {
+	totalBytes int64
+	chunks     map[[sha256.Size]byte]int64
+}
+
+func (c *comparison) collectChunks(checksums map[string]fileEntry, dir string) (*chunkStats, error) {
+	stats := &chunkStats{chunks: make(map[[sha256.Size]byte]int64)}
+	for fileName := range checksums {
+		if err := stats.addFile(c, filepath.Join(dir, fileName)); err != nil {
+			return nil, err
+		}
+	}
+	return stats, nil
+}
+
+func (s *chunkStats) addFile(c *comparison, filePath string) error {
+	file, err := c.openStored(filePath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	reader := bufio.NewReaderSize(file, 1024*1024)
+	chunk := make([]byte, 0, cdcMaxSize)
+	var hash uint64
+	for {
+		b, err := reader.ReadByte()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		chunk = append(chunk, b)
+		hash = hash<<1 + gearTable[b]
+		if len(chunk) >= cdcMaxSize || (len(chunk) >= cdcMinSize && hash&cdcMask == 0) {
+			s.add(chunk)
+			chunk = chunk[:0]
+			hash = 0
+		}
+	}
+	if len(chunk) > 0 {
+		s.add(chunk)
+	}
+
+	return nil
+}
+
+func (s *chunkStats) add(chunk []byte) {
+	s.totalBytes += int64(len(chunk))
+	s.chunks[sha256.Sum256(chunk)] = int64(len(chunk))
+}
+
+// reportDedupStats prints the total bytes of each directory, the bytes of
+// chunks found only on one side and the bytes of chunks found on both, so
+// moved, split or merged content still counts as shared.
+func (c *comparison) reportDedupStats(checksums1, checksums2 map[string]fileEntry, dir1, dir2 string) error {
+	stats1, err := c.collectChunks(checksums1, dir1)
+	if err != nil {
+		return err
+	}
+	stats2, err := c.collectChunks(checksums2, dir2)
+	if err != nil {
+		return err
+	}
+
+	var unique1, unique2, shared int64
+	for sum, size := range stats1.chunks {
+		if _, ok := stats2.chunks[sum]; ok {
+			shared += size
+		} else {
+			unique1 += size
+		}
+	}
+	for sum, size := range stats2.chunks {
+		if _, ok := stats1.chunks[sum]; !ok {
+			unique2 += size
+		}
+	}
+
+	c.logf("# Dedup stats (content-defined chunks)\n")
+	c.logf(" - %s: total %s (%d bytes), unique %s (%d bytes)\n", dir1, humanReadableSize(stats1.totalBytes), stats1.totalBytes, humanReadableSize(unique1), unique1)
+	c.logf(" - %s: total %s (%d bytes), unique %s (%d bytes)\n", dir2, humanReadableSize(stats2.totalBytes), stats2.totalBytes, humanReadableSize(unique2), unique2)
+	c.logf(" - shared: %s (%d bytes)\n", humanReadableSize(shared), shared)
+
+	return nil
+}
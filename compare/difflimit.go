@@ -0,0 +1,86 @@
+package compare
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+)
+
+// diffLimiter writes a .diff cut after its last whole line within
+// maxDiffBytes when it is longer, so a diff of a minified bundle does not
+// bloat the output, followed by a marker with the number of bytes left out.
+// What lies past the limit is only counted, never written, and a first line
+// longer than the limit is cut in the middle.
+type diffLimiter struct {
+	w     io.Writer
+	limit int64
+	// pending holds what follows the last line break written, which is only
+	// written once the diff turns out to fit or to have no line break.
+	pending []byte
+	// kept is the number of bytes within the limit, written or pending, and
+	// size the number of bytes of the whole diff.
+	kept, size int64
+}
+
+func (c *comparison) newDiffLimiter(w io.Writer) *diffLimiter {
+	return &diffLimiter{w: w, limit: c.maxDiffBytes}
+}
+
+func (l *diffLimiter) Write(p []byte) (int, error) {
+	l.size += int64(len(p))
+	if l.limit == 0 {
+		return l.w.Write(p)
+	}
+	take := p[:min(int64(len(p)), l.limit-l.kept)]
+	l.kept += int64(len(take))
+	l.pending = append(l.pending, take...)
+	if i := bytes.LastIndexByte(l.pending, '\n'); i >= 0 {
+		if _, err := l.w.Write(l.pending[:i+1]); err != nil {
+			return 0, err
+		}
+		l.pending = append(l.pending[:0], l.pending[i+1:]...)
+	}
+	return len(p), nil
+}
+
+// finish writes what is pending, or the marker when the diff was longer
+// than the limit, and reports whether it was cut.
+func (l *diffLimiter) finish() (bool, error) {
+	if l.limit == 0 || l.size <= l.limit {
+		_, err := l.w.Write(l.pending)
+		return false, err
+	}
+	cut := l.kept - int64(len(l.pending))
+	marker := ""
+	if cut == 0 {
+		if _, err := l.w.Write(l.pending); err != nil {
+			return false, err
+		}
+		cut = l.kept
+		marker = "\n"
+	}
+	marker += fmt.Sprintf("... diff truncated (%d bytes omitted)\n", l.size-cut)
+	_, err := io.WriteString(l.w, marker)
+	return true, err
+}
+
+// writeDiff writes output to diffFile within -max-diff-bytes, noting in log
+// whether it was cut.
+func (c *comparison) writeDiff(log *diffLog, diffFile string, output []byte) error {
+	file, err := os.OpenFile(diffFile, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	limiter := c.newDiffLimiter(file)
+	if _, err := limiter.Write(output); err != nil {
+		return err
+	}
+	log.truncated, err = limiter.finish()
+	if err != nil {
+		return err
+	}
+	return file.Close()
+}
@@ -0,0 +1,98 @@
+package compare
+
+import (
+	"os"
+	"strconv"
+	"time"
+)
+
+// diffManifest remembers the size and mtime of both source files each .diff
+// was generated from, and when. It is appended to after every diff so an
+// interrupted run can be resumed with -skip-existing-diffs. Without the flag
+// there is none, and a nil *diffManifest records nothing.
+type diffManifest struct {
+	c       *comparison
+	path    string
+	entries map[string][]string
+}
+
+// loadDiffManifest reads the manifest for -skip-existing-diffs. Without the
+// flag every diff is regenerated, so the manifest of an earlier run would no
+// longer match the diffs and is removed, and nil is returned.
+func (c *comparison) loadDiffManifest(path string) (*diffManifest, error) {
+	if !c.skipExisting {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		return nil, nil
+	}
+
+	m := &diffManifest{c: c, path: path, entries: make(map[string][]string)}
+
+	records, err := c.readCSVFile(path, 1, nil)
+	if os.IsNotExist(err) {
+		return m, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	for _, record := range records {
+		// Later rows win, the manifest is append-only
+		m.entries[record[0]] = record
+	}
+
+	return m, nil
+}
+
+func manifestRecord(fileName string, info1, info2 os.FileInfo) []string {
+	return []string{
+		fileName,
+		strconv.FormatInt(info1.Size(), 10), info1.ModTime().UTC().Format(time.RFC3339Nano),
+		strconv.FormatInt(info2.Size(), 10), info2.ModTime().UTC().Format(time.RFC3339Nano),
+	}
+}
+
+// current reports whether the diff of fileName was generated from sources
+// with the same sizes and mtimes as now.
+func (m *diffManifest) current(fileName string, info1, info2 os.FileInfo) bool {
+	if m == nil {
+		return false
+	}
+	entry, ok := m.entries[fileName]
+	if !ok || len(entry) < 5 {
+		return false
+	}
+	want := manifestRecord(fileName, info1, info2)
+	for i := range want {
+		if entry[i] != want[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// record appends the sources of a freshly generated diff and the time.
+func (m *diffManifest) record(fileName string, info1, info2 os.FileInfo) error {
+	if m == nil {
+		return nil
+	}
+	file, err := os.OpenFile(m.path, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	writer := m.c.newCSVWriter(file)
+
+	record := append(manifestRecord(fileName, info1, info2), time.Now().UTC().Format(time.RFC3339))
+	m.entries[fileName] = record
+
+	if err := writer.Write(record); err != nil {
+		return err
+	}
+	writer.Flush()
+	if err := writer.Error(); err != nil {
+		return err
+	}
+	return file.Close()
+}
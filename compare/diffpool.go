@@ -0,0 +1,121 @@
+package compare
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"sync"
+)
+
+// diffLog holds what generateDiff prints for one pair of files, so diffs
+// generated concurrently are still reported in the order of diff.csv, along
+// with the similarity it measured for -similarity-threshold and whether the
+// .diff was cut at -max-diff-bytes.
+type diffLog struct {
+	c *comparison
+	bytes.Buffer
+	diagnostics bytes.Buffer
+	similarity  float64
+	measured    bool
+	truncated   bool
+}
+
+func (l *diffLog) logf(format string, args ...any) {
+	fmt.Fprintf(&l.Buffer, format, args...)
+}
+
+// itemf is the itemf of one pair of files, honoring -quiet.
+func (l *diffLog) itemf(format string, args ...any) {
+	if !l.c.quiet {
+		l.logf(format, args...)
+	}
+}
+
+// verbosef is the verbosef of one pair of files.
+func (l *diffLog) verbosef(level int, format string, args ...any) {
+	if l.c.verbosity >= level {
+		fmt.Fprintf(&l.diagnostics, format, args...)
+	}
+}
+
+// flush prints the collected lines.
+func (l *diffLog) flush() {
+	if l.diagnostics.Len() > 0 {
+		l.c.verbosef(verboseFiles, "%s", l.diagnostics.Bytes())
+		l.diagnostics.Reset()
+	}
+	l.c.output.Write(l.Bytes())
+	l.Reset()
+}
+
+// diffTask is a pair of files for the diff pool, with the outcome of its
+// generateDiff once done is closed.
+type diffTask struct {
+	file1, file2         string
+	checksum1, checksum2 string
+	diffFile             string
+
+	log     diffLog
+	differs bool
+	err     error
+	done    chan struct{}
+}
+
+func (c *comparison) newDiffTask(file1, file2, checksum1, checksum2, diffFile string) *diffTask {
+	return &diffTask{
+		log:       diffLog{c: c},
+		file1:     file1,
+		file2:     file2,
+		checksum1: checksum1,
+		checksum2: checksum2,
+		diffFile:  diffFile,
+		done:      make(chan struct{}),
+	}
+}
+
+// startDiffPool runs generateDiff for tasks across -workers goroutines,
+// starting them in order so the earliest are done first. Each diff writes
+// its own .diff and temporary files. The returned stop waits for the running
+// diffs and drops the tasks not yet started, whose done is closed without a
+// result.
+func (c *comparison) startDiffPool(ctx context.Context, tasks []*diffTask, sizeLimit, lineLimit int) (stop func()) {
+	jobs := make(chan *diffTask)
+	quit := make(chan struct{})
+	var wg sync.WaitGroup
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		defer close(jobs)
+		for _, task := range tasks {
+			select {
+			case jobs <- task:
+			case <-quit:
+				return
+			}
+		}
+	}()
+
+	for w := 0; w < c.workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for task := range jobs {
+				select {
+				case <-quit:
+				default:
+					task.differs, task.err = c.generateDiff(ctx, &task.log, task.file1, task.file2, task.checksum1, task.checksum2, task.diffFile, sizeLimit, lineLimit)
+				}
+				close(task.done)
+			}
+		}()
+	}
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			close(quit)
+			wg.Wait()
+		})
+	}
+}
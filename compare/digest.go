@@ -0,0 +1,36 @@
+package compare
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"sort"
+)
+
+// computeDigest hashes the canonical form of a comparison: one
+// "status\tname\tchecksum1\tchecksum2\n" line per file of either side,
+// identical files included, in byte order of the name. The order does not
+// depend on -sort, so two runs that found the same thing produce the same
+// digest.
+func (c *comparison) computeDigest(checksums1, checksums2 map[string]fileEntry) string {
+	names := make(map[string]bool)
+	for fileName := range checksums1 {
+		names[fileName] = true
+	}
+	for fileName := range checksums2 {
+		names[fileName] = true
+	}
+	sorted := make([]string, 0, len(names))
+	for fileName := range names {
+		sorted = append(sorted, fileName)
+	}
+	sort.Strings(sorted)
+
+	hash := sha256.New()
+	for _, fileName := range sorted {
+		entry1, entry2 := checksums1[fileName], checksums2[fileName]
+		fmt.Fprintf(hash, "%s\t%s\t%s\t%s\n", c.comparisonStatus(entry1, entry2), fileName, entry1.checksum, entry2.checksum)
+	}
+
+	return "sha256:" + hex.EncodeToString(hash.Sum(nil))
+}
@@ -0,0 +1,54 @@
+package compare
+
+import (
+	"fmt"
+	"path/filepath"
+)
+
+// dryRunGroups are the headings of the -dry-run report, by status.
+var dryRunGroups = []struct{ status, heading string }{
+	{"added", "New in %s"},
+	{"removed", "Deleted from %s"},
+	{"modified", "Changed"},
+	{"mode", "Permissions changed"},
+	{"renamed", "Renamed"},
+}
+
+// reportDryRun lists records, the rows of diff.csv, grouped by status in
+// place of the diff phase, so nothing is copied or diffed. Every row counts as
+// a difference, including changed files whose diff could turn out empty after
+// normalization.
+func (c *comparison) reportDryRun(records [][]string, dir2, outputDir string) int {
+	groups := make(map[string][]string)
+	for _, record := range records {
+		status := c.recordStatus(record)
+		name := record[0]
+		if status == "renamed" {
+			name = c.renamedFrom[record[0]] + " -> " + record[0]
+		}
+		groups[status] = append(groups[status], name)
+	}
+
+	c.logf("# Dry run: no files copied or diffed\n")
+	for _, group := range dryRunGroups {
+		names := groups[group.status]
+		if len(names) == 0 {
+			continue
+		}
+		heading := group.heading
+		if group.status == "added" || group.status == "removed" {
+			heading = fmt.Sprintf(heading, dir2)
+		}
+		c.logf("# %s (%d):\n", heading, len(names))
+		for _, name := range names {
+			c.itemf(" - %s\n", name)
+		}
+	}
+	if c.noCombinedCSV {
+		c.logf("# Diff phase skipped\n")
+	} else {
+		c.logf("# Diff phase skipped, see %s\n", filepath.Join(outputDir, "diff.csv"))
+	}
+
+	return len(records)
+}
@@ -0,0 +1,187 @@
+package compare
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+)
+
+// DuplicateResult is the outcome of a search for duplicate files.
+type DuplicateResult struct {
+	// Dir is the searched directory, which for a container image input is
+	// the temporary directory it was extracted to.
+	Dir string
+	// OutputDir holds the checksum CSV and dupes.csv, unless
+	// Options.OutputDir was empty.
+	OutputDir string
+	// Groups lists the sets of files with the same content, those wasting
+	// the most space first.
+	Groups []DuplicateGroup
+	// Reclaimable is the number of bytes freed by keeping a single file of
+	// every group.
+	Reclaimable int64
+}
+
+// DuplicateGroup is a set of files with the same checksum.
+type DuplicateGroup struct {
+	Checksum string
+	// Size is the size of each file.
+	Size int64
+	// Files are the paths relative to the searched directory, sorted.
+	Files []string
+}
+
+// FindDuplicates hashes the files of dir with opts, as a comparison would,
+// and groups those with the same checksum. Empty files are left out, as
+// there is nothing to reclaim from them.
+func FindDuplicates(dir string, opts Options) (DuplicateResult, error) {
+	return FindDuplicatesContext(context.Background(), dir, opts)
+}
+
+// FindDuplicatesContext is FindDuplicates stopping as soon as ctx is done.
+func FindDuplicatesContext(ctx context.Context, dir string, opts Options) (result DuplicateResult, err error) {
+	if err := opts.Validate(); err != nil {
+		return DuplicateResult{}, err
+	}
+	if opts.FailFast || opts.StructureOnly || opts.LowMemory {
+		return DuplicateResult{}, fmt.Errorf("duplicate files cannot be searched with -fail-fast, -structure-only or -low-memory")
+	}
+	c := opts.newComparison()
+	defer c.cleanup()
+	defer func() {
+		err = interrupted(ctx, err)
+	}()
+
+	outputDir := opts.OutputDir
+	if outputDir == "" {
+		tempDir, err := os.MkdirTemp("", "inline-compare-*")
+		if err != nil {
+			return DuplicateResult{}, err
+		}
+		defer os.RemoveAll(tempDir)
+		outputDir = tempDir
+	}
+
+	result.OutputDir = opts.OutputDir
+	result.Dir, err = c.prepareInput(ctx, dir)
+	if err != nil {
+		return result, fmt.Errorf("preparing %s: %v", dir, err)
+	}
+	if sameDir(outputDir, result.Dir) || insideDir(outputDir, result.Dir) {
+		return result, fmt.Errorf("output directory %s is inside the searched directory %s, choose another with -out", outputDir, result.Dir)
+	}
+	c.outputPath = outputDir
+	if err := os.MkdirAll(outputDir, 0755); err != nil {
+		return result, err
+	}
+
+	c.logf("# Find duplicate files in %s\n", result.Dir)
+	checksums, err := c.generateChecksums(ctx, result.Dir, c.useCache, outputDir, nil)
+	if err != nil {
+		return result, fmt.Errorf("generating checksums for %s: %v", result.Dir, err)
+	}
+	result.Groups = c.duplicateGroups(checksums)
+	for _, group := range result.Groups {
+		result.Reclaimable += group.Size * int64(len(group.Files)-1)
+	}
+
+	dupesFile := filepath.Join(outputDir, "dupes.csv")
+	if err := c.writeDupesCSV(dupesFile, result.Groups); err != nil {
+		return result, fmt.Errorf("writing %s: %v", dupesFile, err)
+	}
+	c.reportDuplicates(result, dupesFile)
+
+	if !opts.KeepChecksums {
+		if err := os.Remove(c.checksumCSV(outputDir, result.Dir)); err != nil && !os.IsNotExist(err) {
+			return result, err
+		}
+	}
+
+	return result, nil
+}
+
+// duplicateGroups groups the non-empty files of checksums by checksum and
+// returns the groups of more than one file.
+func (c *comparison) duplicateGroups(checksums map[string]fileEntry) []DuplicateGroup {
+	byChecksum := make(map[string]*DuplicateGroup)
+	for name, entry := range checksums {
+		if entry.size == 0 || entry.checksum == "" {
+			continue
+		}
+		group, ok := byChecksum[entry.checksum]
+		if !ok {
+			group = &DuplicateGroup{Checksum: entry.checksum, Size: entry.size}
+			byChecksum[entry.checksum] = group
+		}
+		group.Files = append(group.Files, name)
+	}
+
+	var groups []DuplicateGroup
+	for _, group := range byChecksum {
+		if len(group.Files) < 2 {
+			continue
+		}
+		sort.Slice(group.Files, func(i, j int) bool {
+			return c.fileNameLess(group.Files[i], group.Files[j])
+		})
+		groups = append(groups, *group)
+	}
+	sort.Slice(groups, func(i, j int) bool {
+		wasted1 := groups[i].Size * int64(len(groups[i].Files)-1)
+		wasted2 := groups[j].Size * int64(len(groups[j].Files)-1)
+		if wasted1 != wasted2 {
+			return wasted1 > wasted2
+		}
+		return c.fileNameLess(groups[i].Files[0], groups[j].Files[0])
+	})
+	return groups
+}
+
+// writeDupesCSV writes a row per duplicate file, group by group.
+func (c *comparison) writeDupesCSV(dupesFile string, groups []DuplicateGroup) error {
+	file, err := os.Create(dupesFile)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	writer := c.newCSVWriter(file)
+	if err := writer.Write([]string{"Checksum", "Size", "File Name"}); err != nil {
+		return err
+	}
+	for _, group := range groups {
+		for _, name := range group.Files {
+			if err := writer.Write([]string{group.Checksum, strconv.FormatInt(group.Size, 10), filepath.ToSlash(name)}); err != nil {
+				return err
+			}
+		}
+	}
+	writer.Flush()
+	if err := writer.Error(); err != nil {
+		return err
+	}
+	return file.Close()
+}
+
+// reportDuplicates prints every group and the space they take up.
+func (c *comparison) reportDuplicates(result DuplicateResult, dupesFile string) {
+	files := 0
+	for _, group := range result.Groups {
+		files += len(group.Files)
+		c.itemf(" - %d copies of %s each (%s):\n", len(group.Files), humanReadableSize(group.Size), group.Checksum)
+		for _, name := range group.Files {
+			c.itemf("   - %s\n", filepath.Join(result.Dir, name))
+		}
+	}
+	c.logf("# %d duplicate files in %d groups, %s (%d bytes) reclaimable (%s)\n",
+		files, len(result.Groups), humanReadableSize(result.Reclaimable), result.Reclaimable, dupesFile)
+}
+
+// DefaultDupesOutputDir is the output directory the command line uses for a
+// search for duplicate files in dir, named after it.
+func DefaultDupesOutputDir(dir string) string {
+	return inputName(dir) + "-dupes"
+}
@@ -0,0 +1,114 @@
+package compare
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// fileEvent is a line of the Options.Events stream, written as soon as a
+// file is hashed or a row of diff.csv is handled. Sizes are omitted for a
+// missing side.
+type fileEvent struct {
+	// Type is checksum for a hashed file, and add, remove, diff, mode or
+	// rename for the rows of diff.csv by their status.
+	Type string `json:"type"`
+	Name string `json:"name"`
+	// Dir, Size and Checksum describe a hashed file.
+	Dir      string `json:"dir,omitempty"`
+	Size     *int64 `json:"size,omitempty"`
+	Checksum string `json:"checksum,omitempty"`
+
+	Size1       *int64 `json:"size1,omitempty"`
+	Size2       *int64 `json:"size2,omitempty"`
+	Checksum1   string `json:"checksum1,omitempty"`
+	Checksum2   string `json:"checksum2,omitempty"`
+	RenamedFrom string `json:"renamedFrom,omitempty"`
+	Output      string `json:"output,omitempty"`
+	// HadDiff tells for a diff event whether a .diff was written, which is
+	// not the case when the files compare equal once normalized.
+	HadDiff *bool `json:"hadDiff,omitempty"`
+}
+
+// eventTypes maps the status of a row of diff.csv to its event type.
+var eventTypes = map[string]string{
+	"added":    "add",
+	"removed":  "remove",
+	"modified": "diff",
+	"mode":     "mode",
+	"renamed":  "rename",
+}
+
+// eventWriter writes fileEvents, one JSON object per line, from any
+// goroutine. A nil writer drops them, so callers never have to check for
+// one.
+type eventWriter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func (e *eventWriter) send(event fileEvent) {
+	if e == nil {
+		return
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	// Each line is written in one call, so a reader of a pipe gets it
+	// as soon as it is complete
+	json.NewEncoder(e.w).Encode(event)
+}
+
+// checksum reports a file of dir hashed, or taken from the -use-cache CSV.
+func (e *eventWriter) checksum(dir, name string, size int64, checksum string) {
+	e.send(fileEvent{Type: "checksum", Name: name, Dir: dir, Size: &size, Checksum: checksum})
+}
+
+// compared reports a row of diff.csv once its copy or .diff is written.
+// hadDiff only applies to modified files.
+func (e *eventWriter) compared(file FileResult, hadDiff bool) {
+	if e == nil {
+		return
+	}
+	event := fileEvent{
+		Type:        eventTypes[file.Status],
+		Name:        file.Name,
+		Checksum1:   file.Checksum1,
+		Checksum2:   file.Checksum2,
+		RenamedFrom: file.RenamedFrom,
+		Output:      file.Output,
+	}
+	if file.Checksum1 != "" {
+		event.Size1 = &file.Size1
+	}
+	if file.Checksum2 != "" {
+		event.Size2 = &file.Size2
+	}
+	if file.Status == "modified" {
+		event.HadDiff = &hadDiff
+	}
+	e.send(event)
+}
+
+// fileHandled reports a row of diff.csv handled by compareFilesInCSV to the
+// Options.Events stream and Options.OnFile. output is the copy or .diff in
+// diffDir, if one was written.
+func (c *comparison) fileHandled(record []string, dir1, dir2, diffDir, output string, hadDiff bool) {
+	if c.events == nil && c.onFile == nil {
+		return
+	}
+	file := c.fileResult(record, dir1, dir2)
+	if _, err := os.Stat(output); err == nil && output != "" {
+		file.Output, _ = filepath.Rel(diffDir, output)
+	}
+	file.Truncated = c.truncatedDiffs[record[0]]
+	if similarity, ok := c.similarities[record[0]]; ok {
+		file.Similarity, file.Change = similarity, c.changeClass(similarity)
+	}
+
+	c.events.compared(file, hadDiff)
+	if c.onFile != nil {
+		c.onFile(file)
+	}
+}
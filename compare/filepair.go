@@ -0,0 +1,95 @@
+package compare
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// isFilePair reports whether both inputs are regular files, which are compared
+// directly instead of as directories. A .zip file is compared by its entries.
+func (c *comparison) isFilePair(path1, path2 string) bool {
+	if isZipInput(path1) || isZipInput(path2) {
+		return false
+	}
+	info1, err := c.statRetried(path1)
+	if err != nil || !info1.Mode().IsRegular() {
+		return false
+	}
+	info2, err := c.statRetried(path2)
+	return err == nil && info2.Mode().IsRegular()
+}
+
+// compareFilePair diffs two files without any checksum CSVs and prints the
+// diff. The -size and -lines limits apply as they do inside directories.
+func (c *comparison) compareFilePair(ctx context.Context, file1, file2 string, sizeLimit, lineLimit int) (Result, error) {
+	result := Result{Dir1: file1, Dir2: file2}
+	c.logf("# Compare %s and %s\n", file1, file2)
+
+	checksum1, err := c.fileChecksum(file1)
+	if err != nil {
+		return result, fmt.Errorf("checksum of %s: %v", file1, err)
+	}
+	checksum2, err := c.fileChecksum(file2)
+	if err != nil {
+		return result, fmt.Errorf("checksum of %s: %v", file2, err)
+	}
+	if checksum1 == checksum2 && c.confirmQuick {
+		checksum1, checksum2, err = c.fullChecksums(file1, file2)
+		if err != nil {
+			return result, err
+		}
+	}
+	if checksum1 == checksum2 {
+		return result, nil
+	}
+
+	tempDir, err := os.MkdirTemp("", "inline-compare-*")
+	if err != nil {
+		return result, err
+	}
+	defer os.RemoveAll(tempDir)
+	c.verbosef(verboseDetails, "// temporary directory %s for the diff\n", tempDir)
+
+	diffFile := filepath.Join(tempDir, filepath.Base(file1)+".diff")
+	log := diffLog{c: c}
+	differs, err := c.generateDiff(ctx, &log, file1, file2, checksum1, checksum2, diffFile, sizeLimit*1024*1024, lineLimit)
+	log.flush()
+	if err != nil {
+		return result, fmt.Errorf("comparing files: %v", err)
+	}
+
+	// Large files whose last lines match still get the explanatory note
+	diff, err := os.ReadFile(diffFile)
+	if err != nil && !os.IsNotExist(err) {
+		return result, err
+	}
+	c.logf("%s", c.colorDiff(diff))
+
+	file := FileResult{
+		Name:      filepath.Base(file1),
+		Status:    "modified",
+		Checksum1: checksum1,
+		Checksum2: checksum2,
+		Size1:     c.fileSize(file1, checksum1),
+		Size2:     c.fileSize(file2, checksum2),
+		Diff:      diff,
+		Truncated: log.truncated,
+	}
+	if log.measured {
+		file.Similarity, file.Change = log.similarity, c.changeClass(log.similarity)
+		c.logf("# Similarity: %s (%s change)\n", formatSimilarity(log.similarity), file.Change)
+	}
+	c.events.compared(file, differs)
+
+	if differs {
+		result.Differences = 1
+		result.Files = []FileResult{file}
+		if c.onFile != nil {
+			c.onFile(file)
+		}
+	}
+
+	return result, nil
+}
@@ -0,0 +1,179 @@
+package compare
+
+import (
+	"bufio"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// gitignoreRule is a pattern of a .gitignore file, relative to the directory
+// holding it.
+type gitignoreRule struct {
+	// dir is the directory of the .gitignore file, relative to the compared
+	// directory, in slash form and "" at the top.
+	dir string
+	// segments is the pattern split at its slashes.
+	segments []string
+	// negate re-includes what an earlier rule ignored, for a !pattern.
+	negate bool
+	// dirOnly only matches directories, for a pattern ending in a slash.
+	dirOnly bool
+	// anchored matches the path from dir, for a pattern with a slash other
+	// than a trailing one. Other patterns match the base name at any depth.
+	anchored bool
+}
+
+// gitignores holds the rules of the .gitignore files read in one compared
+// directory, by the directory holding them. A nil *gitignores ignores
+// nothing, so listings do not check for -use-gitignore.
+type gitignores struct {
+	root  string
+	rules map[string][]gitignoreRule
+}
+
+// newGitignores returns the rules for root with -use-gitignore, or nil.
+func (c *comparison) newGitignores(root string) *gitignores {
+	if !c.useGitignore {
+		return nil
+	}
+	return &gitignores{root: root, rules: make(map[string][]gitignoreRule)}
+}
+
+// load reads the .gitignore file of the directory rel, if it has one. It is
+// called on entering each directory, before ignored is asked about its
+// entries.
+func (g *gitignores) load(rel string) error {
+	if g == nil {
+		return nil
+	}
+	dir := filepath.ToSlash(rel)
+	if dir == "." {
+		dir = ""
+	}
+	file, err := os.Open(filepath.Join(g.root, rel, ".gitignore"))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	var rules []gitignoreRule
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		if rule, ok := parseGitignoreLine(dir, scanner.Text()); ok {
+			rules = append(rules, rule)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	g.rules[dir] = rules
+	return nil
+}
+
+// parseGitignoreLine parses a line of the .gitignore file of dir, reporting
+// false for blank lines and comments.
+func parseGitignoreLine(dir, line string) (gitignoreRule, bool) {
+	line = strings.TrimSuffix(line, "\r")
+	if !strings.HasSuffix(line, `\ `) {
+		line = strings.TrimRight(line, " ")
+	}
+	if line == "" || strings.HasPrefix(line, "#") {
+		return gitignoreRule{}, false
+	}
+
+	rule := gitignoreRule{dir: dir}
+	if strings.HasPrefix(line, "!") {
+		rule.negate = true
+		line = line[1:]
+	} else if strings.HasPrefix(line, `\!`) || strings.HasPrefix(line, `\#`) {
+		line = line[1:]
+	}
+	if strings.HasSuffix(line, "/") {
+		rule.dirOnly = true
+		line = strings.TrimRight(line, "/")
+	}
+	if strings.Contains(line, "/") {
+		rule.anchored = true
+		line = strings.TrimPrefix(line, "/")
+	}
+	if line == "" {
+		return gitignoreRule{}, false
+	}
+	rule.segments = strings.Split(line, "/")
+	return rule, true
+}
+
+// ignored reports whether the file or directory rel of the compared
+// directory is ignored. As with git the last matching rule wins, those of
+// deeper .gitignore files coming after those of their parents. The .git
+// directory is always ignored.
+func (g *gitignores) ignored(rel string, isDir bool) bool {
+	if g == nil {
+		return false
+	}
+	rel = filepath.ToSlash(rel)
+	if isDir && path.Base(rel) == ".git" {
+		return true
+	}
+
+	ignored := false
+	dirs := []string{""}
+	for i, char := range rel {
+		if char == '/' {
+			dirs = append(dirs, rel[:i])
+		}
+	}
+	for _, dir := range dirs {
+		sub := rel
+		if dir != "" {
+			sub = rel[len(dir)+1:]
+		}
+		for _, rule := range g.rules[dir] {
+			if rule.matches(sub, isDir) {
+				ignored = !rule.negate
+			}
+		}
+	}
+	return ignored
+}
+
+// matches reports whether rule matches sub, a path relative to its
+// directory.
+func (rule gitignoreRule) matches(sub string, isDir bool) bool {
+	if rule.dirOnly && !isDir {
+		return false
+	}
+	if !rule.anchored {
+		matched, _ := path.Match(rule.segments[0], path.Base(sub))
+		return matched
+	}
+	return matchSegments(rule.segments, strings.Split(sub, "/"))
+}
+
+// matchSegments matches a path against a pattern, both split at their
+// slashes, where a ** segment stands for any number of directories.
+func matchSegments(pattern, segments []string) bool {
+	if len(pattern) == 0 {
+		return len(segments) == 0
+	}
+	if pattern[0] == "**" {
+		for i := 0; i <= len(segments); i++ {
+			if matchSegments(pattern[1:], segments[i:]) {
+				return true
+			}
+		}
+		return false
+	}
+	if len(segments) == 0 {
+		return false
+	}
+	if matched, _ := path.Match(pattern[0], segments[0]); !matched {
+		return false
+	}
+	return matchSegments(pattern[1:], segments[1:])
+}
@@ -0,0 +1,204 @@
+package compare
+
+import (
+	"bufio"
+	"html/template"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// htmlLine is one line of a diff page, with the class that colors it.
+type htmlLine struct {
+	Class string
+	Text  string
+}
+
+// htmlFile is one row of the report index.
+type htmlFile struct {
+	FileResult
+	Page string
+	Copy string
+}
+
+var htmlIndex = template.Must(template.New("index").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Compare {{.Dir1}} and {{.Dir2}}</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+table { border-collapse: collapse; }
+th, td { text-align: left; padding: 0.2em 1em 0.2em 0; }
+.added { color: #22863a; } .removed { color: #cb2431; } .modified, .mode, .renamed { color: #6f42c1; }
+</style>
+</head>
+<body>
+<h1>Compare {{.Dir1}} and {{.Dir2}}</h1>
+<p>Total differences found: {{.Differences}}</p>
+<ul>
+{{- range .Counts}}
+<li class="{{.Status}}">{{.Status}}: {{.Count}}</li>
+{{- end}}
+</ul>
+<table>
+<tr><th>File</th><th>Status</th><th>Details</th></tr>
+{{- range .Files}}
+<tr>
+<td>{{if .Page}}<a href="{{.Page}}">{{.Name}}</a>{{else if .Copy}}<a href="{{.Copy}}">{{.Name}}</a>{{else}}{{.Name}}{{end}}</td>
+<td class="{{.Status}}">{{.Status}}</td>
+<td>{{if .RenamedFrom}}from {{.RenamedFrom}}{{end}}</td>
+</tr>
+{{- end}}
+</table>
+</body>
+</html>
+`))
+
+var htmlPage = template.Must(template.New("page").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>{{.Name}}</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+pre { font-family: monospace; line-height: 1.3; }
+pre span { display: block; white-space: pre-wrap; }
+.add { background: #e6ffed; } .del { background: #ffeef0; } .hunk { color: #6a737d; background: #f1f8ff; } .header { font-weight: bold; }
+</style>
+</head>
+<body>
+<p><a href="{{.Index}}">Back to the summary</a></p>
+<h1>{{.Name}}</h1>
+<pre>
+{{- range .Lines}}<span class="{{.Class}}">{{.Text}}</span>{{end -}}
+</pre>
+</body>
+</html>
+`))
+
+// writeHTMLReport writes index.html into outputDir, with the summary counts
+// and a link per file to a page under html/ rendering its .diff. Files
+// present on one side link to their copy in the diffs directory instead.
+func writeHTMLReport(outputDir string, result Result) (string, error) {
+	indexFile := filepath.Join(outputDir, "index.html")
+	pageDir := filepath.Join(outputDir, "html")
+	if err := os.RemoveAll(pageDir); err != nil {
+		return "", err
+	}
+
+	counts := make(map[string]int)
+	var files []htmlFile
+	for _, file := range result.Files {
+		counts[file.Status]++
+		row := htmlFile{FileResult: file}
+		if file.Output != "" {
+			output := filepath.Join(outputDir, "diffs", file.Output)
+			if file.Status == "modified" {
+				page := filepath.Join(pageDir, file.Output+".html")
+				if err := writeHTMLPage(page, indexFile, file.Name, output); err != nil {
+					return "", err
+				}
+				row.Page = relativeLink(outputDir, page)
+			} else {
+				row.Copy = relativeLink(outputDir, output)
+			}
+		}
+		files = append(files, row)
+	}
+
+	type statusCount struct {
+		Status string
+		Count  int
+	}
+	var statusCounts []statusCount
+	for _, status := range []string{"added", "removed", "modified", "mode", "renamed"} {
+		if counts[status] > 0 {
+			statusCounts = append(statusCounts, statusCount{status, counts[status]})
+		}
+	}
+
+	out, err := os.Create(indexFile)
+	if err != nil {
+		return "", err
+	}
+	defer out.Close()
+
+	err = htmlIndex.Execute(out, map[string]any{
+		"Dir1":        result.Dir1,
+		"Dir2":        result.Dir2,
+		"Differences": result.Differences,
+		"Counts":      statusCounts,
+		"Files":       files,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return indexFile, out.Close()
+}
+
+// writeHTMLPage renders diffFile as page, each line colored by its kind.
+func writeHTMLPage(page, indexFile, name, diffFile string) error {
+	in, err := os.Open(diffFile)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	var lines []htmlLine
+	scanner := bufio.NewScanner(in)
+	scanner.Buffer(make([]byte, 64*1024), 64*1024*1024)
+	for scanner.Scan() {
+		text := scanner.Text()
+		class := ""
+		switch {
+		case strings.HasPrefix(text, "+++ ") || strings.HasPrefix(text, "--- "):
+			class = "header"
+		case strings.HasPrefix(text, "@@"):
+			class = "hunk"
+		case strings.HasPrefix(text, "+"):
+			class = "add"
+		case strings.HasPrefix(text, "-"):
+			class = "del"
+		}
+		lines = append(lines, htmlLine{class, text})
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(page), 0755); err != nil {
+		return err
+	}
+	out, err := os.Create(page)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	err = htmlPage.Execute(out, map[string]any{
+		"Name":  name,
+		"Index": relativeLink(filepath.Dir(page), indexFile),
+		"Lines": lines,
+	})
+	if err != nil {
+		return err
+	}
+
+	return out.Close()
+}
+
+// relativeLink returns target as a URL path relative to the directory from.
+func relativeLink(from, target string) string {
+	rel, err := filepath.Rel(from, target)
+	if err != nil {
+		rel = target
+	}
+	segments := strings.Split(filepath.ToSlash(rel), "/")
+	for i, segment := range segments {
+		segments[i] = url.PathEscape(segment)
+	}
+	return strings.Join(segments, "/")
+}
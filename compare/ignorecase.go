@@ -0,0 +1,40 @@
+package compare
+
+import "strings"
+
+// pairIgnoringCase returns checksums2 rekeyed so that a file whose name only
+// differs in case from a file of dir1 shares dir1's name, and records the
+// dir2 names in dir2Aliases. Names that match several files of one side,
+// which a case-sensitive filesystem allows, are left as they are.
+func (c *comparison) pairIgnoringCase(checksums1, checksums2 map[string]fileEntry) map[string]fileEntry {
+	byFold1 := namesByFold(checksums1)
+	byFold2 := namesByFold(checksums2)
+
+	paired := make(map[string]fileEntry, len(checksums2))
+	for fileName, entry := range checksums2 {
+		paired[fileName] = entry
+	}
+
+	for folded, names1 := range byFold1 {
+		names2 := byFold2[folded]
+		if len(names1) != 1 || len(names2) != 1 || names1[0] == names2[0] {
+			continue
+		}
+		name1, name2 := names1[0], names2[0]
+
+		paired[name1] = paired[name2]
+		delete(paired, name2)
+		c.dir2Aliases[name1] = name2
+	}
+
+	return paired
+}
+
+func namesByFold(checksums map[string]fileEntry) map[string][]string {
+	byFold := make(map[string][]string)
+	for fileName := range checksums {
+		folded := strings.ToLower(fileName)
+		byFold[folded] = append(byFold[folded], fileName)
+	}
+	return byFold
+}
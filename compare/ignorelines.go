@@ -0,0 +1,31 @@
+package compare
+
+import "bytes"
+
+// stripsLines reports whether lines are left out of the diffs. Unlike the
+// rewrites of normalizeContent it does not apply to the checksums.
+func (c *comparison) stripsLines() bool {
+	return c.ignoreBlankLines || len(c.commentPrefix) > 0
+}
+
+// diffContent returns the content of filePath as it is diffed: rewritten by
+// normalizeContent, without the blank and comment lines stripped by
+// -ignore-blank-lines and -comment-prefix.
+func (c *comparison) diffContent(filePath string, data []byte) []byte {
+	data = c.normalizeContent(filePath, data)
+	if !c.stripsLines() {
+		return data
+	}
+	kept := make([]byte, 0, len(data))
+	for _, line := range splitLines(data) {
+		trimmed := bytes.TrimSpace(line)
+		if c.ignoreBlankLines && len(trimmed) == 0 {
+			continue
+		}
+		if len(c.commentPrefix) > 0 && bytes.HasPrefix(trimmed, c.commentPrefix) {
+			continue
+		}
+		kept = append(kept, line...)
+	}
+	return kept
+}
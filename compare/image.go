@@ -0,0 +1,268 @@
+package compare
+
+import (
+	"archive/tar"
+	"bufio"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+const imagePrefix = "docker://"
+
+func (c *comparison) removeTempDirs() {
+	for _, dir := range c.tempDirs {
+		os.RemoveAll(dir)
+	}
+	c.tempDirs = nil
+}
+
+// inputName returns the name used for an input in the output directory name:
+// the base name of a directory, so absolute paths do not leak separators into
+// it, without the extension of a checksum CSV or a .zip file, or an image
+// reference flattened to a single path element.
+func inputName(input string) string {
+	if !strings.HasPrefix(input, imagePrefix) {
+		if abs, err := filepath.Abs(input); err == nil {
+			input = abs
+		}
+		name := filepath.Base(input)
+		if name == string(filepath.Separator) || name == "." {
+			name = "root"
+		}
+		if isChecksumManifest(input) {
+			name = name[:len(name)-len(".csv")]
+		}
+		if isZipInput(input) {
+			name = name[:len(name)-len(".zip")]
+		}
+		return name
+	}
+	return strings.NewReplacer("/", "_", ":", "_", "@", "_").Replace(strings.TrimPrefix(input, imagePrefix))
+}
+
+// prepareInput turns an input argument into a directory to compare. Plain
+// directories are returned as is, docker:// references are exported and
+// their layers flattened into a temporary directory, and .zip files are
+// opened to be read in place under their own path.
+func (c *comparison) prepareInput(ctx context.Context, input string) (string, error) {
+	if isZipInput(input) {
+		return c.openZip(input)
+	}
+	if !strings.HasPrefix(input, imagePrefix) {
+		return filepath.Clean(input), nil
+	}
+
+	root, err := os.MkdirTemp("", "inline-compare-image-*")
+	if err != nil {
+		return "", err
+	}
+	c.tempDirs = append(c.tempDirs, root)
+	c.verbosef(verboseDetails, "// temporary directory %s for %s\n", root, input)
+
+	ref := strings.TrimPrefix(input, imagePrefix)
+	rootfs := filepath.Join(root, inputName(input))
+	if err := c.exportImage(ctx, ref, root, rootfs); err != nil {
+		return "", err
+	}
+
+	c.logf("# Image %s extracted to %s\n", ref, rootfs)
+
+	return rootfs, nil
+}
+
+// exportImage saves ref with the docker CLI, pulling it first when it is not
+// available locally (registry credentials come from `docker login`), and
+// applies its layers in order into rootfs. Everything is streamed through
+// disk rather than memory, so large layers only cost disk space.
+func (c *comparison) exportImage(ctx context.Context, ref, workDir, rootfs string) error {
+	c.verboseCommand("docker", "image", "inspect", ref)
+	if err := exec.CommandContext(ctx, "docker", "image", "inspect", ref).Run(); err != nil {
+		c.logf("# Pulling image %s\n", ref)
+		c.verboseCommand("docker", "pull", ref)
+		cmd := exec.CommandContext(ctx, "docker", "pull", ref)
+		cmd.Stdout = c.output
+		cmd.Stderr = c.output
+		if err := cmd.Run(); err != nil {
+			return fmt.Errorf("docker pull %s: %v", ref, err)
+		}
+	}
+
+	archive := filepath.Join(workDir, "image.tar")
+	c.verboseCommand("docker", "save", "-o", archive, ref)
+	if output, err := exec.CommandContext(ctx, "docker", "save", "-o", archive, ref).CombinedOutput(); err != nil {
+		return fmt.Errorf("docker save %s: %v: %s", ref, err, strings.TrimSpace(string(output)))
+	}
+
+	saved := filepath.Join(workDir, "saved")
+	if err := extractArchive(archive, saved); err != nil {
+		return err
+	}
+	os.Remove(archive)
+
+	manifestData, err := os.ReadFile(filepath.Join(saved, "manifest.json"))
+	if err != nil {
+		return err
+	}
+	var manifest []struct {
+		Layers []string
+	}
+	if err := json.Unmarshal(manifestData, &manifest); err != nil {
+		return fmt.Errorf("reading image manifest: %v", err)
+	}
+	if len(manifest) == 0 {
+		return fmt.Errorf("image manifest of %s is empty", ref)
+	}
+
+	if err := os.MkdirAll(rootfs, 0755); err != nil {
+		return err
+	}
+	for _, layer := range manifest[0].Layers {
+		c.verbosef(verboseFiles, "// applying layer %s\n", layer)
+		if err := applyLayer(filepath.Join(saved, layer), rootfs); err != nil {
+			return fmt.Errorf("applying layer %s: %v", layer, err)
+		}
+	}
+
+	return os.RemoveAll(saved)
+}
+
+// extractArchive unpacks the docker save tarball as plain files.
+func extractArchive(archive, dest string) error {
+	file, err := os.Open(archive)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	reader := tar.NewReader(file)
+	for {
+		header, err := reader.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		target, err := safeJoin(dest, header.Name)
+		if err != nil {
+			return err
+		}
+		switch header.Typeflag {
+		case tar.TypeDir:
+			err = os.MkdirAll(target, 0755)
+		case tar.TypeReg:
+			if err = os.MkdirAll(filepath.Dir(target), 0755); err == nil {
+				err = writeTarFile(reader, target, 0644)
+			}
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// applyLayer unpacks one layer over rootfs, honoring whiteout files. Symlinks
+// are stored as small text files holding their target so they are compared
+// by target and never followed into the host filesystem.
+func applyLayer(layerFile, rootfs string) error {
+	file, err := os.Open(layerFile)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	var layer io.Reader = bufio.NewReader(file)
+	if magic, err := layer.(*bufio.Reader).Peek(2); err == nil && magic[0] == 0x1f && magic[1] == 0x8b {
+		gz, err := gzip.NewReader(layer)
+		if err != nil {
+			return err
+		}
+		defer gz.Close()
+		layer = gz
+	}
+
+	reader := tar.NewReader(layer)
+	for {
+		header, err := reader.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		target, err := safeJoin(rootfs, header.Name)
+		if err != nil {
+			return err
+		}
+
+		base := filepath.Base(target)
+		if base == ".wh..wh..opq" {
+			// Opaque directory: drop everything lower layers put there
+			entries, _ := os.ReadDir(filepath.Dir(target))
+			for _, entry := range entries {
+				os.RemoveAll(filepath.Join(filepath.Dir(target), entry.Name()))
+			}
+			continue
+		}
+		if strings.HasPrefix(base, ".wh.") {
+			os.RemoveAll(filepath.Join(filepath.Dir(target), strings.TrimPrefix(base, ".wh.")))
+			continue
+		}
+
+		if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+			return err
+		}
+		switch header.Typeflag {
+		case tar.TypeDir:
+			err = os.MkdirAll(target, os.FileMode(header.Mode).Perm()|0700)
+		case tar.TypeReg:
+			err = writeTarFile(reader, target, os.FileMode(header.Mode).Perm()|0600)
+		case tar.TypeSymlink:
+			err = writeTarFile(strings.NewReader("symlink -> "+header.Linkname+"\n"), target, 0644)
+		case tar.TypeLink:
+			var source string
+			source, err = safeJoin(rootfs, header.Linkname)
+			if err == nil {
+				os.RemoveAll(target)
+				err = os.Link(source, target)
+			}
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func writeTarFile(reader io.Reader, target string, mode os.FileMode) error {
+	os.RemoveAll(target)
+	file, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, mode)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	_, err = io.Copy(file, reader)
+	if err != nil {
+		return err
+	}
+
+	return os.Chmod(target, mode)
+}
+
+// safeJoin joins name below root, rejecting entries that would escape it.
+func safeJoin(root, name string) (string, error) {
+	target := filepath.Join(root, filepath.Clean("/"+name))
+	if target != root && !strings.HasPrefix(target, root+string(filepath.Separator)) {
+		return "", fmt.Errorf("archive entry %q escapes %s", name, root)
+	}
+	return target, nil
+}
@@ -0,0 +1,139 @@
+package compare
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+)
+
+// maxWindowBytes caps how much of each file a -full-large window reads, so a
+// file without newlines is not loaded whole.
+const maxWindowBytes = 1024 * 1024
+
+// largeFileWindow finds the first difference of two files over the size
+// limit by streaming both block by block, and returns a note with its offset
+// followed by a unified diff of the lineLimit lines from a little before it.
+// It returns nothing when the compared content is equal.
+func (c *comparison) largeFileWindow(file1 string, info1 os.FileInfo, file2 string, info2 os.FileInfo, lineLimit int) ([]byte, error) {
+	f1, err := c.openContent(file1)
+	if err != nil {
+		return nil, err
+	}
+	defer f1.Close()
+	f2, err := c.openContent(file2)
+	if err != nil {
+		return nil, err
+	}
+	defer f2.Close()
+
+	offset1, length1 := c.contentRange(info1.Size())
+	offset2, length2 := c.contentRange(info2.Size())
+	at, found, err := firstDifferentByte(io.NewSectionReader(f1, offset1, length1), io.NewSectionReader(f2, offset2, length2))
+	if err != nil || !found {
+		return nil, err
+	}
+
+	start, line, diffLine, err := c.windowStart(io.NewSectionReader(f1, offset1, length1), at)
+	if err != nil {
+		return nil, err
+	}
+	window1, err := readLines(io.NewSectionReader(f1, offset1+start, length1-start), lineLimit)
+	if err != nil {
+		return nil, err
+	}
+	window2, err := readLines(io.NewSectionReader(f2, offset2+start, length2-start), lineLimit)
+	if err != nil {
+		return nil, err
+	}
+
+	var out bytes.Buffer
+	fmt.Fprintf(&out, "Files differ first at byte offset %d (line %d); showing up to %d lines from line %d.\n", at, diffLine, lineLimit, line)
+	out.Write(c.unifiedDiffFrom(line, file1, info1.ModTime(), window1, file2, info2.ModTime(), window2))
+	return out.Bytes(), nil
+}
+
+// firstDifferentByte returns the offset of the first byte where r1 and r2
+// differ, including the end of the shorter one.
+func firstDifferentByte(r1, r2 io.Reader) (int64, bool, error) {
+	buf1 := make([]byte, 64*1024)
+	buf2 := make([]byte, 64*1024)
+	var offset int64
+	for {
+		n1, err1 := io.ReadFull(r1, buf1)
+		n2, err2 := io.ReadFull(r2, buf2)
+		if err1 != nil && err1 != io.EOF && err1 != io.ErrUnexpectedEOF {
+			return 0, false, err1
+		}
+		if err2 != nil && err2 != io.EOF && err2 != io.ErrUnexpectedEOF {
+			return 0, false, err2
+		}
+
+		n := min(n1, n2)
+		for i := 0; i < n; i++ {
+			if buf1[i] != buf2[i] {
+				return offset + int64(i), true, nil
+			}
+		}
+		if n1 != n2 {
+			return offset + int64(n), true, nil
+		}
+		if err1 != nil {
+			return 0, false, nil
+		}
+		offset += int64(n)
+	}
+}
+
+// windowStart returns the offset and number of the line diffContext lines
+// before the line holding offset at, and the number of that line. Only the
+// content before at is read, which the two files share.
+func (c *comparison) windowStart(r io.Reader, at int64) (int64, int, int, error) {
+	// starts holds the offsets of the last diffContext+1 lines seen
+	starts := make([]int64, 0, c.diffContext+1)
+	starts = append(starts, 0)
+	line := 1
+
+	buf := make([]byte, 64*1024)
+	var offset int64
+	for offset < at {
+		n, err := r.Read(buf[:min(int64(len(buf)), at-offset)])
+		for i, b := range buf[:n] {
+			if b != '\n' {
+				continue
+			}
+			if len(starts) == cap(starts) {
+				starts = append(starts[:0], starts[1:]...)
+			}
+			starts = append(starts, offset+int64(i)+1)
+			line++
+		}
+		offset += int64(n)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return 0, 0, 0, err
+		}
+	}
+
+	return starts[0], line - len(starts) + 1, line, nil
+}
+
+// readLines returns up to n lines from r, stopping at maxWindowBytes.
+func readLines(r io.Reader, n int) ([]byte, error) {
+	reader := bufio.NewReader(io.LimitReader(r, maxWindowBytes))
+	var out []byte
+	for i := 0; i < n; i++ {
+		line, err := reader.ReadBytes('\n')
+		out = append(out, line...)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return out, nil
+}
@@ -0,0 +1,664 @@
+package compare
+
+import (
+	"container/heap"
+	"context"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// sortRunSize is the number of checksum records sorted in memory at a time
+// by -low-memory before they are spilled to a temporary run file.
+const sortRunSize = 100000
+
+// generateCombinedCSVLowMemory produces diff.csv without keeping either
+// directory's files or checksums in memory: both checksum CSVs are hashed
+// from names sorted on disk, sorted on disk in diff.csv order and then
+// merge-joined row by row. It returns the number of rows below the header.
+func (c *comparison) generateCombinedCSVLowMemory(ctx context.Context, dir1, dir2 string, useCache bool, outputDir string) (int, error) {
+	csvFile1, err := c.scanChecksumsLowMemory(ctx, dir1, useCache, outputDir)
+	if err != nil {
+		return 0, err
+	}
+	csvFile2, err := c.scanChecksumsLowMemory(ctx, dir2, useCache, outputDir)
+	if err != nil {
+		return 0, err
+	}
+
+	sorted1, err := c.sortCSVOnDisk(csvFile1, outputDir)
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(sorted1)
+	sorted2, err := c.sortCSVOnDisk(csvFile2, outputDir)
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(sorted2)
+
+	return c.mergeJoinCSV(sorted1, sorted2, dir1, dir2, outputDir)
+}
+
+// scanChecksumsLowMemory is scanChecksums for -low-memory. The walk of dir
+// is spilled to sorted runs of file names, and the merged names are statted
+// again and hashed sortRunSize at a time straight into the checksum CSV,
+// which ends up sorted by name as in memory. With -use-cache the existing
+// CSV, sorted the same way, is read alongside instead of being loaded. It
+// returns the CSV path.
+func (c *comparison) scanChecksumsLowMemory(ctx context.Context, dir string, useCache bool, outputDir string) (string, error) {
+	csvFile := c.checksumCSV(outputDir, dir)
+	if !useCache {
+		// Delete existing checksum file if it exists
+		if err := os.Remove(csvFile); err != nil && !os.IsNotExist(err) {
+			return "", err
+		}
+	}
+
+	runs, count, err := c.spillFileNames(dir, outputDir)
+	if err != nil {
+		return "", err
+	}
+	defer removeRuns(runs)
+	names, err := c.openRuns(runs, pathLess)
+	if err != nil {
+		return "", err
+	}
+	defer names.close()
+
+	var cache *checksumCache
+	if useCache {
+		cache, err = c.openChecksumCache(csvFile)
+		if err != nil {
+			return "", fmt.Errorf("reading the -use-cache checksums: %v", err)
+		}
+		defer cache.close()
+	}
+
+	// The cached CSV is only replaced once the new one is complete
+	out, err := os.CreateTemp(outputDir, "checksums-*.csv")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(out.Name())
+	defer out.Close()
+
+	c.progress.phase("checksums " + dir)
+	c.meter.start("Hashing "+dir, count)
+	writer := c.newCSVWriter(out)
+	written, reused, err := c.hashRuns(ctx, dir, names, cache, writer)
+	c.meter.finish()
+	if err != nil {
+		return "", err
+	}
+	writer.Flush()
+	if err := writer.Error(); err != nil {
+		return "", err
+	}
+	if err := out.Close(); err != nil {
+		return "", err
+	}
+	cache.close()
+	if err := os.Rename(out.Name(), csvFile); err != nil {
+		return "", err
+	}
+
+	if useCache {
+		c.logf("# Checksums for %s generated (%s, %d of %d reused from the cache)\n", dir, csvFile, reused, written)
+	} else {
+		c.logf("# Checksums for %s generated (%s)\n", dir, csvFile)
+	}
+
+	return csvFile, nil
+}
+
+// hashRuns hashes the files of dir named by names, sortRunSize at a time
+// across the -workers, and writes their rows to writer in the order of
+// names. It returns the number of rows written and of checksums reused from
+// cache.
+func (c *comparison) hashRuns(ctx context.Context, dir string, names *runMerger, cache *checksumCache, writer *csv.Writer) (int, int, error) {
+	written, reused := 0, 0
+	batch := make([]listedFile, 0, sortRunSize)
+	known := make([]string, 0, sortRunSize)
+	flush := func() error {
+		checksums, err := c.hashFiles(ctx, dir, batch, nil, known)
+		if err != nil {
+			return err
+		}
+		files, checksums := c.withoutSkipped(batch, checksums)
+		for i, file := range files {
+			// Print the file checksum
+			c.itemf(" - %s: %s\n", filepath.Join(dir, file.path), checksums[i])
+			if err := writer.Write(checksumRow(file, checksums[i])); err != nil {
+				return err
+			}
+		}
+		written += len(files)
+		batch, known = batch[:0], known[:0]
+		return nil
+	}
+
+	for {
+		record, err := names.next()
+		if err != nil {
+			return written, reused, err
+		}
+		if record == nil {
+			if len(batch) > 0 {
+				err = flush()
+			}
+			return written, reused, err
+		}
+
+		filePath := filepath.Join(dir, record[0])
+		info, err := c.statRetried(filePath)
+		if err != nil && c.skipFile(record[0], filePath, err) {
+			c.meter.step()
+			continue
+		}
+		if err != nil {
+			return written, reused, err
+		}
+		file := listedFile{path: record[0], FileInfo: info}
+		entry, ok, err := cache.lookup(file.path)
+		if err != nil {
+			return written, reused, fmt.Errorf("reading the -use-cache checksums: %v", err)
+		}
+		checksum := ""
+		if ok && entry.current(file, c.quickHash) {
+			checksum = entry.checksum
+			reused++
+		}
+		batch = append(batch, file)
+		known = append(known, checksum)
+
+		if len(batch) == sortRunSize {
+			if err := flush(); err != nil {
+				return written, reused, err
+			}
+		}
+	}
+}
+
+// spillFileNames walks dir and writes the names of its files to runs of up
+// to sortRunSize names, each sorted on disk. It returns the runs and the
+// number of files.
+func (c *comparison) spillFileNames(dir, outputDir string) ([]string, int, error) {
+	var runs []string
+	count := 0
+	batch := make([][]string, 0, sortRunSize)
+	spill := func() error {
+		run, err := c.writeSortedRun(batch, pathLess, outputDir)
+		if err != nil {
+			return err
+		}
+		runs = append(runs, run)
+		batch = batch[:0]
+		return nil
+	}
+
+	err := c.walkFiles(dir, func(file listedFile) error {
+		batch = append(batch, []string{file.path})
+		count++
+		if len(batch) == sortRunSize {
+			return spill()
+		}
+		return nil
+	})
+	if err == nil && len(batch) > 0 {
+		err = spill()
+	}
+	if err != nil {
+		removeRuns(runs)
+		return nil, 0, err
+	}
+
+	return runs, count, nil
+}
+
+// pathLess orders file names as the checksum CSVs are.
+func pathLess(a, b string) bool {
+	return a < b
+}
+
+// removeRuns removes the temporary run files.
+func removeRuns(runs []string) {
+	for _, run := range runs {
+		os.Remove(run)
+	}
+}
+
+// checksumCache reads the checksum CSV of an earlier run alongside the
+// names being hashed, for -use-cache with -low-memory. A nil checksumCache
+// has no entries.
+type checksumCache struct {
+	path   string
+	file   *os.File
+	reader *csv.Reader
+	record []string
+	done   bool
+}
+
+// openChecksumCache opens the checksum CSV of an earlier run. A missing CSV
+// only means that the files are hashed again.
+func (c *comparison) openChecksumCache(csvFile string) (*checksumCache, error) {
+	file, err := os.Open(csvFile)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	reader := c.newCSVReader(file)
+	reader.FieldsPerRecord = -1
+	return &checksumCache{path: csvFile, file: file, reader: reader}, nil
+}
+
+// lookup returns the cached checksum of name, which sorts after the names
+// looked up before it. The rows are checked as readChecksumCache does.
+func (cc *checksumCache) lookup(name string) (cachedChecksum, bool, error) {
+	if cc == nil {
+		return cachedChecksum{}, false, nil
+	}
+	for !cc.done && (cc.record == nil || cc.record[0] < name) {
+		record, err := cc.reader.Read()
+		if err == io.EOF {
+			cc.done = true
+			break
+		}
+		if err != nil {
+			return cachedChecksum{}, false, fmt.Errorf("%s: %v", cc.path, err)
+		}
+		if len(record) < 2 {
+			line, _ := cc.reader.FieldPos(0)
+			return cachedChecksum{}, false, fmt.Errorf("%s line %d: expected at least 2 fields, got %d", cc.path, line, len(record))
+		}
+		cc.record = record
+	}
+	if cc.done || cc.record[0] != name {
+		return cachedChecksum{}, false, nil
+	}
+
+	entry, ok, err := parseCachedChecksum(cc.record)
+	if err != nil {
+		line, _ := cc.reader.FieldPos(0)
+		return cachedChecksum{}, false, fmt.Errorf("%s line %d: %v", cc.path, line, err)
+	}
+	return entry, ok, nil
+}
+
+func (cc *checksumCache) close() {
+	if cc != nil {
+		cc.file.Close()
+	}
+}
+
+// sortCSVOnDisk sorts a checksum CSV by file name with an external merge
+// sort and returns the path of the sorted temporary copy.
+func (c *comparison) sortCSVOnDisk(csvFile, outputDir string) (string, error) {
+	file, err := os.Open(csvFile)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	var runs []string
+	defer func() {
+		removeRuns(runs)
+	}()
+
+	reader := c.newCSVReader(file)
+	batch := make([][]string, 0, sortRunSize)
+	for {
+		record, err := reader.Read()
+		if err != nil && err != io.EOF {
+			return "", err
+		}
+		if record != nil {
+			batch = append(batch, record)
+		}
+		if len(batch) == sortRunSize || (err == io.EOF && len(batch) > 0) {
+			run, werr := c.writeSortedRun(batch, c.fileNameLess, outputDir)
+			if werr != nil {
+				return "", werr
+			}
+			runs = append(runs, run)
+			batch = batch[:0]
+		}
+		if err == io.EOF {
+			break
+		}
+	}
+
+	sorted, err := os.CreateTemp(outputDir, "sorted-*.csv")
+	if err != nil {
+		return "", err
+	}
+	defer sorted.Close()
+
+	if err := c.mergeRuns(runs, c.fileNameLess, sorted); err != nil {
+		os.Remove(sorted.Name())
+		return "", err
+	}
+
+	return sorted.Name(), nil
+}
+
+// writeSortedRun sorts batch by the file name of its records, as less does,
+// and writes it to a temporary run file whose path it returns.
+func (c *comparison) writeSortedRun(batch [][]string, less func(a, b string) bool, outputDir string) (string, error) {
+	sort.Slice(batch, func(i, j int) bool {
+		return less(batch[i][0], batch[j][0])
+	})
+
+	run, err := os.CreateTemp(outputDir, "run-*.csv")
+	if err != nil {
+		return "", err
+	}
+	defer run.Close()
+	c.verbosef(verboseDetails, "// sorted run of %d records in %s\n", len(batch), run.Name())
+
+	writer := c.newCSVWriter(run)
+	if err := writer.WriteAll(batch); err != nil {
+		os.Remove(run.Name())
+		return "", err
+	}
+
+	return run.Name(), nil
+}
+
+// runCursor is the next unread record of one sorted run.
+type runCursor struct {
+	reader *csv.Reader
+	record []string
+}
+
+// runHeap orders the cursors of the runs by the file name of their record,
+// as less does.
+type runHeap struct {
+	cursors []*runCursor
+	less    func(a, b string) bool
+}
+
+func (h *runHeap) Len() int           { return len(h.cursors) }
+func (h *runHeap) Less(i, j int) bool { return h.less(h.cursors[i].record[0], h.cursors[j].record[0]) }
+func (h *runHeap) Swap(i, j int)      { h.cursors[i], h.cursors[j] = h.cursors[j], h.cursors[i] }
+func (h *runHeap) Push(x any)         { h.cursors = append(h.cursors, x.(*runCursor)) }
+func (h *runHeap) Pop() any {
+	cursor := h.cursors[len(h.cursors)-1]
+	h.cursors = h.cursors[:len(h.cursors)-1]
+	return cursor
+}
+
+// runMerger k-way merges sorted runs one record at a time.
+type runMerger struct {
+	files []*os.File
+	heap  runHeap
+}
+
+// openRuns opens the runs, each sorted as less orders them, for merging.
+func (c *comparison) openRuns(runs []string, less func(a, b string) bool) (*runMerger, error) {
+	m := &runMerger{heap: runHeap{less: less}}
+	for _, run := range runs {
+		file, err := os.Open(run)
+		if err != nil {
+			m.close()
+			return nil, err
+		}
+		m.files = append(m.files, file)
+
+		cursor := &runCursor{reader: c.newCSVReader(file)}
+		cursor.record, err = cursor.reader.Read()
+		if err == io.EOF {
+			continue
+		}
+		if err != nil {
+			m.close()
+			return nil, err
+		}
+		heap.Push(&m.heap, cursor)
+	}
+
+	return m, nil
+}
+
+// next returns the first unread record of all runs, or nil once they are
+// all read.
+func (m *runMerger) next() ([]string, error) {
+	if m.heap.Len() == 0 {
+		return nil, nil
+	}
+
+	cursor := m.heap.cursors[0]
+	record := cursor.record
+	next, err := cursor.reader.Read()
+	switch {
+	case err == io.EOF:
+		heap.Pop(&m.heap)
+	case err != nil:
+		return nil, err
+	default:
+		cursor.record = next
+		heap.Fix(&m.heap, 0)
+	}
+	return record, nil
+}
+
+func (m *runMerger) close() {
+	for _, file := range m.files {
+		file.Close()
+	}
+}
+
+// mergeRuns k-way merges the runs, each sorted as less orders them, into
+// out.
+func (c *comparison) mergeRuns(runs []string, less func(a, b string) bool, out io.Writer) error {
+	m, err := c.openRuns(runs, less)
+	if err != nil {
+		return err
+	}
+	defer m.close()
+
+	writer := c.newCSVWriter(out)
+	for {
+		record, err := m.next()
+		if err != nil {
+			return err
+		}
+		if record == nil {
+			break
+		}
+		if err := writer.Write(record); err != nil {
+			return err
+		}
+	}
+	writer.Flush()
+
+	return writer.Error()
+}
+
+// mergeJoinCSV walks two sorted checksum CSVs side by side and writes the
+// differing rows to diff.csv, returning how many. Metadata is only looked up
+// with os.Stat when a column, -check-mode or -check-owner needs it.
+func (c *comparison) mergeJoinCSV(sorted1, sorted2, dir1, dir2, outputDir string) (int, error) {
+	file1, err := os.Open(sorted1)
+	if err != nil {
+		return 0, err
+	}
+	defer file1.Close()
+	file2, err := os.Open(sorted2)
+	if err != nil {
+		return 0, err
+	}
+	defer file2.Close()
+
+	outputFile, err := os.Create(filepath.Join(outputDir, "diff.csv"))
+	if err != nil {
+		return 0, err
+	}
+	defer outputFile.Close()
+
+	writer := c.newCSVWriter(outputFile)
+	err = writer.Write(c.combinedHeaders(dir1, dir2))
+	if err != nil {
+		return 0, err
+	}
+
+	reader1 := c.newCSVReader(file1)
+	reader2 := c.newCSVReader(file2)
+	record1, err := readNext(reader1)
+	if err != nil {
+		return 0, err
+	}
+	record2, err := readNext(reader2)
+	if err != nil {
+		return 0, err
+	}
+
+	rows := 0
+	needStat := c.checkPerms || c.checkOwner || len(c.extraColumns) > 0
+	for record1 != nil || record2 != nil {
+		var fileName string
+		var entry1, entry2 fileEntry
+		switch {
+		case record2 == nil || (record1 != nil && c.fileNameLess(record1[0], record2[0])):
+			fileName, entry1 = record1[0], fileEntry{checksum: record1[1]}
+			record1, err = readNext(reader1)
+		case record1 == nil || c.fileNameLess(record2[0], record1[0]):
+			fileName, entry2 = record2[0], fileEntry{checksum: record2[1]}
+			record2, err = readNext(reader2)
+		default:
+			fileName = record1[0]
+			entry1, entry2 = fileEntry{checksum: record1[1]}, fileEntry{checksum: record2[1]}
+			record1, err = readNext(reader1)
+			if err == nil {
+				record2, err = readNext(reader2)
+			}
+		}
+		if err != nil {
+			return 0, err
+		}
+		if c.skippedFiles[fileName] {
+			continue
+		}
+
+		if needStat {
+			c.statEntry(&entry1, filepath.Join(dir1, fileName))
+			c.statEntry(&entry2, filepath.Join(dir2, fileName))
+		}
+
+		record, differs := c.combinedRecord(fileName, entry1, entry2)
+		if !differs {
+			c.countIdentical(fileName)
+			continue
+		}
+		if !c.keptByOnly(record) {
+			continue
+		}
+		if err := writer.Write(record); err != nil {
+			return 0, err
+		}
+		rows++
+	}
+	writer.Flush()
+	if err := writer.Error(); err != nil {
+		return 0, err
+	}
+
+	// diff.csv is all this mode keeps of the comparison, so a failed write
+	// back to disk must not pass for success
+	return rows, outputFile.Close()
+}
+
+// runDiffPhaseLowMemory is runDiffPhase for -low-memory. diff.csv, of rows
+// rows, is read back sortRunSize rows at a time, so the stat results, output
+// paths and diff tasks of a batch are let go before the next one, and only
+// the rows are kept, for the result. A dry run and -emit-sync list every row
+// at once and read them all.
+func (c *comparison) runDiffPhaseLowMemory(ctx context.Context, rows int, dir1, dir2, outputDir string, sizeLimit, lineLimit int, emitSync string) (int, [][]string, error) {
+	if c.dryRun || emitSync != "" {
+		records, err := c.readCombinedCSV(outputDir)
+		if err != nil {
+			return 0, nil, fmt.Errorf("reading combined CSV: %v", err)
+		}
+		return c.runDiffPhase(ctx, records, dir1, dir2, outputDir, sizeLimit, lineLimit, emitSync)
+	}
+
+	c.progress.phase("diff")
+	csvFile := filepath.Join(outputDir, "diff.csv")
+	file, err := os.Open(csvFile)
+	if err != nil {
+		return 0, nil, fmt.Errorf("reading combined CSV: %v", err)
+	}
+	defer file.Close()
+	reader := c.newCSVReader(file)
+	reader.FieldsPerRecord = -1
+	if _, err := readNext(reader); err != nil {
+		return 0, nil, fmt.Errorf("reading combined CSV: %s: %v", csvFile, err)
+	}
+
+	p, err := c.startDiffPhase(dir1, dir2, sizeLimit, lineLimit, outputDir, rows)
+	if err != nil {
+		return 0, nil, fmt.Errorf("comparing files: %v", err)
+	}
+	defer c.meter.finish()
+
+	var records [][]string
+	batch := make([][]string, 0, sortRunSize)
+	for {
+		record, err := readNext(reader)
+		if err != nil {
+			return 0, nil, fmt.Errorf("reading combined CSV: %s: %v", csvFile, err)
+		}
+		if record != nil && len(record) < 3 {
+			line, _ := reader.FieldPos(0)
+			return 0, nil, fmt.Errorf("reading combined CSV: %s line %d: expected at least 3 fields, got %d", csvFile, line, len(record))
+		}
+		if record != nil {
+			batch = append(batch, record)
+		}
+		if len(batch) == sortRunSize || (record == nil && len(batch) > 0) {
+			if err := c.compareBatch(ctx, p, batch); err != nil {
+				return 0, nil, fmt.Errorf("comparing files: %v", err)
+			}
+			records = append(records, batch...)
+			batch = batch[:0]
+		}
+		if record == nil {
+			break
+		}
+	}
+	// diff.csv is rewritten with the columns filled in from the diffs
+	file.Close()
+
+	count, err := c.finishDiffPhase(p)
+	if err != nil {
+		return 0, nil, fmt.Errorf("comparing files: %v", err)
+	}
+	return count, records, nil
+}
+
+// readNext returns the next record, or nil at the end of the input.
+func readNext(reader *csv.Reader) ([]string, error) {
+	record, err := reader.Read()
+	if err == io.EOF {
+		return nil, nil
+	}
+	return record, err
+}
+
+// statEntry fills size, mtime, mode and owner of entry if the file is present.
+func (c *comparison) statEntry(entry *fileEntry, filePath string) {
+	if entry.checksum == "" {
+		return
+	}
+	if info, err := c.statRetried(filePath); err == nil {
+		entry.size = info.Size()
+		entry.modTime = info.ModTime()
+		entry.mode = info.Mode()
+		entry.owner = fileOwner(info)
+	}
+}
@@ -0,0 +1,133 @@
+package compare
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// maxReportDiffLines caps how many lines of each diff report.md includes.
+const maxReportDiffLines = 500
+
+// writeMarkdownReport writes report.md into outputDir: a table of the counts
+// by status, a list of the differing files and the .diff of each modified file
+// in a fenced block, cut after maxReportDiffLines lines with a pointer to the
+// full .diff.
+func writeMarkdownReport(outputDir string, result Result) (string, error) {
+	reportFile := filepath.Join(outputDir, "report.md")
+
+	counts := make(map[string]int)
+	for _, file := range result.Files {
+		counts[file.Status]++
+	}
+
+	var out bytes.Buffer
+	fmt.Fprintf(&out, "# Compare %s and %s\n\n", markdownCode(result.Dir1), markdownCode(result.Dir2))
+	fmt.Fprintf(&out, "Total differences found: %d\n\n", result.Differences)
+	out.WriteString("| Status | Files |\n| --- | ---: |\n")
+	fmt.Fprintf(&out, "| identical | %d |\n", result.Identical)
+	for _, status := range []string{"added", "removed", "modified", "mode", "renamed"} {
+		// permission changes and renames only get a row when there are any
+		if counts[status] == 0 && (status == "mode" || status == "renamed") {
+			continue
+		}
+		fmt.Fprintf(&out, "| %s | %d |\n", status, counts[status])
+	}
+
+	if len(result.Files) > 0 {
+		out.WriteString("\n## Files\n\n")
+		for _, file := range result.Files {
+			name := markdownCode(file.Name)
+			if file.Output != "" {
+				name = fmt.Sprintf("[%s](%s)", name, relativeLink(outputDir, filepath.Join(outputDir, "diffs", file.Output)))
+			}
+			fmt.Fprintf(&out, "- %s: %s", file.Status, name)
+			if file.RenamedFrom != "" {
+				fmt.Fprintf(&out, " from %s", markdownCode(file.RenamedFrom))
+			}
+			out.WriteString("\n")
+		}
+	}
+
+	for _, file := range result.Files {
+		if file.Status != "modified" || file.Output == "" {
+			continue
+		}
+		diffFile := filepath.Join(outputDir, "diffs", file.Output)
+		lines, truncated, err := readReportDiff(diffFile)
+		if err != nil {
+			return "", err
+		}
+
+		fence := markdownFence(lines)
+		fmt.Fprintf(&out, "\n## %s\n\n%sdiff\n", markdownCode(file.Name), fence)
+		for _, line := range lines {
+			out.WriteString(line)
+			out.WriteString("\n")
+		}
+		out.WriteString(fence + "\n")
+		if truncated {
+			fmt.Fprintf(&out, "\nOnly the first %d lines are shown, see [%s](%s) for the full diff.\n", maxReportDiffLines, file.Output, relativeLink(outputDir, diffFile))
+		}
+	}
+
+	if err := os.WriteFile(reportFile, out.Bytes(), 0644); err != nil {
+		return "", err
+	}
+	return reportFile, nil
+}
+
+// readReportDiff returns the first maxReportDiffLines lines of diffFile and
+// whether there were more.
+func readReportDiff(diffFile string) ([]string, bool, error) {
+	in, err := os.Open(diffFile)
+	if err != nil {
+		return nil, false, err
+	}
+	defer in.Close()
+
+	var lines []string
+	scanner := bufio.NewScanner(in)
+	scanner.Buffer(make([]byte, 64*1024), 64*1024*1024)
+	for scanner.Scan() {
+		if len(lines) == maxReportDiffLines {
+			return lines, true, nil
+		}
+		lines = append(lines, scanner.Text())
+	}
+	return lines, false, scanner.Err()
+}
+
+// markdownFence returns a run of backticks longer than any in lines, so a
+// diff of a Markdown file cannot close its block early.
+func markdownFence(lines []string) string {
+	longest := 0
+	for _, line := range lines {
+		run := 0
+		for _, c := range line {
+			if c == '`' {
+				run++
+				longest = max(longest, run)
+			} else {
+				run = 0
+			}
+		}
+	}
+	return strings.Repeat("`", max(3, longest+1))
+}
+
+// markdownCode formats name as inline code, with a fence longer than any
+// backticks it holds.
+func markdownCode(name string) string {
+	fence := "`"
+	for strings.Contains(name, fence) {
+		fence += "`"
+	}
+	if strings.HasPrefix(name, "`") || strings.HasSuffix(name, "`") {
+		name = " " + name + " "
+	}
+	return fence + name + fence
+}
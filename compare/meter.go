@@ -0,0 +1,81 @@
+package compare
+
+import (
+	"fmt"
+	"io"
+	"sync"
+)
+
+// progressMeter prints the percentage of files done in the current step,
+// rewriting a single line. A nil meter ignores all updates.
+type progressMeter struct {
+	w io.Writer
+
+	mu      sync.Mutex
+	label   string
+	done    int
+	total   int
+	percent int
+	open    bool
+}
+
+// start begins a step over total files, labelled for the line.
+func (p *progressMeter) start(label string, total int) {
+	if p == nil {
+		return
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.end()
+	p.label, p.done, p.total, p.percent = label, 0, total, -1
+	p.print()
+}
+
+// step counts one more file done. It is safe for concurrent use.
+func (p *progressMeter) step() {
+	if p == nil {
+		return
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.done++
+	p.print()
+}
+
+// finish ends the line of the current step.
+func (p *progressMeter) finish() {
+	if p == nil {
+		return
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.end()
+}
+
+// print rewrites the line when the percentage has changed, so huge trees do
+// not flood the terminal.
+func (p *progressMeter) print() {
+	percent := 100
+	if p.total > 0 {
+		percent = p.done * 100 / p.total
+	}
+	if percent == p.percent {
+		return
+	}
+	p.percent = percent
+	p.open = true
+	fmt.Fprintf(p.w, "\r# %s: %3d%% (%d/%d)", p.label, percent, p.done, p.total)
+}
+
+func (p *progressMeter) end() {
+	if p.open {
+		fmt.Fprintln(p.w)
+		p.open = false
+	}
+}
@@ -0,0 +1,35 @@
+package compare
+
+import (
+	"fmt"
+	"hash"
+	"os"
+	runtimedebug "runtime/debug"
+)
+
+// hashMapped feeds the length bytes of file from start to hash in a single
+// Write of its memory-mapped content, which saves copying every block
+// through a read buffer. It reports false, having hashed nothing, when the
+// file is below mmapThreshold or cannot be mapped, so the caller reads it
+// instead. A file truncated while it is hashed faults on the missing pages,
+// which is returned as an error rather than crashing. The mapping is
+// released before it returns.
+func (c *comparison) hashMapped(hash hash.Hash, file *os.File, start, length int64) (mapped bool, err error) {
+	if c.mmapThreshold == 0 || length < c.mmapThreshold {
+		return false, nil
+	}
+	data, err := mapFile(file, start+length)
+	if err != nil {
+		return false, nil
+	}
+	defer unmapFile(data)
+
+	defer runtimedebug.SetPanicOnFault(runtimedebug.SetPanicOnFault(true))
+	defer func() {
+		if recover() != nil {
+			err = fmt.Errorf("%s changed while it was hashed", file.Name())
+		}
+	}()
+	hash.Write(data[start:])
+	return true, nil
+}
@@ -0,0 +1,16 @@
+//go:build !unix
+
+package compare
+
+import (
+	"errors"
+	"os"
+)
+
+// mapFile does not map files where syscall has no mmap, such as on
+// Windows, so they are always read through a buffer.
+func mapFile(file *os.File, size int64) ([]byte, error) {
+	return nil, errors.ErrUnsupported
+}
+
+func unmapFile(data []byte) {}
@@ -0,0 +1,161 @@
+package compare
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// MultiResult is the outcome of a comparison of more than two directories.
+type MultiResult struct {
+	// Dirs are the compared directories, in the order given.
+	Dirs []string
+	// OutputDir holds the combined diff.csv and a subdirectory per pair,
+	// unless Options.OutputDir was empty.
+	OutputDir string
+	// Pairs holds the comparison of the first directory with each of the
+	// others, in order.
+	Pairs []Result
+	// Files lists the files whose checksums do not all agree.
+	Files []MultiFileResult
+}
+
+// MultiFileResult is a row of the combined diff.csv of several directories.
+type MultiFileResult struct {
+	Name string
+	// Checksums holds one checksum per directory, empty where the file is
+	// missing.
+	Checksums []string
+}
+
+// CompareMany compares more than two directories by comparing the first with
+// each of the others, each pair with opts and its own output directory under
+// opts.OutputDir. A diff.csv in opts.OutputDir then lists the files whose
+// checksums do not all agree, with a checksum column per directory.
+func CompareMany(dirs []string, opts Options) (MultiResult, error) {
+	return CompareManyContext(context.Background(), dirs, opts)
+}
+
+// CompareManyContext is CompareMany stopping as soon as ctx is done.
+func CompareManyContext(ctx context.Context, dirs []string, opts Options) (MultiResult, error) {
+	c := opts.newComparison()
+	result := MultiResult{Dirs: dirs, OutputDir: opts.OutputDir}
+	if len(dirs) < 3 {
+		return result, fmt.Errorf("comparing several directories needs at least three, got %d", len(dirs))
+	}
+	if opts.FailFast || opts.StructureOnly || opts.DetectRenames || opts.Semver {
+		return result, fmt.Errorf("more than two directories cannot be compared with -fail-fast, -structure-only, -detect-renames or -semver")
+	}
+
+	for _, dir := range dirs[1:] {
+		if c.isFilePair(dirs[0], dir) {
+			return result, fmt.Errorf("more than two files cannot be compared, only directories")
+		}
+	}
+
+	pairDirs := make(map[string]bool)
+	for _, dir := range dirs[1:] {
+		pairOpts := opts
+		if opts.OutputDir != "" {
+			name := DefaultOutputDir(dirs[0], dir)
+			for i := 2; pairDirs[name]; i++ {
+				name = fmt.Sprintf("%s-%d", DefaultOutputDir(dirs[0], dir), i)
+			}
+			pairDirs[name] = true
+			pairOpts.OutputDir = filepath.Join(opts.OutputDir, name)
+		}
+
+		pair, err := CompareContext(ctx, dirs[0], dir, pairOpts)
+		result.Pairs = append(result.Pairs, pair)
+		if err != nil {
+			return result, fmt.Errorf("comparing %s and %s: %v", dirs[0], dir, err)
+		}
+	}
+
+	result.Files = c.combineResults(result.Pairs)
+	if opts.OutputDir != "" && !opts.NoCombinedCSV {
+		if err := c.writeMultiCSV(opts.OutputDir, result); err != nil {
+			return result, fmt.Errorf("generating combined CSV: %v", err)
+		}
+		c.logf("# Combined CSV of %d directories generated at %s\n", len(dirs), filepath.Join(opts.OutputDir, "diff.csv"))
+	}
+
+	return result, nil
+}
+
+// combineResults rebuilds the checksums of every directory from the pairs,
+// which only list their differing files: a file missing from a pair is
+// identical to the first directory's copy, or missing from both.
+func (c *comparison) combineResults(pairs []Result) []MultiFileResult {
+	listed := make([]map[string]FileResult, len(pairs))
+	first := make(map[string]string)
+	for i, pair := range pairs {
+		listed[i] = make(map[string]FileResult)
+		for _, file := range pair.Files {
+			listed[i][file.Name] = file
+			if file.Checksum1 != "" {
+				first[file.Name] = file.Checksum1
+			} else if _, ok := first[file.Name]; !ok {
+				first[file.Name] = ""
+			}
+		}
+	}
+
+	names := make([]string, 0, len(first))
+	for name := range first {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		return c.fileNameLess(names[i], names[j])
+	})
+
+	var files []MultiFileResult
+	for _, name := range names {
+		checksums := []string{first[name]}
+		agree := true
+		for i := range pairs {
+			checksum := first[name]
+			if file, ok := listed[i][name]; ok {
+				checksum = file.Checksum2
+			}
+			agree = agree && checksum == first[name]
+			checksums = append(checksums, checksum)
+		}
+		// Files only listed for their permissions have the same content
+		if !agree {
+			files = append(files, MultiFileResult{Name: name, Checksums: checksums})
+		}
+	}
+	return files
+}
+
+// writeMultiCSV writes the combined diff.csv of result into outputDir.
+func (c *comparison) writeMultiCSV(outputDir string, result MultiResult) error {
+	headers := []string{"File Name", "Checksum " + result.Pairs[0].Dir1}
+	for _, pair := range result.Pairs {
+		headers = append(headers, "Checksum "+pair.Dir2)
+	}
+
+	records := make([][]string, 0, len(result.Files))
+	for _, file := range result.Files {
+		records = append(records, append([]string{file.Name}, file.Checksums...))
+	}
+
+	if err := os.MkdirAll(outputDir, 0755); err != nil {
+		return err
+	}
+	return c.writeCombinedCSV(outputDir, headers, records)
+}
+
+// DefaultMultiOutputDir is the output directory the command line uses for a
+// comparison of more than two directories, named after all of them.
+func DefaultMultiOutputDir(dirs []string) string {
+	names := make([]string, len(dirs))
+	for i, dir := range dirs {
+		names[i] = inputName(dir)
+	}
+	return strings.Join(names, "-")
+}
@@ -0,0 +1,21 @@
+package compare
+
+// fileStatuses are the statuses of the rows of diff.csv, as accepted by
+// -only.
+var fileStatuses = map[string]bool{
+	"added":    true,
+	"removed":  true,
+	"modified": true,
+	"mode":     true,
+	"renamed":  true,
+}
+
+// keptByOnly reports whether -only keeps a row of diff.csv, counting the rows
+// it leaves out, which get neither a row nor a copy or .diff.
+func (c *comparison) keptByOnly(record []string) bool {
+	if c.onlyStatuses == nil || c.onlyStatuses[c.recordStatus(record)] {
+		return true
+	}
+	c.leftOutCount++
+	return false
+}
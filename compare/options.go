@@ -0,0 +1,461 @@
+package compare
+
+import (
+	"crypto/md5"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Options configures a comparison. Each field corresponds to the command line
+// flag named in its comment; DefaultOptions returns the command line
+// defaults.
+type Options struct {
+	// OutputDir receives the checksum CSVs, diff.csv and the diffs. When it
+	// is empty a temporary directory is used and removed once Compare
+	// returns, leaving only the Result.
+	OutputDir string
+	// Output receives the human-readable report. Nil discards it.
+	Output io.Writer
+	// Progress receives a percentage of the files hashed and compared, one
+	// line per step rewritten in place, as printed by -progress. Nil prints
+	// none.
+	Progress io.Writer
+	// Events receives a JSON object per line for every file hashed and every
+	// row of diff.csv as it is handled, as printed by -format ndjson. Nil
+	// writes none.
+	Events io.Writer
+	// Diagnostics receives the lines of Verbosity, which the command line
+	// prints to stderr. Nil writes them to Output.
+	Diagnostics io.Writer
+	// OnFile is called with every FileResult of Result.Files as soon as its
+	// copy or .diff is written, to act on files while the comparison runs.
+	// Calls come one at a time from the goroutine running the comparison, in
+	// the order of diff.csv, even with several Workers diffing ahead, and
+	// the comparison waits for each to return. Nil calls nothing.
+	OnFile func(FileResult)
+
+	LineLimit      int    // -lines
+	SizeLimit      int    // -size, in MB
+	UseCache       bool   // -use-cache
+	KeepChecksums  bool   // -keep-checksums
+	ChunkHash      int    // -chunk-hash, in MB
+	QuickHash      bool   // -quick-hash
+	ConfirmQuick   bool   // -quick-hash-confirm
+	MmapThreshold  int    // -mmap-threshold, in MB, 0 to never map files
+	BufferSize     int    // -buffer-size, in KB
+	Hash           string // -hash
+	Workers        int    // -workers
+	Retries        int    // -retries
+	Recursive      bool   // -recursive
+	MaxDepth       int    // -max-depth, -1 for no limit
+	FollowSymlinks bool   // -follow-symlinks
+	UseGitignore   bool   // -use-gitignore
+
+	Columns        []string    // -columns
+	CheckPerms     bool        // -check-mode, or its older name -check-perms
+	CheckOwner     bool        // -check-owner
+	IgnoreModeBits os.FileMode // -ignore-mode-bits
+	Delimiter      rune        // -delimiter
+
+	// Files limits the comparison to these paths relative to both inputs
+	// when it is not nil, even if it is empty.
+	Files []string // -files-from
+
+	Exclude            []string // -exclude
+	Include            []string // -include
+	Ext                []string // -ext, with or without the leading dot
+	SkipExt            []string // -skip-ext, with or without the leading dot
+	Only               []string // -only, the statuses of the rows to keep
+	Unordered          []string // -unordered
+	IgnoreHeadBytes    int64    // -ignore-head-bytes
+	IgnoreTailBytes    int64    // -ignore-tail-bytes
+	IgnoreEOL          bool     // -ignore-eol
+	IgnoreFinalNewline bool     // -ignore-final-newline
+	Decompress         bool     // -decompress
+	IgnoreWhitespace   bool     // -ignore-whitespace
+	IgnoreBlankLines   bool     // -ignore-blank-lines
+	CommentPrefix      string   // -comment-prefix
+
+	DetectTruncation  bool   // -detect-truncation
+	DetectRenames     bool   // -detect-renames
+	Semver            bool   // -semver
+	IgnoreCase        bool   // -ignore-case
+	SkipSizeMismatch  bool   // -skip-size-mismatch
+	SkipExistingDiffs bool   // -skip-existing-diffs
+	NoClobber         bool   // -no-clobber
+	DiffTool          string // -diff-tool
+	Context           int    // -context
+	BinaryMode        string // -binary-mode
+	FullLarge         bool   // -full-large
+	MaxDiffBytes      int64  // -max-diff-bytes, 0 for no limit
+
+	StructureOnly   bool // -structure-only
+	FailFast        bool // -fail-fast
+	LowMemory       bool // -low-memory
+	ContinueOnError bool // -continue-on-error
+	DryRun          bool // -dry-run
+	NoCombinedCSV   bool // -no-combined-csv
+	ShowIdentical   bool // -show-identical
+	Stats           bool // -stats
+
+	SimilarityThreshold float64 // -similarity-threshold, 0 to not measure
+
+	SignatureCmd   string // -signature-cmd
+	Manifest       string // -manifest
+	MtimeTiebreak  bool   // -compare-mtime-as-tiebreak
+	DedupStats     bool   // -dedup-stats
+	ResultsDB      string // -results-db
+	EmitSync       string // -emit-sync
+	Digest         bool   // -digest
+	TreeHash       bool   // -tree-hash
+	HTMLReport     bool   // -format html
+	MarkdownReport bool   // -format markdown
+	Archive        string // -archive, zip or tar.gz
+	ArchiveCSVs    bool   // -archive-csvs
+
+	PruneEmptyDirs    bool   // -prune-empty-dirs
+	CollapseAddedDirs bool   // -collapse-added-dirs
+	CaseCollisions    string // -case-collisions
+	Sort              string // -sort
+
+	ProgressSocket string // -progress-socket
+	Quiet          bool   // -quiet
+	Color          bool   // -color, resolved to whether to color
+	Verbosity      int    // -v, -vv or -vvv, from 0 to 3
+}
+
+// DefaultOptions returns the options of a plain command line run.
+func DefaultOptions() Options {
+	return Options{
+		LineLimit:      50,
+		SizeLimit:      100,
+		MmapThreshold:  64,
+		BufferSize:     32,
+		Hash:           "md5",
+		Workers:        runtime.GOMAXPROCS(0),
+		PruneEmptyDirs: true,
+		KeepChecksums:  true,
+		CaseCollisions: "suffix",
+		Sort:           "name",
+		Context:        3,
+		MaxDepth:       -1,
+		Delimiter:      ',',
+		BinaryMode:     "note",
+	}
+}
+
+// HashAlgorithms returns the names accepted by Options.Hash.
+func HashAlgorithms() []string {
+	return sortedKeys(hashNames())
+}
+
+// optionSet reports whether each option named in incompatibleOptions is set.
+var optionSet = map[string]func(Options) bool{
+	"-chunk-hash":                func(o Options) bool { return o.ChunkHash > 0 },
+	"-compare-mtime-as-tiebreak": func(o Options) bool { return o.MtimeTiebreak },
+	"-dedup-stats":               func(o Options) bool { return o.DedupStats },
+	"-detect-renames":            func(o Options) bool { return o.DetectRenames },
+	"-digest":                    func(o Options) bool { return o.Digest },
+	"-emit-sync":                 func(o Options) bool { return o.EmitSync != "" },
+	"-fail-fast":                 func(o Options) bool { return o.FailFast },
+	"-ignore-case":               func(o Options) bool { return o.IgnoreCase },
+	"-ignore-eol":                func(o Options) bool { return o.IgnoreEOL },
+	"-ignore-final-newline":      func(o Options) bool { return o.IgnoreFinalNewline },
+	"-low-memory":                func(o Options) bool { return o.LowMemory },
+	"-manifest":                  func(o Options) bool { return o.Manifest != "" },
+	"-no-combined-csv":           func(o Options) bool { return o.NoCombinedCSV },
+	"-quick-hash":                func(o Options) bool { return o.QuickHash },
+	"-quick-hash-confirm":        func(o Options) bool { return o.ConfirmQuick },
+	"-results-db":                func(o Options) bool { return o.ResultsDB != "" },
+	"-semver":                    func(o Options) bool { return o.Semver },
+	"-signature-cmd":             func(o Options) bool { return o.SignatureCmd != "" },
+	"-skip-size-mismatch":        func(o Options) bool { return o.SkipSizeMismatch },
+	"-structure-only":            func(o Options) bool { return o.StructureOnly },
+	"-tree-hash":                 func(o Options) bool { return o.TreeHash },
+	"-unordered":                 func(o Options) bool { return len(o.Unordered) > 0 },
+}
+
+// incompatibleOptions lists the options that cannot be combined with the
+// options following them.
+var incompatibleOptions = []struct {
+	option string
+	with   []string
+}{
+	{"-low-memory", []string{"-compare-mtime-as-tiebreak", "-dedup-stats", "-detect-renames", "-digest", "-fail-fast", "-manifest",
+		"-no-combined-csv", "-results-db", "-signature-cmd", "-skip-size-mismatch", "-tree-hash"}},
+	{"-quick-hash", []string{"-chunk-hash", "-ignore-eol", "-ignore-final-newline", "-unordered"}},
+	{"-quick-hash-confirm", []string{"-fail-fast", "-ignore-case", "-low-memory", "-semver"}},
+	{"-ignore-case", []string{"-emit-sync", "-fail-fast", "-low-memory", "-semver"}},
+	{"-semver", []string{"-emit-sync", "-fail-fast", "-low-memory"}},
+}
+
+// firstSet returns the first of options that o sets, or "" for none.
+func (o Options) firstSet(options []string) string {
+	for _, name := range options {
+		if optionSet[name](o) {
+			return name
+		}
+	}
+	return ""
+}
+
+// Validate reports the first invalid value or combination of options.
+func (o Options) Validate() error {
+	if o.ChunkHash < 0 {
+		return fmt.Errorf("-chunk-hash must not be negative")
+	}
+	if o.SimilarityThreshold < 0 || o.SimilarityThreshold > 1 {
+		return fmt.Errorf("-similarity-threshold must be between 0 and 1")
+	}
+	if o.BufferSize < 4 || o.BufferSize > 1024*1024 {
+		return fmt.Errorf("-buffer-size must be between 4 and 1048576 KB")
+	}
+	if o.MmapThreshold < 0 {
+		return fmt.Errorf("-mmap-threshold must not be negative")
+	}
+	if o.Verbosity < 0 || o.Verbosity > verboseDetails {
+		return fmt.Errorf("verbosity must be between 0 and 3")
+	}
+	if o.Retries < 0 {
+		return fmt.Errorf("-retries must not be negative")
+	}
+	if o.Workers < 1 {
+		return fmt.Errorf("-workers must be at least 1")
+	}
+	if _, ok := hashAlgorithms[o.Hash]; !ok {
+		return fmt.Errorf("unknown -hash %q, expected one of %s", o.Hash, strings.Join(HashAlgorithms(), ", "))
+	}
+	for _, ext := range append(append([]string{}, o.Ext...), o.SkipExt...) {
+		if strings.Trim(ext, ".") == "" || strings.ContainsAny(ext, `/\`) {
+			return fmt.Errorf("invalid extension %q for -ext or -skip-ext", ext)
+		}
+	}
+	if o.MaxDepth < -1 {
+		return fmt.Errorf("-max-depth must be -1 (no limit) or more")
+	}
+	if o.MaxDepth >= 0 && !o.Recursive {
+		return fmt.Errorf("-max-depth requires -recursive")
+	}
+	if o.MaxDiffBytes < 0 {
+		return fmt.Errorf("-max-diff-bytes must not be negative")
+	}
+	if o.Context < 0 {
+		return fmt.Errorf("-context must not be negative")
+	}
+	if o.IgnoreHeadBytes < 0 || o.IgnoreTailBytes < 0 {
+		return fmt.Errorf("-ignore-head-bytes and -ignore-tail-bytes must not be negative")
+	}
+	for _, status := range o.Only {
+		if !fileStatuses[status] {
+			return fmt.Errorf("unknown -only status %q, expected %s", status, strings.Join(sortedKeys(fileStatuses), ", "))
+		}
+	}
+	for _, column := range o.Columns {
+		if !optionalColumns[column] {
+			return fmt.Errorf("unknown column %q", column)
+		}
+	}
+	if o.Delimiter != '\t' && (unicode.IsControl(o.Delimiter) || o.Delimiter == '"' || o.Delimiter == utf8.RuneError) {
+		return fmt.Errorf("invalid -delimiter %q, expected a printable character other than a double quote, or a tab", o.Delimiter)
+	}
+	if o.IgnoreModeBits&^os.ModePerm != 0 {
+		return fmt.Errorf("invalid -ignore-mode-bits %#o, expected an octal mask such as 0111", o.IgnoreModeBits)
+	}
+
+	if o.ConfirmQuick && !o.QuickHash {
+		return fmt.Errorf("-quick-hash-confirm requires -quick-hash")
+	}
+	for _, rule := range incompatibleOptions {
+		if !optionSet[rule.option](o) {
+			continue
+		}
+		if name := o.firstSet(rule.with); name != "" {
+			return fmt.Errorf("%s cannot be combined with %s", rule.option, name)
+		}
+	}
+
+	if _, ok := archiveFormats[o.Archive]; !ok && o.Archive != "" {
+		return fmt.Errorf("unknown -archive %q, expected zip or tar.gz", o.Archive)
+	}
+	if o.Archive != "" && (o.FailFast || o.StructureOnly || o.DryRun) {
+		return fmt.Errorf("-archive cannot be combined with -fail-fast, -structure-only or -dry-run")
+	}
+	if o.TreeHash && (o.FailFast || o.StructureOnly) {
+		return fmt.Errorf("-tree-hash cannot be combined with -fail-fast or -structure-only")
+	}
+	if o.ArchiveCSVs && o.Archive == "" {
+		return fmt.Errorf("-archive-csvs requires -archive")
+	}
+
+	if o.HTMLReport && (o.FailFast || o.StructureOnly) {
+		return fmt.Errorf("-format html cannot be combined with -fail-fast or -structure-only")
+	}
+
+	if o.MarkdownReport && (o.FailFast || o.StructureOnly) {
+		return fmt.Errorf("-format markdown cannot be combined with -fail-fast or -structure-only")
+	}
+
+	for _, name := range o.Files {
+		if !filepath.IsLocal(name) {
+			return fmt.Errorf("-files-from path %q is not relative to the inputs", name)
+		}
+	}
+
+	patterns := map[string][]string{"-unordered": o.Unordered, "-exclude": o.Exclude, "-include": o.Include}
+	for _, name := range []string{"-unordered", "-exclude", "-include"} {
+		for _, pattern := range patterns[name] {
+			if _, err := filepath.Match(pattern, ""); err != nil {
+				return fmt.Errorf("invalid %s pattern %q: %v", name, pattern, err)
+			}
+		}
+	}
+
+	if o.CaseCollisions != "suffix" && o.CaseCollisions != "overwrite" {
+		return fmt.Errorf("unknown -case-collisions %q, expected suffix or overwrite", o.CaseCollisions)
+	}
+	if o.BinaryMode != "skip" && o.BinaryMode != "note" && o.BinaryMode != "hexdump" {
+		return fmt.Errorf("unknown -binary-mode %q, expected skip, note or hexdump", o.BinaryMode)
+	}
+	if o.Sort != "name" && o.Sort != "dir-then-name" {
+		return fmt.Errorf("unknown -sort %q, expected name or dir-then-name", o.Sort)
+	}
+
+	return nil
+}
+
+// newComparison sets up the state of a run with o.
+func (o Options) newComparison() *comparison {
+	c := &comparison{}
+	c.output = o.Output
+	if c.output == nil {
+		c.output = io.Discard
+	}
+
+	c.verbosity = o.Verbosity
+	c.diagnostics = o.Diagnostics
+	if c.diagnostics == nil {
+		c.diagnostics = c.output
+	}
+	c.chunkHashSize = int64(o.ChunkHash) * 1024 * 1024
+	c.quickHash = o.QuickHash
+	c.confirmQuick = o.ConfirmQuick
+	c.mmapThreshold = int64(o.MmapThreshold) * 1024 * 1024
+	c.hashBufferSize = int64(o.BufferSize) * 1024
+	c.retries = o.Retries
+	c.newHash = hashAlgorithms[o.Hash]
+	if c.newHash == nil {
+		c.newHash = md5.New
+	}
+	c.workers = o.Workers
+	c.useCache = o.UseCache
+	c.sizeLimit, c.lineLimit = o.SizeLimit, o.LineLimit
+	c.emitSync, c.signatureCmd, c.manifestPath = o.EmitSync, o.SignatureCmd, o.Manifest
+	c.dedupStats, c.mtimeTiebreak = o.DedupStats, o.MtimeTiebreak
+	c.chunkSlots = make(chan struct{}, c.workers)
+	c.recursive = o.Recursive
+	c.maxDepth = o.MaxDepth
+	c.followSymlinks = o.FollowSymlinks
+	c.useGitignore = o.UseGitignore
+
+	c.extraColumns = append([]string(nil), o.Columns...)
+	c.checkPerms = o.CheckPerms
+	if c.checkPerms && !c.hasColumn("mode") {
+		c.extraColumns = append(c.extraColumns, "mode")
+	}
+	c.checkOwner = o.CheckOwner
+	if c.checkOwner && !c.hasColumn("owner") {
+		c.extraColumns = append(c.extraColumns, "owner")
+	}
+	c.ignoreModeBits = o.IgnoreModeBits
+	c.csvDelimiter = o.Delimiter
+
+	if o.Files != nil {
+		c.fileList = uniqueCleanPaths(o.Files)
+	}
+	c.excludes = o.Exclude
+	c.includes = o.Include
+	c.extensions = normalizeExtensions(o.Ext)
+	c.skipExtensions = normalizeExtensions(o.SkipExt)
+	c.unordered = o.Unordered
+	c.ignoreHead = o.IgnoreHeadBytes
+	c.ignoreTail = o.IgnoreTailBytes
+	c.ignoreEOL = o.IgnoreEOL
+	c.ignoreFinalNewline = o.IgnoreFinalNewline
+	c.decompress = o.Decompress
+	c.decompressed = map[string]string{}
+	c.extracted = map[string]string{}
+	c.listedInfos = map[string]os.FileInfo{}
+	c.ignoreWhitespace = o.IgnoreWhitespace
+	c.ignoreBlankLines = o.IgnoreBlankLines
+	c.commentPrefix = []byte(o.CommentPrefix)
+
+	c.detectTruncate = o.DetectTruncation
+	c.detectRenames = o.DetectRenames
+	c.semverMode = o.Semver
+	c.ignoreCase = o.IgnoreCase
+	c.skipSizeMismatch = o.SkipSizeMismatch
+	c.skipExisting = o.SkipExistingDiffs
+	c.noClobber = o.NoClobber
+	c.diffTool = o.DiffTool
+	c.diffContext = o.Context
+	c.binaryMode = o.BinaryMode
+	c.fullLarge = o.FullLarge
+	c.maxDiffBytes = o.MaxDiffBytes
+	c.truncatedDiffs = make(map[string]bool)
+
+	c.structureOnly = o.StructureOnly
+	c.failFast = o.FailFast
+	c.lowMemory = o.LowMemory
+	c.continueOnError = o.ContinueOnError
+	c.dryRun = o.DryRun
+	c.noCombinedCSV = o.NoCombinedCSV
+	c.showIdentical = o.ShowIdentical
+	c.showStats = o.Stats
+	if len(o.Only) > 0 {
+		c.onlyStatuses = make(map[string]bool)
+		for _, status := range o.Only {
+			c.onlyStatuses[status] = true
+		}
+	}
+	c.similarityThreshold = o.SimilarityThreshold
+	c.similarities = make(map[string]float64)
+	c.resultsDB = o.ResultsDB
+	c.printDigest = o.Digest
+	c.printTreeHashes = o.TreeHash
+
+	c.pruneEmpty = o.PruneEmptyDirs
+	c.collapseDirs = o.CollapseAddedDirs
+	c.caseCollisions = o.CaseCollisions
+	c.sortOrder = o.Sort
+	c.quiet = o.Quiet
+	c.colorOutput = o.Color
+
+	if o.Progress != nil {
+		c.meter = &progressMeter{w: o.Progress}
+	}
+	c.onFile = o.OnFile
+	if o.Events != nil {
+		c.events = &eventWriter{w: o.Events}
+	}
+
+	c.dir2Aliases = map[string]string{}
+	c.renamedFrom = map[string]string{}
+	c.skippedFiles = map[string]bool{}
+	return c
+}
+
+// normalizeExtensions lowers exts and drops their leading dot, as hasExtension
+// expects them.
+func normalizeExtensions(exts []string) []string {
+	var normalized []string
+	for _, ext := range exts {
+		normalized = append(normalized, strings.ToLower(strings.TrimPrefix(ext, ".")))
+	}
+	return normalized
+}
@@ -0,0 +1,11 @@
+//go:build !unix
+
+package compare
+
+import "os"
+
+// fileOwner returns nothing where files have no uid and gid, such as on
+// Windows, so ownership never differs.
+func fileOwner(info os.FileInfo) string {
+	return ""
+}
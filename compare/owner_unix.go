@@ -0,0 +1,18 @@
+//go:build unix
+
+package compare
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// fileOwner returns the uid:gid owning the file described by info.
+func fileOwner(info os.FileInfo) string {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return ""
+	}
+	return fmt.Sprintf("%d:%d", stat.Uid, stat.Gid)
+}
@@ -0,0 +1,131 @@
+package compare
+
+import (
+	"encoding/json"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// progressEvent is the state sent to -progress-socket clients, one JSON
+// object per line, whenever it changes.
+type progressEvent struct {
+	Phase       string `json:"phase"`
+	File        string `json:"file,omitempty"`
+	FilesHashed int    `json:"filesHashed"`
+	Differences int    `json:"differences"`
+}
+
+// progressServer broadcasts progress events to every connected client. A nil
+// server ignores all updates, so callers never have to check for one.
+type progressServer struct {
+	listener net.Listener
+	path     string
+
+	mu      sync.Mutex
+	clients []net.Conn
+	state   progressEvent
+}
+
+// startProgressServer listens on a Unix domain socket at path, replacing a
+// stale socket left behind by an earlier run.
+func startProgressServer(path string) (*progressServer, error) {
+	if info, err := os.Stat(path); err == nil && info.Mode()&os.ModeSocket != 0 {
+		os.Remove(path)
+	}
+
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &progressServer{listener: listener, path: path}
+	go p.accept()
+
+	return p, nil
+}
+
+func (p *progressServer) accept() {
+	for {
+		conn, err := p.listener.Accept()
+		if err != nil {
+			return
+		}
+
+		p.mu.Lock()
+		p.clients = append(p.clients, conn)
+		p.send(conn)
+		p.mu.Unlock()
+	}
+}
+
+// send writes the current state to one client and reports whether it is
+// still connected. Slow clients are dropped rather than stalling the run.
+func (p *progressServer) send(conn net.Conn) bool {
+	data, err := json.Marshal(p.state)
+	if err != nil {
+		return false
+	}
+	conn.SetWriteDeadline(time.Now().Add(time.Second))
+	if _, err := conn.Write(append(data, '\n')); err != nil {
+		conn.Close()
+		return false
+	}
+	return true
+}
+
+func (p *progressServer) update(change func(*progressEvent)) {
+	if p == nil {
+		return
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	change(&p.state)
+	clients := p.clients[:0]
+	for _, conn := range p.clients {
+		if p.send(conn) {
+			clients = append(clients, conn)
+		}
+	}
+	p.clients = clients
+}
+
+func (p *progressServer) phase(phase string) {
+	p.update(func(e *progressEvent) {
+		e.Phase = phase
+		e.File = ""
+	})
+}
+
+func (p *progressServer) fileHashed(filePath string) {
+	p.update(func(e *progressEvent) {
+		e.File = filePath
+		e.FilesHashed++
+	})
+}
+
+func (p *progressServer) difference(fileName string) {
+	p.update(func(e *progressEvent) {
+		e.File = fileName
+		e.Differences++
+	})
+}
+
+// close disconnects all clients and removes the socket file.
+func (p *progressServer) close() {
+	if p == nil {
+		return
+	}
+
+	p.listener.Close()
+	p.mu.Lock()
+	for _, conn := range p.clients {
+		conn.Close()
+	}
+	p.clients = nil
+	p.mu.Unlock()
+	os.Remove(p.path)
+}
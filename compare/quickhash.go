@@ -0,0 +1,105 @@
+package compare
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// quickHashSpan is the number of bytes -quick-hash reads at each end of a
+// file.
+const quickHashSpan = 64 * 1024
+
+// quickPrefix labels the checksums of -quick-hash in the CSVs, so they are
+// never taken for full checksums.
+const quickPrefix = "quick:"
+
+// quickChecksum hashes the size of the length bytes of file from start and
+// their first and last quickHashSpan bytes, all of them when there are fewer.
+func (c *comparison) quickChecksum(file *os.File, start, length int64) (string, error) {
+	hash := c.newHash()
+	binary.Write(hash, binary.BigEndian, length)
+	if length <= 2*quickHashSpan {
+		if err := c.copyHashed(hash, io.NewSectionReader(file, start, length), length); err != nil {
+			return "", err
+		}
+	} else {
+		if _, err := io.Copy(hash, io.NewSectionReader(file, start, quickHashSpan)); err != nil {
+			return "", err
+		}
+		if _, err := io.Copy(hash, io.NewSectionReader(file, start+length-quickHashSpan, quickHashSpan)); err != nil {
+			return "", err
+		}
+	}
+	return quickPrefix + hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// streamQuickChecksum is quickChecksum for the length bytes of content, which
+// can only be read in order and is read through to its last bytes.
+func (c *comparison) streamQuickChecksum(content io.Reader, length int64) (string, error) {
+	hash := c.newHash()
+	binary.Write(hash, binary.BigEndian, length)
+	if length <= 2*quickHashSpan {
+		if err := c.copyHashed(hash, content, length); err != nil {
+			return "", err
+		}
+	} else {
+		if _, err := io.CopyN(hash, content, quickHashSpan); err != nil {
+			return "", err
+		}
+		if _, err := io.CopyN(io.Discard, content, length-2*quickHashSpan); err != nil {
+			return "", err
+		}
+		if _, err := io.CopyN(hash, content, quickHashSpan); err != nil {
+			return "", err
+		}
+	}
+	return quickPrefix + hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// confirmQuickMatches hashes in full the files of both sides whose quick
+// checksums match, and replaces both quick checksums by the full ones when
+// those differ, so the pair is reported modified. Pairs whose quick
+// checksums differ are known to differ and are not read again.
+func (c *comparison) confirmQuickMatches(dir1, dir2 string, checksums1, checksums2 map[string]fileEntry) error {
+	confirmed, differed := 0, 0
+	for _, name := range c.allFileNames(checksums1, checksums2) {
+		entry1, ok1 := checksums1[name]
+		entry2, ok2 := checksums2[name]
+		if !ok1 || !ok2 || entry1.checksum != entry2.checksum || !strings.HasPrefix(entry1.checksum, quickPrefix) {
+			continue
+		}
+		checksum1, checksum2, err := c.fullChecksums(filepath.Join(dir1, name), filepath.Join(dir2, name))
+		if err != nil {
+			return err
+		}
+		confirmed++
+		if checksum1 != checksum2 {
+			differed++
+			entry1.checksum, entry2.checksum = checksum1, checksum2
+			checksums1[name], checksums2[name] = entry1, entry2
+		}
+	}
+	if confirmed > 0 {
+		c.logf("# %d quick hash matches confirmed with a full hash, %d of them differ\n", confirmed, differed)
+	}
+	return nil
+}
+
+// fullChecksums returns the full checksums of file1 and file2 whatever
+// -quick-hash.
+func (c *comparison) fullChecksums(file1, file2 string) (string, string, error) {
+	checksum1, err := c.checksumFile(file1, false)
+	if err != nil {
+		return "", "", fmt.Errorf("checksum of %s: %v", file1, err)
+	}
+	checksum2, err := c.checksumFile(file2, false)
+	if err != nil {
+		return "", "", fmt.Errorf("checksum of %s: %v", file2, err)
+	}
+	return checksum1, checksum2, nil
+}
@@ -0,0 +1,38 @@
+package compare
+
+// detectRenamedFiles pairs files present only in dir1 with files present
+// only in dir2 that have the same checksum and records them in renamedFrom.
+// When several files share a checksum they are paired in name order. Empty
+// files are never paired, since any two of them match.
+func (c *comparison) detectRenamedFiles(checksums1, checksums2 map[string]fileEntry) {
+	removed := make(map[string][]string)
+	for fileName, entry := range checksums1 {
+		if _, ok := checksums2[fileName]; !ok && entry.size > 0 {
+			removed[entry.checksum] = append(removed[entry.checksum], fileName)
+		}
+	}
+	added := make(map[string][]string)
+	for fileName, entry := range checksums2 {
+		if _, ok := checksums1[fileName]; !ok && entry.size > 0 {
+			added[entry.checksum] = append(added[entry.checksum], fileName)
+		}
+	}
+
+	for checksum, oldNames := range removed {
+		newNames := added[checksum]
+		c.sortFileNames(oldNames)
+		c.sortFileNames(newNames)
+		for i := 0; i < len(oldNames) && i < len(newNames); i++ {
+			c.renamedFrom[newNames[i]] = oldNames[i]
+		}
+	}
+}
+
+// renamedOldNames returns the dir1 names of the files in renamedFrom.
+func (c *comparison) renamedOldNames() map[string]bool {
+	oldNames := make(map[string]bool)
+	for _, oldName := range c.renamedFrom {
+		oldNames[oldName] = true
+	}
+	return oldNames
+}
@@ -0,0 +1,117 @@
+package compare
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const resultsSchema = `CREATE TABLE IF NOT EXISTS results (
+	run_id TEXT NOT NULL,
+	run_at TEXT NOT NULL,
+	dir1 TEXT NOT NULL,
+	dir2 TEXT NOT NULL,
+	file TEXT NOT NULL,
+	status TEXT NOT NULL,
+	checksum1 TEXT,
+	checksum2 TEXT,
+	size1 INTEGER,
+	size2 INTEGER,
+	mtime1 TEXT,
+	mtime2 TEXT,
+	similarity REAL
+);
+CREATE INDEX IF NOT EXISTS results_file ON results (file);
+CREATE INDEX IF NOT EXISTS results_run ON results (run_id);
+`
+
+// writeResultsDB appends one row per file, identical files included, to the
+// results table of dbFile, creating the schema on first use. All rows of a
+// run share a run ID and timestamp so historical runs can be queried apart.
+// The database is written through the sqlite3 command line tool.
+func (c *comparison) writeResultsDB(checksums1, checksums2 map[string]fileEntry, dir1, dir2, dbFile string) error {
+	runID, err := newRunID()
+	if err != nil {
+		return err
+	}
+	runAt := time.Now().UTC().Format(time.RFC3339)
+
+	c.verboseCommand("sqlite3", dbFile)
+	cmd := exec.Command("sqlite3", dbFile)
+	cmd.Stdout = c.output
+	cmd.Stderr = c.output
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("starting sqlite3: %v", err)
+	}
+
+	w := bufio.NewWriter(stdin)
+	fmt.Fprint(w, resultsSchema)
+	fmt.Fprintln(w, "BEGIN;")
+	for _, fileName := range c.allFileNames(checksums1, checksums2) {
+		entry1 := checksums1[fileName]
+		entry2 := checksums2[fileName]
+		values := []string{
+			sqlText(runID), sqlText(runAt), sqlText(dir1), sqlText(dir2), sqlText(fileName),
+			sqlText(c.comparisonStatus(entry1, entry2)),
+			sqlNullable(entry1.checksum, entry1.checksum), sqlNullable(entry2.checksum, entry2.checksum),
+			sqlNullable(entry1.checksum, strconv.FormatInt(entry1.size, 10)), sqlNullable(entry2.checksum, strconv.FormatInt(entry2.size, 10)),
+			sqlNullable(entry1.checksum, formatModTime(entry1.modTime)), sqlNullable(entry2.checksum, formatModTime(entry2.modTime)),
+			c.sqlSimilarity(fileName),
+		}
+		fmt.Fprintf(w, "INSERT INTO results VALUES (%s);\n", strings.Join(values, ", "))
+	}
+	fmt.Fprintln(w, "COMMIT;")
+
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	stdin.Close()
+	if err := cmd.Wait(); err != nil {
+		return fmt.Errorf("sqlite3: %v", err)
+	}
+
+	c.logf("# Results stored in %s (run %s)\n", dbFile, runID)
+
+	return nil
+}
+
+// sqlSimilarity returns the similarity measured for fileName with
+// -similarity-threshold, or NULL.
+func (c *comparison) sqlSimilarity(fileName string) string {
+	similarity, ok := c.similarities[fileName]
+	if !ok {
+		return "NULL"
+	}
+	return formatSimilarity(similarity)
+}
+
+func newRunID() (string, error) {
+	random := make([]byte, 4)
+	if _, err := rand.Read(random); err != nil {
+		return "", err
+	}
+	return time.Now().UTC().Format("20060102T150405Z") + "-" + hex.EncodeToString(random), nil
+}
+
+func sqlText(value string) string {
+	return "'" + strings.ReplaceAll(value, "'", "''") + "'"
+}
+
+// sqlNullable quotes value, or returns NULL when the file is missing on that
+// side (its checksum is empty). Numbers are safe to quote: SQLite converts
+// them according to the column affinity.
+func sqlNullable(checksum, value string) string {
+	if checksum == "" || value == "" {
+		return "NULL"
+	}
+	return sqlText(value)
+}
@@ -0,0 +1,61 @@
+package compare
+
+import (
+	"errors"
+	"os"
+	"time"
+)
+
+// retryBackoff is the wait before the first retry, doubled before each
+// following one up to maxRetryBackoff.
+const (
+	retryBackoff    = 100 * time.Millisecond
+	maxRetryBackoff = 2 * time.Second
+)
+
+// isTransient reports whether err is worth retrying.
+func isTransient(err error) bool {
+	for _, transient := range transientErrors {
+		if errors.Is(err, transient) {
+			return true
+		}
+	}
+	return false
+}
+
+// retried calls fn until it succeeds, returns an error that is not
+// transient, or has been retried -retries times.
+func (c *comparison) retried(fn func() error) error {
+	backoff := retryBackoff
+	for attempt := 0; ; attempt++ {
+		err := fn()
+		if err == nil || attempt == c.retries || !isTransient(err) {
+			return err
+		}
+		c.retriedCount.Add(1)
+		time.Sleep(backoff)
+		backoff = min(2*backoff, maxRetryBackoff)
+	}
+}
+
+// openRetried is os.Open retrying transient errors.
+func (c *comparison) openRetried(path string) (file *os.File, err error) {
+	err = c.retried(func() error {
+		file, err = os.Open(path)
+		return err
+	})
+	return file, err
+}
+
+// statRetried is os.Stat retrying transient errors. The entries of a .zip
+// input are stated from its directory, read once.
+func (c *comparison) statRetried(path string) (info os.FileInfo, err error) {
+	if info, ok, err := c.statZipEntry(path); ok {
+		return info, err
+	}
+	err = c.retried(func() error {
+		info, err = os.Stat(path)
+		return err
+	})
+	return info, err
+}
@@ -0,0 +1,7 @@
+//go:build !unix
+
+package compare
+
+// transientErrors is empty where the errors of a remote mount are not those
+// of unix, such as on Windows, so nothing is retried.
+var transientErrors []error
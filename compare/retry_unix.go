@@ -0,0 +1,21 @@
+//go:build unix
+
+package compare
+
+import "syscall"
+
+// transientErrors are the errors a flaky NFS or SMB mount returns for a read
+// that succeeds when tried again. A missing file or a permission denied is
+// never among them.
+var transientErrors = []error{
+	syscall.EIO,
+	syscall.EAGAIN,
+	syscall.EINTR,
+	syscall.EBUSY,
+	syscall.ETIMEDOUT,
+	syscall.ESTALE,
+	syscall.ECONNRESET,
+	syscall.ECONNABORTED,
+	syscall.EHOSTUNREACH,
+	syscall.ENETUNREACH,
+}
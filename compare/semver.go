@@ -0,0 +1,178 @@
+package compare
+
+import (
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// versionPattern matches <name>-<version><ext> file names such as
+// app-1.10.0.jar or libfoo-v2.3-rc1.tar.gz: a dot-separated numeric version,
+// optionally prefixed with v and followed by a -prerelease tag, between the
+// artifact name and an extension made of letter-led components.
+var versionPattern = regexp.MustCompile(`^(.+?)-v?(\d+(?:\.\d+)*(?:-[0-9A-Za-z]+)?)((?:\.[A-Za-z][0-9A-Za-z]*)*)$`)
+
+// versionedName splits a file name into its artifact key (the name with the
+// version replaced by *) and its version.
+func versionedName(fileName string) (key, version string, ok bool) {
+	match := versionPattern.FindStringSubmatch(filepath.Base(fileName))
+	if match == nil {
+		return "", "", false
+	}
+	return filepath.Join(filepath.Dir(fileName), match[1]+"-*"+match[3]), match[2], true
+}
+
+// compareVersions orders two versions numerically component by component; a
+// prerelease sorts before the release it precedes.
+func compareVersions(a, b string) int {
+	coreA, preA, _ := strings.Cut(a, "-")
+	coreB, preB, _ := strings.Cut(b, "-")
+	partsA, partsB := strings.Split(coreA, "."), strings.Split(coreB, ".")
+	for i := 0; i < len(partsA) || i < len(partsB); i++ {
+		var numA, numB int
+		if i < len(partsA) {
+			numA, _ = strconv.Atoi(partsA[i])
+		}
+		if i < len(partsB) {
+			numB, _ = strconv.Atoi(partsB[i])
+		}
+		if numA != numB {
+			if numA < numB {
+				return -1
+			}
+			return 1
+		}
+	}
+	switch {
+	case preA == preB:
+		return 0
+	case preA == "":
+		return 1
+	case preB == "":
+		return -1
+	}
+	return strings.Compare(preA, preB)
+}
+
+// semverLess orders two versions of the same artifact by version, and
+// reports false for ok when a and b are not versions of the same artifact.
+func semverLess(a, b string) (less, ok bool) {
+	keyA, versionA, okA := versionedName(a)
+	keyB, versionB, okB := versionedName(b)
+	if !okA || !okB || keyA != keyB {
+		return false, false
+	}
+	return compareVersions(versionA, versionB) < 0, true
+}
+
+// versionChange describes an artifact that carries a different version in
+// dir1 and dir2.
+type versionChange struct {
+	key      string
+	version1 string
+	version2 string
+}
+
+// pairVersions returns checksums2 rekeyed so that an artifact found exactly
+// once on each side under different versions shares dir1's file name, and
+// records the dir2 names in dir2Aliases. Artifacts with several versions on
+// one side are left as they are, since there is no way to tell which
+// versions correspond.
+func (c *comparison) pairVersions(checksums1, checksums2 map[string]fileEntry) (map[string]fileEntry, []versionChange) {
+	byKey1 := versionsByKey(checksums1)
+	byKey2 := versionsByKey(checksums2)
+
+	paired := make(map[string]fileEntry, len(checksums2))
+	for fileName, entry := range checksums2 {
+		paired[fileName] = entry
+	}
+
+	var changes []versionChange
+	for key, names1 := range byKey1 {
+		names2 := byKey2[key]
+		if len(names1) != 1 || len(names2) != 1 || names1[0] == names2[0] {
+			continue
+		}
+		name1, name2 := names1[0], names2[0]
+		if _, exists := checksums2[name1]; exists {
+			continue
+		}
+		_, version1, _ := versionedName(name1)
+		_, version2, _ := versionedName(name2)
+
+		paired[name1] = paired[name2]
+		delete(paired, name2)
+		c.dir2Aliases[name1] = name2
+		changes = append(changes, versionChange{key: key, version1: version1, version2: version2})
+	}
+
+	sort.Slice(changes, func(i, j int) bool {
+		return changes[i].key < changes[j].key
+	})
+
+	return paired, changes
+}
+
+func versionsByKey(checksums map[string]fileEntry) map[string][]string {
+	byKey := make(map[string][]string)
+	for fileName := range checksums {
+		if key, _, ok := versionedName(fileName); ok {
+			byKey[key] = append(byKey[key], fileName)
+		}
+	}
+	return byKey
+}
+
+// dir2Name returns the name a diff.csv row has in dir2, which differs from
+// the row name for artifacts paired by -semver and names paired by
+// -ignore-case.
+func (c *comparison) dir2Name(fileName string) string {
+	if alias, ok := c.dir2Aliases[fileName]; ok {
+		return alias
+	}
+	return fileName
+}
+
+// reportVersionChanges prints each upgrade and downgrade and writes them to
+// versions.csv in outputDir.
+func (c *comparison) reportVersionChanges(changes []versionChange, dir1, dir2, outputDir string) error {
+	outputFile, err := os.Create(filepath.Join(outputDir, "versions.csv"))
+	if err != nil {
+		return err
+	}
+	defer outputFile.Close()
+
+	writer := c.newCSVWriter(outputFile)
+
+	err = writer.Write([]string{"Artifact", "Version " + dir1, "Version " + dir2, "Change"})
+	if err != nil {
+		return err
+	}
+
+	for _, change := range changes {
+		direction := "upgrade"
+		if compareVersions(change.version1, change.version2) > 0 {
+			direction = "downgrade"
+		}
+		c.itemf(" - %s: %s -> %s (%s)\n", change.key, change.version1, change.version2, direction)
+		err = writer.Write([]string{change.key, change.version1, change.version2, direction})
+		if err != nil {
+			return err
+		}
+	}
+
+	writer.Flush()
+	if err := writer.Error(); err != nil {
+		return err
+	}
+	if err := outputFile.Close(); err != nil {
+		return err
+	}
+
+	c.logf("# %d version changes found (%s)\n", len(changes), filepath.Join(outputDir, "versions.csv"))
+
+	return nil
+}
@@ -0,0 +1,126 @@
+package compare
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// externalHash runs command with filePath appended and returns the first
+// field of its output, so tools like `md5sum` or a perceptual hasher that
+// print "<hash> <file>" work unchanged.
+func (c *comparison) externalHash(command, filePath string) (string, error) {
+	fields := strings.Fields(command)
+	if len(fields) == 0 {
+		return "", fmt.Errorf("empty command")
+	}
+
+	args := append(fields[1:], filePath)
+	c.verboseCommand(append([]string{fields[0]}, args...)...)
+	output, err := exec.Command(fields[0], args...).Output()
+	if err != nil {
+		return "", fmt.Errorf("%s %s: %v", fields[0], filePath, err)
+	}
+
+	result := strings.Fields(string(output))
+	if len(result) == 0 {
+		return "", fmt.Errorf("%s %s: no output", fields[0], filePath)
+	}
+
+	return result[0], nil
+}
+
+// fileSignatures maps each signature to the sorted file names carrying it.
+func (c *comparison) fileSignatures(checksums map[string]fileEntry, dir, command string) (map[string][]string, error) {
+	signatures := make(map[string][]string)
+	for fileName := range checksums {
+		signature, err := c.externalHash(command, filepath.Join(dir, fileName))
+		if err != nil {
+			return nil, err
+		}
+		signatures[signature] = append(signatures[signature], fileName)
+	}
+	for _, names := range signatures {
+		sort.Strings(names)
+	}
+	return signatures, nil
+}
+
+// generateSignatureReport pairs files across both directories by the content
+// signature printed by command instead of by name. The signature decides
+// which files are "the same item", the checksum decides whether they are
+// byte-identical, so a re-encoded image shows up as changed rather than as a
+// removal plus an addition.
+func (c *comparison) generateSignatureReport(checksums1, checksums2 map[string]fileEntry, dir1, dir2, outputDir, command string) error {
+	signatures1, err := c.fileSignatures(checksums1, dir1, command)
+	if err != nil {
+		return err
+	}
+	signatures2, err := c.fileSignatures(checksums2, dir2, command)
+	if err != nil {
+		return err
+	}
+
+	allSignatures := make(map[string]bool)
+	for signature := range signatures1 {
+		allSignatures[signature] = true
+	}
+	for signature := range signatures2 {
+		allSignatures[signature] = true
+	}
+
+	reportFile := filepath.Join(outputDir, "signatures.csv")
+	file, err := os.Create(reportFile)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	writer := c.newCSVWriter(file)
+
+	err = writer.Write([]string{"Signature", "File " + dir1, "File " + dir2, "Status"})
+	if err != nil {
+		return err
+	}
+
+	counts := make(map[string]int)
+	for _, signature := range sortedKeys(allSignatures) {
+		names1 := signatures1[signature]
+		names2 := signatures2[signature]
+		for i := 0; i < len(names1) || i < len(names2); i++ {
+			var name1, name2, status string
+			switch {
+			case i >= len(names1):
+				name2, status = names2[i], "added"
+			case i >= len(names2):
+				name1, status = names1[i], "removed"
+			default:
+				name1, name2 = names1[i], names2[i]
+				status = "identical"
+				if checksums1[name1].checksum != checksums2[name2].checksum {
+					status = "changed"
+				}
+			}
+			counts[status]++
+			if err := writer.Write([]string{signature, name1, name2, status}); err != nil {
+				return err
+			}
+		}
+	}
+
+	writer.Flush()
+	if err := writer.Error(); err != nil {
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+
+	c.logf("# Signature report generated at %s (identical: %d, changed: %d, added: %d, removed: %d)\n",
+		reportFile, counts["identical"], counts["changed"], counts["added"], counts["removed"])
+
+	return nil
+}
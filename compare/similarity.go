@@ -0,0 +1,43 @@
+package compare
+
+import "strconv"
+
+// measureSimilarity returns the share of lines content1 and content2 have in
+// common, given diff, their unified diff: twice the unchanged lines over the
+// lines of both, from 1 for equal files down to 0 for files sharing no line.
+// It is the ratio of Python's difflib, taken from the lines the diff adds and
+// removes instead of a second comparison.
+func measureSimilarity(content1, content2, diff []byte) float64 {
+	total := len(splitLines(content1)) + len(splitLines(content2))
+	if total == 0 {
+		return 1
+	}
+	added, removed := countDiffLines(diff)
+	return float64(total-added-removed) / float64(total)
+}
+
+// changeClass names a measured similarity for the summary: minor from
+// similarityThreshold on, major below it.
+func (c *comparison) changeClass(similarity float64) string {
+	if similarity >= c.similarityThreshold {
+		return "minor"
+	}
+	return "major"
+}
+
+// formatSimilarity writes a similarity for diff.csv and the results
+// database.
+func formatSimilarity(similarity float64) string {
+	return strconv.FormatFloat(similarity, 'f', 4, 64)
+}
+
+// countChanges counts the files of the given change class.
+func countChanges(files []FileResult, change string) int {
+	count := 0
+	for _, file := range files {
+		if file.Change == change {
+			count++
+		}
+	}
+	return count
+}
@@ -0,0 +1,41 @@
+package compare
+
+import (
+	"fmt"
+)
+
+// skipFile records err for the file at path and reports whether the run goes
+// on without it, which only -continue-on-error does. name is the file's name
+// relative to its input, or empty for a directory that could not be read.
+func (c *comparison) skipFile(name, path string, err error) bool {
+	if !c.continueOnError {
+		return false
+	}
+
+	c.skipMu.Lock()
+	defer c.skipMu.Unlock()
+	c.fileErrors = append(c.fileErrors, fmt.Errorf("%s: %v", path, err))
+	if name != "" {
+		c.skippedFiles[name] = true
+	}
+	c.logf(" - skipped %s: %v\n", path, err)
+	return true
+}
+
+// withoutSkipped drops the files that could not be hashed, whose checksum was
+// left empty, so they are not written to the checksum CSV.
+func (c *comparison) withoutSkipped(files []listedFile, checksums []string) ([]listedFile, []string) {
+	if len(c.skippedFiles) == 0 {
+		return files, checksums
+	}
+
+	keptFiles, keptChecksums := files[:0:0], checksums[:0:0]
+	for i, file := range files {
+		if checksums[i] == "" && c.skippedFiles[file.path] {
+			continue
+		}
+		keptFiles = append(keptFiles, file)
+		keptChecksums = append(keptChecksums, checksums[i])
+	}
+	return keptFiles, keptChecksums
+}
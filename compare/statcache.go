@@ -0,0 +1,22 @@
+package compare
+
+import "os"
+
+// listedStat is os.Stat of a file listed by generateChecksums, taken from
+// the listing, and statRetried for any other, such as a file missing on its
+// side.
+func (c *comparison) listedStat(filePath string) (os.FileInfo, error) {
+	if info, ok := c.listedInfos[filePath]; ok {
+		return info, nil
+	}
+	return c.statRetried(filePath)
+}
+
+// contentInfo is statContent without stating a listed file again. A .gz file
+// with -decompress is stated for the size of its decompressed copy.
+func (c *comparison) contentInfo(filePath string) (os.FileInfo, error) {
+	if c.decompress {
+		return c.statContent(filePath)
+	}
+	return c.listedStat(filePath)
+}
@@ -0,0 +1,125 @@
+package compare
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+// directoryTree maps every subdirectory of a root, relative to it, to the
+// number of files it contains at any depth.
+func (c *comparison) directoryTree(root string) (map[string]int, error) {
+	if archive, name, ok := c.zipPath(root); ok && name == "" {
+		return c.zipDirectoryTree(archive), nil
+	}
+	tree := make(map[string]int)
+	ignores := c.newGitignores(root)
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			if info, err := d.Info(); err == nil && rel != "." && c.isOutputDir(info) {
+				return filepath.SkipDir
+			}
+			if rel != "." && ignores.ignored(rel, true) {
+				return filepath.SkipDir
+			}
+			if rel != "." {
+				tree[rel] += 0
+			}
+			return ignores.load(rel)
+		}
+		if !c.selected(rel) || ignores.ignored(rel, false) {
+			return nil
+		}
+		for dir := filepath.Dir(rel); dir != "."; dir = filepath.Dir(dir) {
+			tree[dir]++
+		}
+		return nil
+	})
+	return tree, err
+}
+
+// compareStructure reports directories that exist on only one side, ignoring
+// file contents entirely. Only the topmost one-sided directory of a subtree
+// is listed; its file count covers everything below it. The result is also
+// written to structure.csv and the number of listed directories returned.
+func (c *comparison) compareStructure(dir1, dir2, outputDir string) (int, error) {
+	tree1, err := c.directoryTree(dir1)
+	if err != nil {
+		return 0, err
+	}
+	tree2, err := c.directoryTree(dir2)
+	if err != nil {
+		return 0, err
+	}
+
+	structureFile := filepath.Join(outputDir, "structure.csv")
+	file, err := os.Create(structureFile)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	writer := c.newCSVWriter(file)
+
+	err = writer.Write([]string{"Directory", "Status", "Files"})
+	if err != nil {
+		return 0, err
+	}
+
+	all := make(map[string]bool)
+	for dir := range tree1 {
+		all[dir] = true
+	}
+	for dir := range tree2 {
+		all[dir] = true
+	}
+
+	count := 0
+	for _, dir := range sortedKeys(all) {
+		files1, ok1 := tree1[dir]
+		files2, ok2 := tree2[dir]
+		if ok1 && ok2 {
+			continue
+		}
+		if parent := filepath.Dir(dir); parent != "." && !(hasKey(tree1, parent) && hasKey(tree2, parent)) {
+			// Already covered by a one-sided ancestor
+			continue
+		}
+
+		status, files := "added", files2
+		if !ok2 {
+			status, files = "removed", files1
+		}
+		c.itemf(" - %s (directory) %s: %d files\n", status, dir+string(filepath.Separator), files)
+		err = writer.Write([]string{dir, status, strconv.Itoa(files)})
+		if err != nil {
+			return 0, err
+		}
+		count++
+	}
+
+	writer.Flush()
+	if err := writer.Error(); err != nil {
+		return 0, err
+	}
+	if err := file.Close(); err != nil {
+		return 0, err
+	}
+
+	c.logf("# Directory structure compared (%s)\n", structureFile)
+
+	return count, nil
+}
+
+func hasKey(tree map[string]int, dir string) bool {
+	_, ok := tree[dir]
+	return ok
+}
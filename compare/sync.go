@@ -0,0 +1,127 @@
+package compare
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// generateSyncScript writes a shell script of mv, cp, rm, chmod and mkdir
+// commands derived from records, the rows of diff.csv, that would turn dir1
+// into a copy of dir2. The script is only written, never executed.
+//
+// A path can be a file on one side and a directory on the other, so the
+// files only in dir1 are removed first, then the directories are created
+// and the renamed files moved, and the directories dir2 lacks are removed
+// before anything is copied into their place.
+func (c *comparison) generateSyncScript(records [][]string, dir1, dir2, scriptPath string) error {
+	var moves, copies, removals, chmods []string
+	newDirs := make(map[string]bool)
+	oldDirs := make(map[string]bool)
+
+	for _, record := range records {
+		name := record[0]
+		src := filepath.Join(dir2, name)
+		dst := filepath.Join(dir1, name)
+
+		switch oldName, renamed := c.renamedFrom[name]; {
+		case renamed:
+			// Renamed: move the dir1 file into place
+			for parent := filepath.Dir(name); parent != "."; parent = filepath.Dir(parent) {
+				if !c.isDir(filepath.Join(dir1, parent)) {
+					newDirs[parent] = true
+				}
+			}
+			for parent := filepath.Dir(oldName); parent != "."; parent = filepath.Dir(parent) {
+				if !c.isDir(filepath.Join(dir2, parent)) {
+					oldDirs[parent] = true
+				}
+			}
+			moves = append(moves, "mv -- "+shellQuote(filepath.Join(dir1, oldName))+" "+shellQuote(dst))
+		case record[1] == "":
+			// Only in dir2: create missing parents in dir1 and copy it over
+			for parent := filepath.Dir(name); parent != "."; parent = filepath.Dir(parent) {
+				if !c.isDir(filepath.Join(dir1, parent)) {
+					newDirs[parent] = true
+				}
+			}
+			copies = append(copies, "cp -p -- "+shellQuote(src)+" "+shellQuote(dst))
+		case record[2] == "":
+			// Only in dir1: remove it, and its directories if dir2 lacks them
+			removals = append(removals, "rm -f -- "+shellQuote(dst))
+			for parent := filepath.Dir(name); parent != "."; parent = filepath.Dir(parent) {
+				if !c.isDir(filepath.Join(dir2, parent)) {
+					oldDirs[parent] = true
+				}
+			}
+		case record[1] == record[2]:
+			// Same content, only the permission bits differ
+			info, err := c.statRetried(src)
+			if err != nil {
+				return err
+			}
+			chmods = append(chmods, fmt.Sprintf("chmod %04o -- %s", info.Mode().Perm(), shellQuote(dst)))
+		default:
+			copies = append(copies, "cp -p -- "+shellQuote(src)+" "+shellQuote(dst))
+		}
+	}
+
+	file, err := os.OpenFile(scriptPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0755)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	w := bufio.NewWriter(file)
+	fmt.Fprintf(w, "#!/bin/sh\n")
+	fmt.Fprintf(w, "# Generated by inline-compare to make %s match %s.\n", dir1, dir2)
+	fmt.Fprintf(w, "# This script was NOT executed. Review it, then run it from the directory\n")
+	fmt.Fprintf(w, "# the comparison was started in.\n")
+	fmt.Fprintf(w, "set -e\n\n")
+
+	for _, line := range removals {
+		fmt.Fprintln(w, line)
+	}
+	for _, dir := range sortedKeys(newDirs) {
+		fmt.Fprintf(w, "mkdir -p -- %s\n", shellQuote(filepath.Join(dir1, dir)))
+	}
+	for _, line := range moves {
+		fmt.Fprintln(w, line)
+	}
+
+	// Remove directories deepest first so their parents are empty in turn
+	dirs := sortedKeys(oldDirs)
+	sort.Slice(dirs, func(i, j int) bool { return dirs[i] > dirs[j] })
+	for _, dir := range dirs {
+		fmt.Fprintf(w, "rmdir -- %s\n", shellQuote(filepath.Join(dir1, dir)))
+	}
+
+	for _, line := range copies {
+		fmt.Fprintln(w, line)
+	}
+	for _, line := range chmods {
+		fmt.Fprintln(w, line)
+	}
+
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	return file.Close()
+}
+
+// shellQuote quotes s for POSIX sh using single quotes.
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+func sortedKeys(set map[string]bool) []string {
+	keys := make([]string, 0, len(set))
+	for key := range set {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,39 @@
+package compare
+
+import (
+	"encoding/hex"
+	"fmt"
+	"path/filepath"
+	"sort"
+)
+
+// computeTreeHash hashes a directory with the -hash algorithm as one
+// "name\tchecksum\n" line per file, the name in slash form, in byte order of
+// the names. The order the files were listed or hashed in does not matter,
+// so two directories with the same files give the same hash, whatever their
+// platform or -workers, and any added, removed or changed file changes it.
+func (c *comparison) computeTreeHash(checksums map[string]fileEntry) string {
+	names := make([]string, 0, len(checksums))
+	for fileName := range checksums {
+		names = append(names, filepath.ToSlash(fileName))
+	}
+	sort.Strings(names)
+
+	hash := c.newHash()
+	for _, name := range names {
+		fmt.Fprintf(hash, "%s\t%s\n", name, checksums[filepath.FromSlash(name)].checksum)
+	}
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// reportTreeHashes computes and prints the tree hashes of dir1 and dir2.
+func (c *comparison) reportTreeHashes(dir1, dir2 string, checksums1, checksums2 map[string]fileEntry) {
+	c.treeHashes = [2]string{c.computeTreeHash(checksums1), c.computeTreeHash(checksums2)}
+	c.logf("# Tree hash of %s: %s\n", dir1, c.treeHashes[0])
+	c.logf("# Tree hash of %s: %s\n", dir2, c.treeHashes[1])
+	if c.treeHashes[0] == c.treeHashes[1] {
+		c.logf("# Tree hashes match\n")
+	} else {
+		c.logf("# Tree hashes differ\n")
+	}
+}
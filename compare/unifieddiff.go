@@ -0,0 +1,430 @@
+package compare
+
+import (
+	"bytes"
+	"fmt"
+	"time"
+)
+
+// diffOp is one line of an edit script: ' ' kept, '-' deleted from a, '+'
+// inserted from b.
+type diffOp struct {
+	kind byte
+	line []byte
+}
+
+// unifiedDiff returns a and b compared in the format of diff -u, or nothing
+// when they are equal. name and modTime label each side in the header.
+func (c *comparison) unifiedDiff(name1 string, modTime1 time.Time, a []byte, name2 string, modTime2 time.Time, b []byte) []byte {
+	return c.unifiedDiffFrom(1, name1, modTime1, a, name2, modTime2, b)
+}
+
+// unifiedDiffFrom is unifiedDiff for excerpts of two files that both start at
+// line firstLine, which the hunk line numbers count from.
+func (c *comparison) unifiedDiffFrom(firstLine int, name1 string, modTime1 time.Time, a []byte, name2 string, modTime2 time.Time, b []byte) []byte {
+	if bytes.Equal(a, b) {
+		return nil
+	}
+
+	ops := c.editScript(splitLines(a), splitLines(b))
+	if !hasChanges(ops) {
+		return nil
+	}
+
+	var out bytes.Buffer
+	fmt.Fprintf(&out, "--- %s\t%s\n", name1, modTime1.Format("2006-01-02 15:04:05.000000000 -0700"))
+	fmt.Fprintf(&out, "+++ %s\t%s\n", name2, modTime2.Format("2006-01-02 15:04:05.000000000 -0700"))
+
+	for start := 0; start < len(ops); {
+		// Find the next change and extend the hunk while the gap to the
+		// following change is short enough to share context.
+		first := start
+		for first < len(ops) && ops[first].kind == ' ' {
+			first++
+		}
+		if first == len(ops) {
+			break
+		}
+		last := first
+		for i := first; i < len(ops); i++ {
+			if ops[i].kind != ' ' {
+				if i-last-1 > 2*c.diffContext {
+					break
+				}
+				last = i
+			}
+		}
+
+		from := first - c.diffContext
+		if from < start {
+			from = start
+		}
+		to := last + c.diffContext + 1
+		if to > len(ops) {
+			to = len(ops)
+		}
+		writeHunk(&out, ops, from, to, firstLine-1)
+		start = to
+	}
+
+	return out.Bytes()
+}
+
+// hasChanges reports whether ops delete or insert any line, which they may
+// not with -ignore-whitespace even though the inputs differ.
+func hasChanges(ops []diffOp) bool {
+	for _, op := range ops {
+		if op.kind != ' ' {
+			return true
+		}
+	}
+	return false
+}
+
+// writeHunk writes ops[from:to] as one @@ hunk, numbering lines after the
+// skipped leading lines.
+func writeHunk(out *bytes.Buffer, ops []diffOp, from, to, skipped int) {
+	line1, line2 := skipped, skipped
+	for _, op := range ops[:from] {
+		if op.kind != '+' {
+			line1++
+		}
+		if op.kind != '-' {
+			line2++
+		}
+	}
+	count1, count2 := 0, 0
+	for _, op := range ops[from:to] {
+		if op.kind != '+' {
+			count1++
+		}
+		if op.kind != '-' {
+			count2++
+		}
+	}
+
+	fmt.Fprintf(out, "@@ -%s +%s @@\n", hunkRange(line1, count1), hunkRange(line2, count2))
+	for _, op := range ops[from:to] {
+		out.WriteByte(op.kind)
+		out.Write(op.line)
+		if !bytes.HasSuffix(op.line, []byte("\n")) {
+			out.WriteString("\n\\ No newline at end of file\n")
+		}
+	}
+}
+
+// hunkRange formats the start,count of a hunk side the way diff does: an
+// empty side starts at the line before it and a single line omits the count.
+func hunkRange(before, count int) string {
+	if count == 0 {
+		return fmt.Sprintf("%d,0", before)
+	}
+	if count == 1 {
+		return fmt.Sprintf("%d", before+1)
+	}
+	return fmt.Sprintf("%d,%d", before+1, count)
+}
+
+// splitLines splits data after every newline, keeping the newlines so that a
+// missing final newline counts as a difference.
+func splitLines(data []byte) [][]byte {
+	var lines [][]byte
+	for len(data) > 0 {
+		n := bytes.IndexByte(data, '\n')
+		if n < 0 {
+			lines = append(lines, data)
+			break
+		}
+		lines = append(lines, data[:n+1])
+		data = data[n+1:]
+	}
+	return lines
+}
+
+// editScript computes a shortest edit script from a to b with Myers'
+// algorithm in linear space: the lines of one file only and the common ends
+// are skipped, and the rest is split where a forward and a backward search
+// meet. Heavily changed inputs
+// give up minimality past a cost limit, so the time stays bounded. The runs
+// of changed lines are then slid as slideChanges does, and the deletions of
+// a change come before its insertions.
+func (c *comparison) editScript(a, b [][]byte) []diffOp {
+	// Lines are compared by number, the same number for equal lines
+	ids := make(map[string]int)
+	number := func(lines [][]byte) []int {
+		numbers := make([]int, len(lines))
+		for i, line := range lines {
+			key := string(line)
+			if c.ignoreWhitespace {
+				key = withoutWhitespace(line)
+			}
+			id, ok := ids[key]
+			if !ok {
+				id = len(ids)
+				ids[key] = id
+			}
+			numbers[i] = id
+		}
+		return numbers
+	}
+
+	idsA, idsB := number(a), number(b)
+
+	// A line found in one file only is changed in every script, so the
+	// search only runs over the others, which keeps it short when most
+	// lines are new
+	inA, inB := make([]bool, len(ids)), make([]bool, len(ids))
+	for _, id := range idsA {
+		inA[id] = true
+	}
+	for _, id := range idsB {
+		inB[id] = true
+	}
+	shared := func(numbers []int, in []bool) (kept, at []int) {
+		for i, id := range numbers {
+			if in[id] {
+				kept, at = append(kept, id), append(at, i)
+			}
+		}
+		return kept, at
+	}
+	s := &myersSearch{costLimit: 4096}
+	var atA, atB []int
+	s.idsA, atA = shared(idsA, inB)
+	s.idsB, atB = shared(idsB, inA)
+	s.deleted, s.inserted = make([]bool, len(s.idsA)), make([]bool, len(s.idsB))
+	for n := len(s.idsA) + len(s.idsB); s.costLimit*s.costLimit < n; {
+		s.costLimit *= 2
+	}
+	s.compare(0, len(s.idsA), 0, len(s.idsB))
+
+	deleted, inserted := make([]bool, len(a)), make([]bool, len(b))
+	for i := range deleted {
+		deleted[i] = !inB[idsA[i]]
+	}
+	for j := range inserted {
+		inserted[j] = !inA[idsB[j]]
+	}
+	for i, changed := range s.deleted {
+		deleted[atA[i]] = changed
+	}
+	for j, changed := range s.inserted {
+		inserted[atB[j]] = changed
+	}
+	slideChanges(deleted, idsA, inserted)
+	slideChanges(inserted, idsB, deleted)
+
+	ops := make([]diffOp, 0, len(a)+len(b))
+	for i, j := 0, 0; i < len(a) || j < len(b); {
+		switch {
+		case i < len(a) && deleted[i]:
+			ops = append(ops, diffOp{'-', a[i]})
+			i++
+		case j < len(b) && inserted[j]:
+			ops = append(ops, diffOp{'+', b[j]})
+			j++
+		default:
+			ops = append(ops, diffOp{' ', a[i]})
+			i, j = i+1, j+1
+		}
+	}
+	return ops
+}
+
+// withoutWhitespace returns line with all white space removed, the key under
+// which -ignore-whitespace compares it.
+func withoutWhitespace(line []byte) string {
+	return string(bytes.Join(bytes.Fields(line), nil))
+}
+
+// myersSearch holds the state of editScript. idsA and idsB number the lines,
+// deleted and inserted mark those found changed, and forward and backward
+// hold the furthest reaching x per diagonal of the two searches, reused by
+// every subproblem.
+type myersSearch struct {
+	idsA, idsB        []int
+	deleted, inserted []bool
+	forward, backward []int
+	costLimit         int
+}
+
+// compare marks the changes between a[x1:x2] and b[y1:y2].
+func (s *myersSearch) compare(x1, x2, y1, y2 int) {
+	for x1 < x2 && y1 < y2 && s.idsA[x1] == s.idsB[y1] {
+		x1, y1 = x1+1, y1+1
+	}
+	for x1 < x2 && y1 < y2 && s.idsA[x2-1] == s.idsB[y2-1] {
+		x2, y2 = x2-1, y2-1
+	}
+
+	if x, y, ok := s.split(x1, x2, y1, y2); ok {
+		s.compare(x1, x, y1, y)
+		s.compare(x, x2, y, y2)
+		return
+	}
+	for x := x1; x < x2; x++ {
+		s.deleted[x] = true
+	}
+	for y := y1; y < y2; y++ {
+		s.inserted[y] = true
+	}
+}
+
+// split returns a point on a shortest path through a[x1:x2] and b[y1:y2],
+// which differ at both ends, strictly between the two corners: the end of
+// the forward path where it first overlaps the backward one, or past the
+// cost limit the forward point that got furthest. There is none when either
+// side is empty, and the lines left are then all changed.
+func (s *myersSearch) split(x1, x2, y1, y2 int) (int, int, bool) {
+	n, m := x2-x1, y2-y1
+	if n == 0 || m == 0 {
+		return 0, 0, false
+	}
+
+	// Diagonal k holds the points with x-y == k, at k+offset. A point off
+	// the grid is never kept, and a diagonal without one holds -1.
+	bound := min((n+m+1)/2, s.costLimit) + 1
+	offset, size := bound, 2*bound+1
+	if cap(s.forward) < size {
+		s.forward, s.backward = make([]int, size), make([]int, size)
+	}
+	fwd, bwd := s.forward[:size], s.backward[:size]
+	delta := n - m
+	odd := delta%2 != 0
+
+	for d := 0; d < bound; d++ {
+		// A forward end on diagonal k overlaps the backward end on delta-k
+		// once together they cover the width of the grid
+		for k := -d; k <= d; k += 2 {
+			x := s.step(fwd, offset, d, k, n, m)
+			if x < 0 {
+				fwd[offset+k] = -1
+				continue
+			}
+			for x < n && x-k < m && s.idsA[x1+x] == s.idsB[y1+x-k] {
+				x++
+			}
+			fwd[offset+k] = x
+			if back := delta - k; odd && d > 0 && back >= -(d-1) && back <= d-1 && bwd[offset+back] >= 0 && x+bwd[offset+back] >= n {
+				return s.middle(x1, y1, n, m, x, x-k)
+			}
+		}
+		for k := -d; k <= d; k += 2 {
+			x := s.step(bwd, offset, d, k, n, m)
+			if x < 0 {
+				bwd[offset+k] = -1
+				continue
+			}
+			for x < n && x-k < m && s.idsA[x2-1-x] == s.idsB[y2-1-x+k] {
+				x++
+			}
+			bwd[offset+k] = x
+			if front := delta - k; !odd && front >= -d && front <= d && fwd[offset+front] >= 0 && fwd[offset+front]+x >= n {
+				return s.middle(x1, y1, n, m, fwd[offset+front], fwd[offset+front]-front)
+			}
+		}
+	}
+
+	// Past the cost limit the forward point that got furthest is taken
+	midX, midY := 0, 0
+	for k := -(bound - 1); k <= bound-1; k += 2 {
+		if x := fwd[offset+k]; x >= 0 && x+x-k > midX+midY {
+			midX, midY = x, x-k
+		}
+	}
+	return s.middle(x1, y1, n, m, midX, midY)
+}
+
+// step returns the furthest x on diagonal k that one more change takes a
+// path of v to at step d, before it follows equal lines, or -1 when no path
+// reaches the diagonal within the n by m grid.
+func (s *myersSearch) step(v []int, offset, d, k, n, m int) int {
+	if d == 0 {
+		return 0
+	}
+	x := -1
+	if k > -d && v[offset+k-1] >= 0 && v[offset+k-1] < n {
+		x = v[offset+k-1] + 1
+	}
+	if k < d && v[offset+k+1] >= 0 && v[offset+k+1]-(k+1) < m && v[offset+k+1] > x {
+		x = v[offset+k+1]
+	}
+	return x
+}
+
+// middle returns the point x, y of an n by m grid at x1, y1 that split chose,
+// unless it is a corner, which would not make the problem any smaller.
+func (s *myersSearch) middle(x1, y1, n, m, x, y int) (int, int, bool) {
+	if (x == 0 && y == 0) || (x == n && y == m) {
+		return 0, 0, false
+	}
+	return x1 + x, y1 + y, true
+}
+
+// slideChanges moves every run of changed lines of one side as far as the
+// lines around it allow, the same script written another way, so that runs
+// only split by lines that could go either way are joined. A run ends up as
+// low as it goes, unless it can end next to a change of the other side,
+// other, which keeps a deletion and its insertion in one piece.
+func slideChanges(changed []bool, ids []int, other []bool) {
+	var otherKept []int
+	for j, c := range other {
+		if !c {
+			otherKept = append(otherKept, j)
+		}
+	}
+	// nextToOther reports whether the line after a run past kept unchanged
+	// lines pairs with one that follows a change of the other side
+	nextToOther := func(kept int) bool {
+		j := len(other)
+		if kept < len(otherKept) {
+			j = otherKept[kept]
+		}
+		return j > 0 && other[j-1]
+	}
+
+	kept := 0
+	for start := 0; start < len(changed); {
+		if !changed[start] {
+			start, kept = start+1, kept+1
+			continue
+		}
+		end := start
+		for end < len(changed) && changed[end] {
+			end++
+		}
+
+		for start > 0 && !changed[start-1] && ids[start-1] == ids[end-1] {
+			start, end, kept = start-1, end-1, kept-1
+			changed[start], changed[end] = true, false
+			for start > 0 && changed[start-1] {
+				start--
+			}
+		}
+		// Each step down is kept, to go back to where the run last lined up
+		type step struct{ from, to int }
+		var steps []step
+		aligned, alignedEnd, alignedKept := -1, end, kept
+		if nextToOther(kept) {
+			aligned = 0
+		}
+		for end < len(changed) && ids[start] == ids[end] {
+			changed[start], changed[end] = false, true
+			steps = append(steps, step{start, end})
+			start, end, kept = start+1, end+1, kept+1
+			for end < len(changed) && changed[end] {
+				end++
+			}
+			if nextToOther(kept) {
+				aligned, alignedEnd, alignedKept = len(steps), end, kept
+			}
+		}
+		if aligned >= 0 && aligned < len(steps) {
+			for i := len(steps) - 1; i >= aligned; i-- {
+				changed[steps[i].from], changed[steps[i].to] = true, false
+			}
+			end, kept = alignedEnd, alignedKept
+		}
+		start = end
+	}
+}
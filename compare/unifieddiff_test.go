@@ -0,0 +1,207 @@
+package compare
+
+import (
+	"bytes"
+	"errors"
+	"math/rand"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// hunks returns a unified diff without its two header lines.
+func hunks(diff []byte) string {
+	for i := 0; i < 2 && len(diff) > 0; i++ {
+		diff = diff[bytes.IndexByte(diff, '\n')+1:]
+	}
+	return string(diff)
+}
+
+// changedLines returns the number of lines a unified diff deletes or inserts.
+func changedLines(diff string) int {
+	n := 0
+	for _, line := range strings.SplitAfter(diff, "\n") {
+		if strings.HasPrefix(line, "-") || strings.HasPrefix(line, "+") {
+			n++
+		}
+	}
+	return n
+}
+
+// applyHunks returns a with the hunks of a unified diff applied, or false
+// when a line the diff keeps or deletes is not the one at its place.
+func applyHunks(a []byte, diff string) ([]byte, bool) {
+	lines := splitLines(a)
+	var out []byte
+	next := 0
+	diffLines := strings.SplitAfter(diff, "\n")
+	for i := 0; i < len(diffLines); i++ {
+		line := diffLines[i]
+		noNewline := i+1 < len(diffLines) && strings.HasPrefix(diffLines[i+1], "\\ No newline")
+		text := line[min(1, len(line)):]
+		if noNewline {
+			text = strings.TrimSuffix(text, "\n")
+			i++
+		}
+		switch {
+		case strings.HasPrefix(line, "@@ "):
+			from, _, _ := strings.Cut(strings.TrimPrefix(line, "@@ -"), " ")
+			start, _, _ := strings.Cut(from, ",")
+			n, _ := strconv.Atoi(start)
+			if !strings.HasSuffix(from, ",0") {
+				n--
+			}
+			if n < next || n > len(lines) {
+				return nil, false
+			}
+			for ; next < n; next++ {
+				out = append(out, lines[next]...)
+			}
+		case strings.HasPrefix(line, " "), strings.HasPrefix(line, "-"):
+			if next >= len(lines) || string(lines[next]) != text {
+				return nil, false
+			}
+			if line[0] == ' ' {
+				out = append(out, lines[next]...)
+			}
+			next++
+		case strings.HasPrefix(line, "+"):
+			out = append(out, text...)
+		}
+	}
+	for ; next < len(lines); next++ {
+		out = append(out, lines[next]...)
+	}
+	return out, true
+}
+
+// shortestEdit returns the fewest lines to delete and insert to turn a into
+// b, from their longest common subsequence.
+func shortestEdit(a, b [][]byte) int {
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if bytes.Equal(a[i], b[j]) {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else {
+				lcs[i][j] = max(lcs[i+1][j], lcs[i][j+1])
+			}
+		}
+	}
+	return len(a) + len(b) - 2*lcs[0][0]
+}
+
+// randomLines returns n lines drawn from a few distinct ones, which gives
+// many equally short edit scripts to choose from.
+func randomLines(rng *rand.Rand, n, distinct int) []byte {
+	var lines strings.Builder
+	for i := 0; i < n; i++ {
+		lines.WriteString(strings.Repeat(" ", rng.Intn(2)))
+		lines.WriteByte(byte('a' + rng.Intn(distinct)))
+		lines.WriteByte('\n')
+	}
+	text := lines.String()
+	if rng.Intn(4) == 0 {
+		text = strings.TrimSuffix(text, "\n")
+	}
+	return []byte(text)
+}
+
+// The expected hunks are those GNU diff 3.8 prints for the same inputs.
+func TestUnifiedDiffMatchesDiff(t *testing.T) {
+	tests := []struct {
+		a, b, want string
+	}{
+		{"a\nb\nc\n", "a\nx\nc\n", "@@ -1,3 +1,3 @@\n a\n-b\n+x\n c\n"},
+		{"c\nb\na\n", "a\nc\na\na\n", "@@ -1,3 +1,4 @@\n+a\n c\n-b\n+a\n a\n"},
+		{"b\nb\na\na\nb\na\n", "b\nb\nc\na\nb\nc\nc\n", "@@ -1,6 +1,7 @@\n b\n b\n-a\n+c\n a\n b\n-a\n+c\n+c\n"},
+		{"b\na\nc\nb\nc\na\n", "c\nc\nc\na\nc\n", "@@ -1,6 +1,5 @@\n-b\n-a\n c\n-b\n+c\n c\n a\n+c\n"},
+		{"a\nb\nb\nc\n", "a\nb\nc\n", "@@ -1,4 +1,3 @@\n a\n b\n-b\n c\n"},
+		{"x\ny", "x\nz", "@@ -1,2 +1,2 @@\n x\n-y\n\\ No newline at end of file\n+z\n\\ No newline at end of file\n"},
+		{"x\ny", "x\ny\n", "@@ -1,2 +1,2 @@\n x\n-y\n\\ No newline at end of file\n+y\n"},
+		{"", "a\n", "@@ -0,0 +1 @@\n+a\n"},
+		{"1\n2\n3\n4\n5\n6\n7\n8\n9\n", "1\n2\n3\n4\nx\n6\n7\n8\n9\n", "@@ -2,7 +2,7 @@\n 2\n 3\n 4\n-5\n+x\n 6\n 7\n 8\n"},
+	}
+	c := testOptions().newComparison()
+	for _, test := range tests {
+		got := hunks(c.unifiedDiff("a", time.Time{}, []byte(test.a), "b", time.Time{}, []byte(test.b)))
+		if got != test.want {
+			t.Errorf("diff of %q and %q:\n%s\nwant:\n%s", test.a, test.b, got, test.want)
+		}
+	}
+}
+
+func TestUnifiedDiffIsShortest(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	for i := 0; i < 2000; i++ {
+		a, b := randomLines(rng, rng.Intn(40), 2+rng.Intn(6)), randomLines(rng, rng.Intn(40), 2+rng.Intn(6))
+		opts := testOptions()
+		opts.Context = rng.Intn(5)
+		c := opts.newComparison()
+
+		got := hunks(c.unifiedDiff("a", time.Time{}, a, "b", time.Time{}, b))
+		if patched, ok := applyHunks(a, got); !ok || !bytes.Equal(patched, b) {
+			t.Fatalf("diff of %q and %q does not turn one into the other:\n%s", a, b, got)
+		}
+		if n, want := changedLines(got), shortestEdit(splitLines(a), splitLines(b)); n != want {
+			t.Fatalf("diff of %q and %q changes %d lines, want %d:\n%s", a, b, n, want, got)
+		}
+	}
+}
+
+// GNU diff may pick another of the shortest scripts, but never a shorter one,
+// and its output must read the same way as far as a patch is concerned.
+func TestUnifiedDiffAgreesWithDiff(t *testing.T) {
+	if out, err := exec.Command("diff", "--version").Output(); err != nil || !bytes.Contains(out, []byte("GNU diffutils")) {
+		t.Skip("GNU diff is not installed")
+	}
+	dir := t.TempDir()
+	file1, file2 := filepath.Join(dir, "1"), filepath.Join(dir, "2")
+	rng := rand.New(rand.NewSource(1))
+
+	same := 0
+	const runs = 500
+	for i := 0; i < runs; i++ {
+		a, b := randomLines(rng, rng.Intn(60), 2+rng.Intn(6)), randomLines(rng, rng.Intn(60), 2+rng.Intn(6))
+		opts := testOptions()
+		opts.IgnoreWhitespace = i%3 == 0
+		opts.Context = rng.Intn(5)
+		c := opts.newComparison()
+		if err := os.WriteFile(file1, a, 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(file2, b, 0644); err != nil {
+			t.Fatal(err)
+		}
+		args := []string{"-U", strconv.Itoa(opts.Context), file1, file2}
+		if opts.IgnoreWhitespace {
+			args = append([]string{"-w"}, args...)
+		}
+		want, err := exec.Command("diff", args...).Output()
+		var exitErr *exec.ExitError
+		if err != nil && !(errors.As(err, &exitErr) && exitErr.ExitCode() == 1) {
+			t.Fatal(err)
+		}
+
+		got := c.unifiedDiff(file1, time.Time{}, a, file2, time.Time{}, b)
+		if (len(got) == 0) != (len(want) == 0) || changedLines(hunks(got)) > changedLines(hunks(want)) {
+			t.Fatalf("diff %s of %q and %q:\n%s\nwant no more changes than:\n%s", strings.Join(args[:len(args)-2], " "), a, b, hunks(got), hunks(want))
+		}
+		if !opts.IgnoreWhitespace {
+			if patched, ok := applyHunks(a, hunks(got)); !ok || !bytes.Equal(patched, b) {
+				t.Fatalf("diff of %q and %q does not turn one into the other:\n%s", a, b, hunks(got))
+			}
+		}
+		if hunks(got) == hunks(want) {
+			same++
+		}
+	}
+	t.Logf("%d of %d diffs are the same as those of diff", same, runs)
+}
@@ -0,0 +1,33 @@
+package compare
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Levels of Options.Verbosity, each showing what the lower ones show.
+const (
+	// verboseFiles shows the progress of each file.
+	verboseFiles = 1
+	// verboseLimits shows how each pair of files is diffed, as decided by the
+	// -size limit.
+	verboseLimits = 2
+	// verboseDetails shows the temporary files and the commands run.
+	verboseDetails = 3
+)
+
+// verbosef prints a diagnostic line from level on. It can be called from any
+// goroutine.
+func (c *comparison) verbosef(level int, format string, args ...any) {
+	if c.verbosity < level {
+		return
+	}
+	c.diagnosticsMu.Lock()
+	defer c.diagnosticsMu.Unlock()
+	fmt.Fprintf(c.diagnostics, format, args...)
+}
+
+// verboseCommand prints args, a command about to run, from verboseDetails on.
+func (c *comparison) verboseCommand(args ...string) {
+	c.verbosef(verboseDetails, "// running %s\n", strings.Join(args, " "))
+}
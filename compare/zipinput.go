@@ -0,0 +1,337 @@
+package compare
+
+import (
+	"archive/zip"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// isZipInput reports whether input is a .zip file, whose entries are compared
+// as the files of a directory.
+func isZipInput(input string) bool {
+	if !strings.HasSuffix(strings.ToLower(input), ".zip") {
+		return false
+	}
+	info, err := os.Stat(input)
+	return err == nil && info.Mode().IsRegular()
+}
+
+// zipInput is a .zip input opened for the run. Its entries are listed and
+// hashed where they are, under the path of the archive as if it were a
+// directory, and only extracted when a diff or a copy needs their content.
+type zipInput struct {
+	path   string
+	reader *zip.ReadCloser
+	// entries maps the name of every file entry, relative to the archive, to
+	// the entry, and names lists them once each in the order of the archive.
+	entries map[string]*zipEntry
+	names   []string
+	// dirs holds the directories of the archive, with or without an entry.
+	dirs map[string]bool
+}
+
+// zipEntry is a file entry of a zipInput. A symbolic link reads as a small
+// text file holding its target, as in container images.
+type zipEntry struct {
+	file *zip.File
+	link []byte
+	info os.FileInfo
+}
+
+// zipEntryInfo is the os.FileInfo of a zipEntry, whose size and mode differ
+// from those of its header for a symbolic link.
+type zipEntryInfo struct {
+	fs.FileInfo
+	size int64
+	mode fs.FileMode
+}
+
+func (i zipEntryInfo) Size() int64       { return i.size }
+func (i zipEntryInfo) Mode() fs.FileMode { return i.mode }
+
+// open returns the content of the entry.
+func (e *zipEntry) open() (io.ReadCloser, error) {
+	if e.link != nil {
+		return io.NopCloser(strings.NewReader(string(e.link))), nil
+	}
+	return e.file.Open()
+}
+
+// openZip opens the .zip file input for the run, closed by cleanup, and
+// returns the path its entries are compared under. Directory entries only
+// mark their directory, and an entry whose name was already seen replaces
+// the earlier one, as unzip does, after a note. Names that would escape the
+// archive are kept inside it.
+func (c *comparison) openZip(input string) (string, error) {
+	dir := filepath.Clean(input)
+	reader, err := zip.OpenReader(dir)
+	if err != nil {
+		return "", err
+	}
+	archive := &zipInput{path: dir, reader: reader, entries: make(map[string]*zipEntry), dirs: make(map[string]bool)}
+	c.zips = append(c.zips, archive)
+
+	for _, file := range reader.File {
+		name := zipEntryName(file.Name)
+		if strings.HasSuffix(file.Name, "/") || file.Mode().IsDir() {
+			if name != "" {
+				archive.addDirs(name)
+			}
+			continue
+		}
+		if name == "" {
+			continue
+		}
+
+		entry := &zipEntry{file: file}
+		info := zipEntryInfo{FileInfo: file.FileInfo(), size: int64(file.UncompressedSize64), mode: file.Mode()}
+		if file.Mode()&os.ModeSymlink != 0 {
+			target, err := readZipLink(file)
+			if err != nil {
+				return "", fmt.Errorf("reading %s: %v", file.Name, err)
+			}
+			entry.link = []byte("symlink -> " + target + "\n")
+			info.size, info.mode = int64(len(entry.link)), 0644
+		}
+		entry.info = info
+
+		if _, ok := archive.entries[name]; ok {
+			c.logf("# Duplicate entry %s in %s, the last one is compared\n", file.Name, dir)
+		} else {
+			archive.names = append(archive.names, name)
+		}
+		archive.entries[name] = entry
+		archive.addDirs(filepath.Dir(name))
+	}
+	c.verbosef(verboseDetails, "// %d entries in %s\n", len(archive.names), dir)
+
+	return dir, nil
+}
+
+// zipEntryName returns the name of a .zip entry as a path relative to the
+// archive, or an empty name for the archive itself.
+func zipEntryName(name string) string {
+	return filepath.FromSlash(strings.TrimPrefix(path.Clean("/"+name), "/"))
+}
+
+// readZipLink returns the target of a symbolic link entry.
+func readZipLink(file *zip.File) (string, error) {
+	content, err := file.Open()
+	if err != nil {
+		return "", err
+	}
+	defer content.Close()
+	target, err := io.ReadAll(content)
+	return string(target), err
+}
+
+// addDirs records dir and its parents as directories of the archive.
+func (a *zipInput) addDirs(dir string) {
+	for ; dir != "." && dir != string(filepath.Separator); dir = filepath.Dir(dir) {
+		a.dirs[dir] = true
+	}
+}
+
+// walkZip hands visit the file entries of archive at any depth, or within
+// -max-depth, in the order of the archive, as walkFiles does for a directory.
+func (c *comparison) walkZip(archive *zipInput, visit func(listedFile) error) error {
+	for _, name := range archive.names {
+		if !c.selected(name) {
+			continue
+		}
+		if c.maxDepth >= 0 && strings.Count(name, string(filepath.Separator)) > c.maxDepth {
+			continue
+		}
+		if err := visit(listedFile{path: name, FileInfo: archive.entries[name].info}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// zipPath returns the .zip input that filePath, the archive or a path below
+// it, lies in, and the name of filePath within it, empty for the archive.
+func (c *comparison) zipPath(filePath string) (*zipInput, string, bool) {
+	for _, archive := range c.zips {
+		if filePath == archive.path {
+			return archive, "", true
+		}
+		if name, ok := strings.CutPrefix(filePath, archive.path+string(filepath.Separator)); ok {
+			return archive, name, true
+		}
+	}
+	return nil, "", false
+}
+
+// statZipEntry is os.Stat of filePath when it lies below a .zip input, with
+// ok set. Anything but a file entry does not exist.
+func (c *comparison) statZipEntry(filePath string) (info os.FileInfo, ok bool, err error) {
+	archive, name, ok := c.zipPath(filePath)
+	if !ok || name == "" {
+		return nil, false, nil
+	}
+	if entry, found := archive.entries[name]; found {
+		return entry.info, true, nil
+	}
+	return nil, true, &fs.PathError{Op: "stat", Path: filePath, Err: fs.ErrNotExist}
+}
+
+// pathExists reports whether there is anything at path, a file or a
+// directory, including the directories of a .zip input.
+func (c *comparison) pathExists(path string) bool {
+	if archive, name, ok := c.zipPath(path); ok && name != "" {
+		return archive.dirs[name] || archive.entries[name] != nil
+	}
+	_, err := os.Stat(path)
+	return !os.IsNotExist(err)
+}
+
+// isDir reports whether path is a directory, including the directories of a
+// .zip input.
+func (c *comparison) isDir(path string) bool {
+	if archive, name, ok := c.zipPath(path); ok && name != "" {
+		return archive.dirs[name]
+	}
+	info, err := os.Stat(path)
+	return err == nil && info.IsDir()
+}
+
+// openStored opens filePath as it is stored, reading an entry of a .zip
+// input in place.
+func (c *comparison) openStored(filePath string) (io.ReadCloser, error) {
+	if archive, name, ok := c.zipPath(filePath); ok && name != "" {
+		if entry := archive.entries[name]; entry != nil {
+			return entry.open()
+		}
+		return nil, &fs.PathError{Op: "open", Path: filePath, Err: fs.ErrNotExist}
+	}
+	return os.Open(filePath)
+}
+
+// hashZipEntry is hashFile for the entry name of archive, at filePath, which
+// is hashed as it is decompressed.
+func (c *comparison) hashZipEntry(archive *zipInput, name, filePath string, quick bool) (string, error) {
+	entry := archive.entries[name]
+	if entry == nil {
+		return "", &fs.PathError{Op: "open", Path: filePath, Err: fs.ErrNotExist}
+	}
+	content, err := entry.open()
+	if err != nil {
+		return "", err
+	}
+	defer content.Close()
+
+	start, length := c.contentRange(entry.info.Size())
+	if _, err := io.CopyN(io.Discard, content, start); err != nil {
+		return "", err
+	}
+	compared := io.LimitReader(content, length)
+
+	switch {
+	case quick:
+		return c.streamQuickChecksum(compared, length)
+	case c.hashesNormalized(filePath):
+		return c.normalizedChecksum(filePath, compared, length)
+	case c.chunkHashSize > 0:
+		return c.streamTreeChecksum(compared, length)
+	}
+	hash := c.newHash()
+	if err := c.copyHashed(hash, compared, length); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// localPath returns a path on disk holding the content of filePath: the file
+// itself, or for an entry of a .zip input a copy extracted by the first
+// call, which the following calls reuse until releaseContent or the end of
+// the comparison.
+func (c *comparison) localPath(filePath string) (string, error) {
+	archive, name, ok := c.zipPath(filePath)
+	if !ok || name == "" {
+		return filePath, nil
+	}
+
+	c.decompressMu.Lock()
+	path, ok := c.extracted[filePath]
+	if !ok && c.extractDir == "" {
+		dir, err := os.MkdirTemp("", "inline-compare-zip-*")
+		if err != nil {
+			c.decompressMu.Unlock()
+			return "", err
+		}
+		c.extractDir = dir
+		c.tempDirs = append(c.tempDirs, dir)
+		c.verbosef(verboseDetails, "// temporary directory %s for extracted zip entries\n", dir)
+	}
+	c.decompressMu.Unlock()
+	if ok {
+		return path, nil
+	}
+
+	path, err := c.extractZipEntry(archive, name, c.extractDir)
+	if err != nil {
+		return "", fmt.Errorf("extracting %s: %v", filePath, err)
+	}
+
+	c.decompressMu.Lock()
+	c.extracted[filePath] = path
+	c.decompressMu.Unlock()
+	return path, nil
+}
+
+// extractZipEntry writes the content of the entry name of archive to a new
+// file in dir and returns its path. The copy keeps the mtime of the entry,
+// which labels the diffs.
+func (c *comparison) extractZipEntry(archive *zipInput, name, dir string) (string, error) {
+	entry := archive.entries[name]
+	if entry == nil {
+		return "", fs.ErrNotExist
+	}
+	content, err := entry.open()
+	if err != nil {
+		return "", err
+	}
+	defer content.Close()
+
+	dst, err := os.CreateTemp(dir, "entry-*")
+	if err != nil {
+		return "", err
+	}
+	c.verbosef(verboseDetails, "// extracting %s from %s to %s\n", name, archive.path, dst.Name())
+	_, err = io.Copy(dst, content)
+	if closeErr := dst.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chtimes(dst.Name(), entry.info.ModTime(), entry.info.ModTime())
+	}
+	if err != nil {
+		os.Remove(dst.Name())
+		return "", err
+	}
+	return dst.Name(), nil
+}
+
+// zipDirectoryTree is directoryTree for a .zip input.
+func (c *comparison) zipDirectoryTree(archive *zipInput) map[string]int {
+	tree := make(map[string]int)
+	for dir := range archive.dirs {
+		tree[dir] += 0
+	}
+	for _, name := range archive.names {
+		if !c.selected(name) {
+			continue
+		}
+		for dir := filepath.Dir(name); dir != "."; dir = filepath.Dir(dir) {
+			tree[dir]++
+		}
+	}
+	return tree
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// loadConfig gives the flags not set on the command line the values of the
+// -config file at path. Each line holds a flag name, with or without its
+// dash, and its value as key = value, or the name alone to turn a boolean
+// flag on. Blank lines and lines starting with # are skipped. A repeatable
+// flag such as exclude takes one line per value, unless the command line
+// sets it, which replaces them all.
+func loadConfig(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	explicit := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) {
+		explicit[f.Name] = true
+	})
+
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		name, value, hasValue := strings.Cut(text, "=")
+		name = strings.TrimLeft(strings.TrimSpace(name), "-")
+		value = strings.TrimSpace(value)
+
+		f := flag.Lookup(name)
+		if f == nil || name == "config" || name == "version" {
+			return fmt.Errorf("%s:%d: unknown option %q", path, line, name)
+		}
+		if !hasValue {
+			if !isBoolFlag(f) {
+				return fmt.Errorf("%s:%d: %s needs a value", path, line, name)
+			}
+			value = "true"
+		}
+		if strings.HasPrefix(value, `"`) {
+			if value, err = strconv.Unquote(value); err != nil {
+				return fmt.Errorf("%s:%d: invalid quoted value for %s", path, line, name)
+			}
+		}
+		if explicit[name] {
+			continue
+		}
+		if err := f.Value.Set(value); err != nil {
+			return fmt.Errorf("%s:%d: invalid value %q for %s: %v", path, line, value, name, err)
+		}
+	}
+	return scanner.Err()
+}
+
+// isBoolFlag reports whether f can be given without a value.
+func isBoolFlag(f *flag.Flag) bool {
+	b, ok := f.Value.(interface{ IsBoolFlag() bool })
+	return ok && b.IsBoolFlag()
+}
@@ -1,417 +1,543 @@
 package main
 
 import (
-	"crypto/md5"
-	"encoding/csv"
-	"encoding/hex"
+	"bufio"
+	"context"
 	"flag"
 	"fmt"
 	"io"
-	"io/ioutil"
 	"os"
-	"os/exec"
+	"os/signal"
 	"path/filepath"
 	"sort"
-)
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+	"unicode/utf8"
 
-var debug bool
+	"inline-compare/compare"
+)
 
-func main() {
-	lineLimit := flag.Int("lines", 50, "Number of lines to compare for large files")
-	sizeLimit := flag.Int("size", 100, "File size limit in MB for comparing last lines")
-	useCache := flag.Bool("use-cache", false, "Use existing checksum CSV files instead of regenerating new ones")
-	flag.BoolVar(&debug, "debug", false, "Enable debug mode")
-	flag.Parse()
+// stringList is a flag that can be repeated, collecting every value.
+type stringList []string
 
-	if len(flag.Args()) != 2 {
-		fmt.Println("Usage: compare [options] <dir1> <dir2>")
-		return
-	}
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
 
-	dir1 := filepath.Clean(flag.Arg(0))
-	dir2 := filepath.Clean(flag.Arg(1))
-	outputDir := filepath.Clean(dir1 + "-" + dir2)
+func (l *stringList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
 
-	// Create the output directory
-	err := os.MkdirAll(outputDir, 0755)
-	if err != nil {
-		fmt.Printf("Error creating output directory: %v\n", err)
-		return
-	}
+// verbosityFlag is one of -v, -vv and -vvv, given without a value. -v raises
+// the level by one each time it is repeated, the others set theirs, and any
+// of them takes a level such as -v=2.
+type verbosityFlag struct {
+	level *int
+	set   int
+}
 
-	fmt.Printf("# Compare %s and %s\n", dir1, dir2)
+func (f verbosityFlag) IsBoolFlag() bool { return true }
 
-	checksums1, err := generateChecksums(dir1, *useCache, outputDir)
-	if err != nil {
-		fmt.Printf("Error generating checksums for %s: %v\n", dir1, err)
-		return
+func (f verbosityFlag) String() string {
+	if f.level == nil {
+		return "0"
 	}
+	return strconv.Itoa(*f.level)
+}
 
-	checksums2, err := generateChecksums(dir2, *useCache, outputDir)
-	if err != nil {
-		fmt.Printf("Error generating checksums for %s: %v\n", dir2, err)
-		return
+func (f verbosityFlag) Set(value string) error {
+	switch {
+	case value == "true" && f.set == 0:
+		*f.level = min(*f.level+1, 3)
+	case value == "true":
+		*f.level = max(*f.level, f.set)
+	case value != "false":
+		level, err := strconv.Atoi(value)
+		if err != nil || level < 0 || level > 3 {
+			return fmt.Errorf("expected a level from 0 to 3")
+		}
+		*f.level = level
 	}
+	return nil
+}
 
-	err = generateCombinedCSV(checksums1, checksums2, dir1, dir2, outputDir)
-	if err != nil {
-		fmt.Printf("Error generating combined CSV: %v\n", err)
-		return
-	}
-	fmt.Printf("# Combined CSV generated at %s\n", filepath.Join(outputDir, "diff.csv"))
+var (
+	// output receives everything but the JSON document of -format json.
+	output    io.Writer = os.Stdout
+	verbosity int
+)
 
-	diffCount, err := compareFilesInCSV(dir1, dir2, *sizeLimit, *lineLimit, outputDir)
-	if err != nil {
-		fmt.Printf("Error comparing files: %v\n", err)
-		return
-	}
+// Exit statuses of a comparison.
+const (
+	exitIdentical = 0
+	exitDifferent = 1
+	exitError     = 2
+)
 
-	fmt.Printf("# Total differences found: %d (%s)\n", diffCount, filepath.Join(outputDir, "diffs"))
+func main() {
+	status := run()
+	closeRunLog(status)
+	os.Exit(status)
 }
 
-func generateChecksums(dir string, useCache bool, outputDir string) (map[string]string, error) {
-	checksums := make(map[string]string)
-	csvFile := filepath.Join(outputDir, filepath.Base(dir)+"-checksums.csv")
-
-	if useCache {
-		file, err := os.Open(csvFile)
-		if err == nil {
-			defer file.Close()
-			reader := csv.NewReader(file)
-			records, err := reader.ReadAll()
-			if err == nil {
-				for _, record := range records {
-					checksums[record[0]] = record[1]
-				}
-				return checksums, nil
-			}
-		}
-	} else {
-		// Delete existing checksum file if it exists
-		if err := os.Remove(csvFile); err != nil && !os.IsNotExist(err) {
-			return nil, err
+// run runs the comparison described by the command line and returns the
+// exit status, so deferred cleanup runs before the process exits.
+func run() int {
+	opts := compare.DefaultOptions()
+	var excludes, includes, unordered stringList
+
+	out := flag.String("out", "", "Output directory (default: <dir1>-<dir2> from the base names of the inputs)")
+	flag.IntVar(&opts.LineLimit, "lines", opts.LineLimit, "Number of lines to compare for large files")
+	flag.IntVar(&opts.SizeLimit, "size", opts.SizeLimit, "File size limit in MB for comparing last lines")
+	flag.BoolVar(&opts.UseCache, "use-cache", false, "Use existing checksum CSV files instead of regenerating new ones")
+	flag.BoolVar(&opts.KeepChecksums, "keep-checksums", opts.KeepChecksums, "Keep the checksum CSVs for -use-cache (use -keep-checksums=false to delete them after a successful run)")
+	flag.IntVar(&opts.ChunkHash, "chunk-hash", 0, "Chunk size in MB for parallel tree hashing (0 disables, the digest is the -hash digest of the chunk digests)")
+	flag.BoolVar(&opts.QuickHash, "quick-hash", false, "Hash only the size and the first and last 64 KB of each file, labeled quick: in the CSVs")
+	flag.BoolVar(&opts.ConfirmQuick, "quick-hash-confirm", false, "Hash files in full when their quick hashes match, before reporting them identical")
+	flag.IntVar(&opts.BufferSize, "buffer-size", opts.BufferSize, "Read buffer size in KB for hashing files (at least 4)")
+	flag.IntVar(&opts.Retries, "retries", opts.Retries, "Times to retry a read failing with a transient error, such as on a flaky network mount")
+	flag.IntVar(&opts.MmapThreshold, "mmap-threshold", opts.MmapThreshold, "File size in MB from which files are memory-mapped for hashing (0 disables)")
+	columns := flag.String("columns", "", "Comma-separated optional columns to add to diff.csv (mtime, mode, diffhash)")
+	flag.BoolVar(&opts.CheckPerms, "check-mode", false, "Report files whose permission bits differ even when their content matches")
+	flag.BoolVar(&opts.CheckPerms, "check-perms", false, "Alias of -check-mode")
+	flag.BoolVar(&opts.CheckOwner, "check-owner", false, "Report files whose uid or gid differ even when their content matches")
+	delimiter := flag.String("delimiter", ",", "Field delimiter of the CSV files, a single character such as ';' or \\t for tabs")
+	modeMask := flag.String("ignore-mode-bits", "0", "Octal mask of permission bits to ignore with -check-mode")
+	notify := flag.String("notify", "", "Command to run or webhook URL to POST to when the comparison finishes")
+	flag.BoolVar(&opts.DetectTruncation, "detect-truncation", false, "Report files whose content is a truncated prefix of the other side")
+	flag.StringVar(&opts.SignatureCmd, "signature-cmd", "", "External command printing a content signature for a file; pairs files by signature into signatures.csv")
+	flag.StringVar(&opts.Manifest, "manifest", "", "Write a CSV of every file in both directories with both checksums to this path")
+	flag.BoolVar(&opts.MtimeTiebreak, "compare-mtime-as-tiebreak", false, "List identical files in identical.csv with the side holding the newer mtime")
+	flag.BoolVar(&opts.DedupStats, "dedup-stats", false, "Report how much data is shared between the directories at the chunk level")
+	showProgress := flag.Bool("progress", false, "Print the percentage of files hashed and compared to stderr")
+	flag.StringVar(&opts.ProgressSocket, "progress-socket", "", "Serve JSON progress events on a Unix domain socket at this path")
+	flag.Int64Var(&opts.IgnoreHeadBytes, "ignore-head-bytes", 0, "Ignore this many bytes at the start of every file when hashing and diffing")
+	flag.Int64Var(&opts.IgnoreTailBytes, "ignore-tail-bytes", 0, "Ignore this many bytes at the end of every file when hashing and diffing")
+	flag.BoolVar(&opts.IgnoreEOL, "ignore-eol", false, "Treat CRLF and LF line endings as equal when hashing and diffing")
+	flag.BoolVar(&opts.IgnoreFinalNewline, "ignore-final-newline", false, "Treat files with and without a newline at the end as equal when hashing and diffing")
+	flag.BoolVar(&opts.Decompress, "decompress", false, "Compare .gz files by their decompressed content")
+	flag.BoolVar(&opts.IgnoreWhitespace, "ignore-whitespace", false, "Ignore lines that only differ in white space in the diffs, passing -w to -diff-tool")
+	flag.BoolVar(&opts.IgnoreBlankLines, "ignore-blank-lines", false, "Leave blank lines out of the diffs, like diff -B")
+	flag.StringVar(&opts.CommentPrefix, "comment-prefix", "", "Leave lines starting with this prefix, such as # or //, out of the diffs")
+	flag.BoolVar(&opts.DetectRenames, "detect-renames", false, "Report a file only in dir1 and a file only in dir2 with the same checksum as a rename")
+	flag.Var(&excludes, "exclude", "Glob of files to leave out of the comparison on both sides (repeatable)")
+	flag.Var(&includes, "include", "Glob of files to compare, leaving out all others (repeatable)")
+	ext := flag.String("ext", "", "Comma-separated file extensions to compare, leaving out all others, e.g. conf,yaml")
+	skipExt := flag.String("skip-ext", "", "Comma-separated file extensions to leave out of the comparison, e.g. png,jpg")
+	only := flag.String("only", "", "Comma-separated statuses of the rows to keep in diff.csv and diffs (added, removed, modified, mode, renamed)")
+	flag.Var(&unordered, "unordered", "Glob of files whose lines are sorted before hashing and diffing (repeatable)")
+	flag.BoolVar(&opts.SkipExistingDiffs, "skip-existing-diffs", false, "Keep .diff files whose source files are unchanged since they were generated")
+	flag.BoolVar(&opts.NoClobber, "no-clobber", false, "Keep every existing .diff file, even if its source files changed since")
+	flag.BoolVar(&opts.SkipSizeMismatch, "skip-size-mismatch", false, "Do not hash files of dir2 whose size differs from their counterpart in dir1")
+	format := flag.String("format", "text", "Output format: text, json for a single JSON summary on stdout (progress goes to stderr), ndjson for a JSON object per line on stdout for every file as it is handled, html for an index.html report or markdown for a report.md in the output directory")
+	flag.BoolVar(&opts.Quiet, "quiet", false, "Suppress the per-file output; the summary and the exit status are unchanged")
+	flag.StringVar(&opts.Archive, "archive", "", "Pack the diffs directory into diffs.zip or diffs.tar.gz in the output directory: zip or tar.gz")
+	flag.BoolVar(&opts.ArchiveCSVs, "archive-csvs", false, "Add the CSVs of the output directory to the -archive")
+	colorMode := flag.String("color", "auto", "Color the diff of two files and the summary counts: auto on a terminal unless NO_COLOR is set, always or never")
+	summaryOnly := flag.Bool("summary", false, "Print nothing but errors and a final block of counts")
+	flag.StringVar(&opts.DiffTool, "diff-tool", "", "External diff command, e.g. \"diff -u\", run on the two files instead of the built-in unified diff")
+	flag.IntVar(&opts.Context, "context", opts.Context, "Number of unchanged lines shown around each change in diffs")
+	flag.BoolVar(&opts.FullLarge, "full-large", false, "Find the first difference of files over -size instead of diffing only their last -lines lines")
+	flag.Int64Var(&opts.MaxDiffBytes, "max-diff-bytes", 0, "Cut each .diff after this many bytes, with a note of how much was left out (0 for no limit)")
+	flag.StringVar(&opts.BinaryMode, "binary-mode", opts.BinaryMode, "Handling of binary files: skip, note with their checksums and sizes, or hexdump for files within -size")
+	flag.IntVar(&opts.Workers, "workers", opts.Workers, "Number of files hashed or diffed concurrently")
+	flag.StringVar(&opts.Hash, "hash", opts.Hash, "Checksum algorithm: "+strings.Join(compare.HashAlgorithms(), ", "))
+	flag.BoolVar(&opts.Recursive, "recursive", false, "Walk subdirectories and compare files by their path relative to each input")
+	flag.IntVar(&opts.MaxDepth, "max-depth", opts.MaxDepth, "Maximum directory depth walked by -recursive, 0 for the top level only (-1 for no limit)")
+	flag.BoolVar(&opts.FollowSymlinks, "follow-symlinks", false, "Compare what symbolic links point to instead of skipping them")
+	flag.BoolVar(&opts.UseGitignore, "use-gitignore", false, "Leave out the files ignored by the .gitignore files of each directory, and .git")
+	flag.BoolVar(&opts.Digest, "digest", false, "Print a SHA-256 fingerprint of the whole comparison result at the end")
+	flag.BoolVar(&opts.TreeHash, "tree-hash", false, "Print a hash of each input directory computed from its sorted file names and checksums")
+	flag.BoolVar(&opts.Semver, "semver", false, "Pair <name>-<version><ext> artifacts across versions and order them by version")
+	flag.BoolVar(&opts.IgnoreCase, "ignore-case", false, "Pair files whose names only differ in case, as on macOS and Windows, under their dir1 name")
+	flag.BoolVar(&opts.StructureOnly, "structure-only", false, "Only report directories present on one side, ignoring file contents")
+	flag.BoolVar(&opts.LowMemory, "low-memory", false, "Walk, hash and merge-join through sorted runs on disk instead of holding all files and checksums in memory")
+	flag.StringVar(&opts.ResultsDB, "results-db", "", "Append the per-file results to this SQLite database (requires the sqlite3 CLI)")
+	flag.StringVar(&opts.EmitSync, "emit-sync", "", "Write a shell script to this path that would make dir1 match dir2 (not executed)")
+	flag.BoolVar(&opts.ShowIdentical, "show-identical", false, "List the files that are identical on both sides")
+	flag.BoolVar(&opts.Stats, "stats", false, "Count the lines each diff adds and removes, in diff.csv and the summary")
+	flag.Float64Var(&opts.SimilarityThreshold, "similarity-threshold", 0, "Measure the share of lines modified files keep and count those from this ratio on (0 to 1) as minor changes, the others as major (0 disables)")
+	flag.BoolVar(&opts.NoCombinedCSV, "no-combined-csv", false, "Keep the combined comparison in memory instead of writing diff.csv")
+	flag.BoolVar(&opts.DryRun, "dry-run", false, "Stop after diff.csv and list the new, deleted and changed files without copying or diffing anything")
+	flag.BoolVar(&opts.ContinueOnError, "continue-on-error", false, "Skip files that cannot be read or diffed, list them at the end and exit with status 2")
+	flag.BoolVar(&opts.FailFast, "fail-fast", false, "Stop at the first differing file and exit with status 1, skipping the CSV and diffs")
+	filesFrom := flag.String("files-from", "", "Only compare the relative paths listed in this file, one per line, or on stdin with -")
+	latest := flag.String("latest", "", "Treat dir2 as a glob and compare against the latest match, by mtime or name")
+	flag.BoolVar(&opts.PruneEmptyDirs, "prune-empty-dirs", opts.PruneEmptyDirs, "Remove empty directories from the diffs output (use -prune-empty-dirs=false to keep them)")
+	flag.BoolVar(&opts.CollapseAddedDirs, "collapse-added-dirs", false, "Report a subtree present on only one side as a single directory entry (-v lists its files)")
+	flag.StringVar(&opts.CaseCollisions, "case-collisions", opts.CaseCollisions, "Handling of output names differing only in case: suffix or overwrite")
+	flag.StringVar(&opts.Sort, "sort", opts.Sort, "Order of results: name or dir-then-name")
+	timeout := flag.Duration("timeout", 0, "Abort the comparison after this long, e.g. 30m (0 disables)")
+	flag.Var(verbosityFlag{level: &opts.Verbosity}, "v", "Print diagnostics to stderr: the progress of each file, more with -vv and -vvv (repeatable)")
+	flag.Var(verbosityFlag{level: &opts.Verbosity, set: 2}, "vv", "Also print how each pair of files is diffed given the -size limit")
+	flag.Var(verbosityFlag{level: &opts.Verbosity, set: 3}, "vvv", "Also print the temporary files and the commands run")
+	findDupes := flag.Bool("find-dupes", false, "Group the files of a single directory with identical checksums instead of comparing two")
+	showVersion := flag.Bool("version", false, "Print the version, git commit and build date and exit")
+	config := flag.String("config", "", "File of key = value lines giving defaults for the other options, which the command line overrides")
+	logFile := flag.String("log-file", "", "Append a timestamped copy of the output, errors and diagnostics to this file, e.g. for runs from cron")
+	flag.Parse()
+
+	if *config != "" {
+		if err := loadConfig(*config); err != nil {
+			fmt.Printf("Error: reading -config: %v\n", err)
+			return exitError
 		}
 	}
 
-	files, err := ioutil.ReadDir(dir)
-	if err != nil {
-		return nil, err
+	if *showVersion {
+		fmt.Println(versionString())
+		return exitIdentical
 	}
 
-	for _, file := range files {
-		if !file.IsDir() {
-			filePath := filepath.Join(dir, file.Name())
-			checksum, err := fileChecksum(filePath)
-			if err != nil {
-				return nil, err
-			}
-			checksums[file.Name()] = checksum
-			err = updateCSV(csvFile, file.Name(), checksum)
-			if err != nil {
-				return nil, err
-			}
-			// Print the file checksum
-			fmt.Printf(" - %s: %s\n", filePath, checksum)
-		}
+	if *findDupes && flag.NArg() != 1 {
+		fmt.Println("Usage: compare -find-dupes [options] <dir|docker://image:tag>")
+		return exitError
+	}
+	if len(flag.Args()) < 2 && !*findDupes {
+		fmt.Println("Usage: compare [options] <dir1|file1|docker://image:tag> <dir2|file2|docker://image:tag|checksums.csv> [dir3...]")
+		fmt.Println("       compare -find-dupes [options] <dir|docker://image:tag>")
+		return exitError
 	}
 
-	fmt.Printf("# Checksums for %s generated (%s)\n", dir, csvFile)
-
-	return checksums, nil
-}
+	opts.Exclude, opts.Include, opts.Unordered = excludes, includes, unordered
+	opts.Ext, opts.SkipExt = splitList(*ext), splitList(*skipExt)
+	opts.Columns = splitList(*columns)
+	opts.Only = splitList(*only)
 
-func fileChecksum(filePath string) (string, error) {
-	file, err := os.Open(filePath)
-	if err != nil {
-		return "", err
+	mask, err := strconv.ParseUint(*modeMask, 8, 32)
+	if err != nil || mask&^uint64(os.ModePerm) != 0 {
+		fmt.Printf("Error: invalid -ignore-mode-bits %q, expected an octal mask such as 0111\n", *modeMask)
+		return exitError
 	}
-	defer file.Close()
+	opts.IgnoreModeBits = os.FileMode(mask)
 
-	hash := md5.New()
-	if _, err := io.Copy(hash, file); err != nil {
-		return "", err
+	if *delimiter == `\t` {
+		*delimiter = "\t"
 	}
+	if utf8.RuneCountInString(*delimiter) != 1 {
+		fmt.Printf("Error: invalid -delimiter %q, expected a single character\n", *delimiter)
+		return exitError
+	}
+	opts.Delimiter, _ = utf8.DecodeRuneInString(*delimiter)
 
-	return hex.EncodeToString(hash.Sum(nil)), nil
-}
+	if *format != "text" && *format != "json" && *format != "ndjson" && *format != "html" && *format != "markdown" {
+		fmt.Printf("Error: unknown -format %q, expected text, json, ndjson, html or markdown\n", *format)
+		return exitError
+	}
+	opts.HTMLReport = *format == "html"
+	opts.MarkdownReport = *format == "markdown"
 
-func updateCSV(csvFile, fileName, checksum string) error {
-	file, err := os.OpenFile(csvFile, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0644)
-	if err != nil {
-		return err
+	if *filesFrom != "" {
+		opts.Files, err = readFileList(*filesFrom)
+		if err != nil {
+			fmt.Printf("Error: reading -files-from: %v\n", err)
+			return exitError
+		}
 	}
-	defer file.Close()
 
-	writer := csv.NewWriter(file)
-	defer writer.Flush()
+	if err := opts.Validate(); err != nil {
+		fmt.Printf("Error: %v\n", err)
+		return exitError
+	}
 
-	err = writer.Write([]string{fileName, checksum})
-	if err != nil {
-		return err
+	if *timeout < 0 {
+		fmt.Println("Error: -timeout must not be negative")
+		return exitError
 	}
 
-	return nil
-}
+	jsonFormat := *format == "json" || *format == "ndjson"
 
-func generateCombinedCSV(checksums1, checksums2 map[string]string, dir1, dir2, outputDir string) error {
-	outputFile, err := os.Create(filepath.Join(outputDir, "diff.csv"))
-	if err != nil {
-		return err
+	if *findDupes && (jsonFormat || *latest != "" || *summaryOnly) {
+		fmt.Println("Error: -find-dupes cannot be combined with -format json or ndjson, -latest or -summary")
+		return exitError
 	}
-	defer outputFile.Close()
-
-	writer := csv.NewWriter(outputFile)
-	defer writer.Flush()
 
-	// Write headers
-	err = writer.Write([]string{"File Name", "Checksum " + dir1, "Checksum " + dir2})
-	if err != nil {
-		return err
+	if flag.NArg() > 2 && (jsonFormat || *latest != "") {
+		fmt.Printf("Error: -format %s and -latest only apply to two inputs\n", *format)
+		return exitError
 	}
 
-	// Get all unique file names
-	fileNames := make(map[string]bool)
-	for fileName := range checksums1 {
-		fileNames[fileName] = true
+	if jsonFormat && (opts.FailFast || opts.StructureOnly) {
+		fmt.Printf("Error: -format %s cannot be combined with -fail-fast or -structure-only\n", *format)
+		return exitError
 	}
-	for fileName := range checksums2 {
-		fileNames[fileName] = true
+
+	if *summaryOnly && jsonFormat {
+		fmt.Printf("Error: -summary cannot be combined with -format %s\n", *format)
+		return exitError
 	}
 
-	// Sort file names
-	var sortedFileNames []string
-	for fileName := range fileNames {
-		sortedFileNames = append(sortedFileNames, fileName)
+	if *colorMode != "auto" && *colorMode != "always" && *colorMode != "never" {
+		fmt.Printf("Error: unknown -color %q, expected auto, always or never\n", *colorMode)
+		return exitError
 	}
-	sort.Strings(sortedFileNames)
 
-	// Write data
-	for _, fileName := range sortedFileNames {
-		checksum1 := checksums1[fileName]
-		checksum2 := checksums2[fileName]
-		if checksum1 != checksum2 {
-			err = writer.Write([]string{fileName, checksum1, checksum2})
-			if err != nil {
-				return err
-			}
+	if *logFile != "" {
+		if err := openRunLog(*logFile); err != nil {
+			fmt.Printf("Error: opening -log-file: %v\n", err)
+			return exitError
 		}
 	}
 
-	return nil
-}
-
-func compareFilesInCSV(dir1, dir2 string, sizeLimit int, lineLimit int, outputDir string) (int, error) {
-	file, err := os.Open(filepath.Join(outputDir, "diff.csv"))
-	if err != nil {
-		return 0, err
+	if jsonFormat {
+		output = os.Stderr
 	}
-	defer file.Close()
-
-	reader := csv.NewReader(file)
-	records, err := reader.ReadAll()
-	if err != nil {
-		return 0, err
+	colorCounts = useColor(*colorMode, output)
+	opts.Color = colorCounts
+	output = teeRunLog(output)
+	opts.Output = output
+	if *format == "ndjson" {
+		opts.Events = os.Stdout
 	}
-
-	diffDir := filepath.Join(outputDir, "diffs")
-	err = os.MkdirAll(diffDir, 0755)
-	if err != nil {
-		return 0, err
+	if *summaryOnly {
+		opts.Output = teeRunLog(io.Discard)
 	}
+	if *showProgress {
+		opts.Progress = os.Stderr
+	}
+	verbosity = opts.Verbosity
+	opts.Diagnostics = teeRunLog(os.Stderr)
 
-	diffCount := 0
-	fmt.Printf("# Start comparing files\n")
-	for _, record := range records[1:] { // Skip header
-		file1 := filepath.Join(dir1, record[0])
-		file2 := filepath.Join(dir2, record[0])
-
-		_, err1 := os.Stat(file1)
-		_, err2 := os.Stat(file2)
-
-		if os.IsNotExist(err1) {
-			// file1 does not exist, copy file2 to diffs directory
-			err = copyFile(file2, filepath.Join(diffDir, record[0]))
-			if err != nil {
-				return 0, err
-			}
-			diffCount++
-		} else if os.IsNotExist(err2) {
-			// file2 does not exist, copy file1 to diffs directory
-			err = copyFile(file1, filepath.Join(diffDir, record[0]))
-			if err != nil {
-				return 0, err
-			}
-			diffCount++
-		} else {
-			// Both files exist, compare them
-			sizeLimitInBytes := sizeLimit * 1024 * 1024
-			diffFile := filepath.Join(diffDir, record[0]+".diff")
-			err = generateDiff(file1, file2, diffFile, sizeLimitInBytes, lineLimit)
-			if err != nil {
-				return 0, err
-			}
-			diffCount++
+	dir1 := flag.Arg(0)
+	dir2 := flag.Arg(1)
+	if *latest != "" {
+		dir2, err = pickLatest(flag.Arg(1), *latest)
+		if err != nil {
+			fmt.Fprintf(output, "Error: %v\n", err)
+			return exitError
 		}
 	}
+	opts.OutputDir = *out
+	if opts.OutputDir == "" {
+		opts.OutputDir = compare.DefaultOutputDir(dir1, dir2)
+	}
 
-	fmt.Printf("# Files compared and differences stored in %s\n", diffDir)
+	// Interrupting stops the run cleanly; a second signal kills it
+	signalCtx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	go func() {
+		<-signalCtx.Done()
+		stop()
+	}()
+	ctx := signalCtx
+	if *timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, *timeout)
+		defer cancel()
+	}
 
-	return diffCount, nil
-}
+	if *findDupes {
+		if *out == "" {
+			opts.OutputDir = compare.DefaultDupesOutputDir(dir1)
+		}
+		return runFindDupes(ctx, dir1, opts)
+	}
 
-func generateDiff(file1, file2, diffFile string, sizeLimit, lineLimit int) error {
-	// Check if the diff file already exists and remove it
-	if _, err := os.Stat(diffFile); err == nil {
-		if err := os.Remove(diffFile); err != nil {
-			return fmt.Errorf("failed to remove existing diff file: %v", err)
+	if flag.NArg() > 2 {
+		if *out == "" {
+			opts.OutputDir = compare.DefaultMultiOutputDir(flag.Args())
 		}
+		return runMany(ctx, flag.Args(), opts, *notify)
 	}
 
-	info1, err := os.Stat(file1)
-	if err != nil {
-		return err
+	result, err := compare.CompareContext(ctx, dir1, dir2, opts)
+	if *notify != "" {
+		notifyDir1, notifyDir2 := result.Dir1, result.Dir2
+		if notifyDir1 == "" || notifyDir2 == "" {
+			notifyDir1, notifyDir2 = dir1, dir2
+		}
+		notifyCompletion(*notify, notifyDir1, notifyDir2, result.Differences, err)
 	}
-	info2, err := os.Stat(file2)
 	if err != nil {
-		return err
+		fmt.Fprintf(output, "Error %v\n", err)
 	}
-
-	var content1, content2 []byte
-
-	if debug {
-		fmt.Printf("// Size limit: %d\n", sizeLimit)
-		fmt.Printf("// File Size 1: %d\n", info1.Size())
-		fmt.Printf("// File Size 2: %d\n", info2.Size())
+	if *format == "json" {
+		if jsonErr := writeJSONSummary(os.Stdout, dir1, dir2, result.OutputDir, result, err); jsonErr != nil {
+			fmt.Fprintf(output, "Error writing JSON summary: %v\n", jsonErr)
+			return exitError
+		}
+	}
+	if err != nil {
+		return exitError
 	}
 
-	if info1.Size() > int64(sizeLimit) || info2.Size() > int64(sizeLimit) {
-		if debug {
-			fmt.Printf("// large files detected: %s - %s, comparing last %d lines\n", file1, file2, lineLimit)
-		}
-		content1, err = readLastLines(file1, lineLimit)
-		if err != nil {
-			return err
-		}
-		content2, err = readLastLines(file2, lineLimit)
-		if err != nil {
-			return err
+	if *summaryOnly {
+		printSummary(result)
+	} else if opts.FailFast {
+		if result.Differences == 0 {
+			fmt.Fprintf(output, "# No differences found\n")
 		}
+	} else if opts.StructureOnly {
+		fmt.Fprintf(output, "# Total directory differences found: %d (%s)\n", result.Differences, filepath.Join(opts.OutputDir, "structure.csv"))
+	} else if opts.DryRun && opts.NoCombinedCSV {
+		fmt.Fprintf(output, "# Total differences found: %s\n", highlight(result.Differences))
+	} else if opts.DryRun {
+		fmt.Fprintf(output, "# Total differences found: %s (%s)\n", highlight(result.Differences), filepath.Join(opts.OutputDir, "diff.csv"))
+	} else if result.OutputDir == "" {
+		// Two files were compared and their diff is already printed
+		fmt.Fprintf(output, "# Total differences found: %s\n", highlight(result.Differences))
 	} else {
-		if debug {
-			fmt.Printf("// comparing entire files %s - %s \n", file1, file2)
-		}
-		content1, err = readFileInChunks(file1)
-		if err != nil {
-			return err
-		}
-		content2, err = readFileInChunks(file2)
-		if err != nil {
-			return err
+		fmt.Fprintf(output, "# Total differences found: %s (%s)\n", highlight(result.Differences), filepath.Join(opts.OutputDir, "diffs"))
+		if result.Digest != "" {
+			fmt.Fprintf(output, "# Comparison digest: %s\n", result.Digest)
 		}
 	}
 
-	tmpFile1, err := os.CreateTemp("", "file1-*.tmp")
-	if err != nil {
-		return err
+	if len(result.Errors) > 0 {
+		fmt.Fprintf(output, "# %d files skipped after errors:\n", len(result.Errors))
+		for _, fileErr := range result.Errors {
+			fmt.Fprintf(output, " - %v\n", fileErr)
+		}
+		return exitError
 	}
-	defer os.Remove(tmpFile1.Name())
-
-	tmpFile2, err := os.CreateTemp("", "file2-*.tmp")
-	if err != nil {
-		return err
+	if result.Differences > 0 {
+		return exitDifferent
 	}
-	defer os.Remove(tmpFile2.Name())
+	return exitIdentical
+}
 
-	if _, err := tmpFile1.Write(content1); err != nil {
-		return err
+// printSummary prints the counts of a finished run for -summary, followed by
+// the files skipped after errors.
+func printSummary(result compare.Result) {
+	counts := make(map[string]int)
+	for _, file := range result.Files {
+		counts[file.Status]++
 	}
-	if _, err := tmpFile2.Write(content2); err != nil {
-		return err
+	fmt.Fprintf(output, "Identical: %s\n", highlight(result.Identical))
+	fmt.Fprintf(output, "Modified: %s\n", highlight(counts["modified"]))
+	fmt.Fprintf(output, "Added: %s\n", highlight(counts["added"]))
+	fmt.Fprintf(output, "Removed: %s\n", highlight(counts["removed"]))
+	if counts["mode"] > 0 {
+		fmt.Fprintf(output, "Permissions changed: %s\n", highlight(counts["mode"]))
 	}
-
-	cmd := exec.Command("diff", "-u", tmpFile1.Name(), tmpFile2.Name())
-	output, err := cmd.CombinedOutput()
-	if err != nil && len(output) == 0 {
-		return err
+	if counts["renamed"] > 0 {
+		fmt.Fprintf(output, "Renamed: %s\n", highlight(counts["renamed"]))
 	}
+	fmt.Fprintf(output, "Total differences: %s\n", highlight(result.Differences))
+}
 
-	err = os.WriteFile(diffFile, output, 0644)
+// runMany compares the first of dirs with each of the others and returns the
+// exit status: 1 when the files of the directories do not all agree.
+func runMany(ctx context.Context, dirs []string, opts compare.Options, notify string) int {
+	result, err := compare.CompareManyContext(ctx, dirs, opts)
+	if notify != "" {
+		differences := len(result.Files)
+		notifyCompletion(notify, dirs[0], strings.Join(dirs[1:], ", "), differences, err)
+	}
 	if err != nil {
-		return err
+		fmt.Fprintf(output, "Error %v\n", err)
+		return exitError
 	}
 
-	fmt.Printf(" - diff generated for %s (%s) and %s (%s)\n", file1, humanReadableSize(info1.Size()), file2, humanReadableSize(info2.Size()))
-	if debug {
-		fmt.Printf(" __________________________________________________________\n")
+	status := exitIdentical
+	for _, pair := range result.Pairs {
+		fmt.Fprintf(output, "# Total differences found between %s and %s: %s (%s)\n", pair.Dir1, pair.Dir2, highlight(pair.Differences), filepath.Join(pair.OutputDir, "diffs"))
+		for _, fileErr := range pair.Errors {
+			fmt.Fprintf(output, " - skipped %v\n", fileErr)
+			status = exitError
+		}
+	}
+	if opts.NoCombinedCSV {
+		fmt.Fprintf(output, "# Files differing across the %d directories: %d\n", len(dirs), len(result.Files))
+	} else {
+		fmt.Fprintf(output, "# Files differing across the %d directories: %d (%s)\n", len(dirs), len(result.Files), filepath.Join(opts.OutputDir, "diff.csv"))
 	}
 
-	return nil
+	if status == exitIdentical && len(result.Files) > 0 {
+		status = exitDifferent
+	}
+	return status
 }
 
-func readLastLines(filePath string, n int) ([]byte, error) {
-	cmd := exec.Command("tail", "-n", fmt.Sprintf("%d", n), filePath)
-	output, err := cmd.Output()
+// runFindDupes searches dir for duplicate files and returns the exit status:
+// 1 when there are any.
+func runFindDupes(ctx context.Context, dir string, opts compare.Options) int {
+	result, err := compare.FindDuplicatesContext(ctx, dir, opts)
 	if err != nil {
-		return nil, err
+		fmt.Fprintf(output, "Error %v\n", err)
+		return exitError
+	}
+	if len(result.Groups) > 0 {
+		return exitDifferent
 	}
-	return output, nil
+	return exitIdentical
 }
 
-func copyFile(src, dst string) error {
-	sourceFile, err := os.Open(filepath.Clean(src))
-	if err != nil {
-		return err
+// splitList returns the non-empty comma-separated values of list.
+func splitList(list string) []string {
+	var values []string
+	for _, value := range strings.Split(list, ",") {
+		if value = strings.TrimSpace(value); value != "" {
+			values = append(values, value)
+		}
 	}
-	defer sourceFile.Close()
+	return values
+}
 
-	destinationFile, err := os.Create(filepath.Clean(dst))
-	if err != nil {
-		return err
+// readFileList reads the newline-separated paths of -files-from from path, or
+// from stdin when path is -. Blank lines are skipped.
+func readFileList(path string) ([]string, error) {
+	var r io.Reader = os.Stdin
+	if path != "-" {
+		file, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		defer file.Close()
+		r = file
 	}
-	defer destinationFile.Close()
 
-	_, err = io.Copy(destinationFile, sourceFile)
-	if err != nil {
-		return err
+	files := []string{}
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		if line := strings.TrimRight(scanner.Text(), "\r"); line != "" {
+			files = append(files, line)
+		}
 	}
-
-	fmt.Printf("# File copied from %s to %s\n", src, dst)
-
-	return nil
+	return files, scanner.Err()
 }
 
-func humanReadableSize(size int64) string {
-	const unit = 1024
-	if size < unit {
-		return fmt.Sprintf("%d B", size)
+// pickLatest returns the most recent directory matching pattern, either by
+// modification time or by the last name in lexicographic order (which suits
+// timestamped names such as backup-2024-05-01).
+func pickLatest(pattern, by string) (string, error) {
+	if by != "mtime" && by != "name" {
+		return "", fmt.Errorf("unknown -latest %q, expected mtime or name", by)
 	}
-	div, exp := int64(unit), 0
-	for n := size / unit; n >= unit; n /= unit {
-		div *= unit
-		exp++
-	}
-	return fmt.Sprintf("%.1f %cB", float64(size)/float64(div), "KMGTPE"[exp])
-}
 
-func readFileInChunks(filePath string) ([]byte, error) {
-	file, err := os.Open(filePath)
+	matches, err := filepath.Glob(pattern)
 	if err != nil {
-		return nil, err
+		return "", err
 	}
-	defer file.Close()
 
-	var content []byte
-	buf := make([]byte, 1024*1024) // 1 MB buffer
-	for {
-		n, err := file.Read(buf)
-		if err != nil && err != io.EOF {
-			return nil, err
+	var candidates []string
+	modTimes := make(map[string]time.Time)
+	for _, match := range matches {
+		info, err := os.Stat(match)
+		if err != nil || !info.IsDir() {
+			continue
 		}
-		if n == 0 {
-			break
+		candidates = append(candidates, match)
+		modTimes[match] = info.ModTime()
+	}
+	if len(candidates) == 0 {
+		return "", fmt.Errorf("no directories match %s", pattern)
+	}
+
+	sort.Strings(candidates)
+	chosen := candidates[len(candidates)-1]
+	if by == "mtime" {
+		for _, candidate := range candidates {
+			if modTimes[candidate].After(modTimes[chosen]) {
+				chosen = candidate
+			}
 		}
-		content = append(content, buf[:n]...)
 	}
 
-	return content, nil
+	fmt.Fprintf(output, "# Selected %s as the latest of %d candidates (by %s)\n", chosen, len(candidates), by)
+
+	return filepath.Clean(chosen), nil
 }
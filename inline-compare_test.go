@@ -0,0 +1,104 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// TestMain runs the command itself when INLINE_COMPARE_ARGS holds its
+// arguments, one per line, so the tests can check its exit status.
+func TestMain(m *testing.M) {
+	if args, ok := os.LookupEnv("INLINE_COMPARE_ARGS"); ok {
+		os.Args = append([]string{"inline-compare"}, strings.Split(args, "\n")...)
+		main()
+	}
+	os.Exit(m.Run())
+}
+
+// exitStatus runs inline-compare with args and returns its exit status.
+func exitStatus(t *testing.T, args ...string) int {
+	t.Helper()
+	cmd := exec.Command(os.Args[0])
+	cmd.Env = append(os.Environ(), "INLINE_COMPARE_ARGS="+strings.Join(args, "\n"))
+	err := cmd.Run()
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return exitErr.ExitCode()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return 0
+}
+
+func TestLargeFilesDifferingBeforeTheirTailsExitDifferent(t *testing.T) {
+	root := t.TempDir()
+	dir1, dir2 := filepath.Join(root, "a"), filepath.Join(root, "b")
+	tail := strings.Repeat("same line\n", 200000)
+	for dir, head := range map[string]string{dir1: "first\n", dir2: "other\n"} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, "big.log"), []byte(head+tail), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	status := exitStatus(t, "-size", "1", "-out", filepath.Join(root, "out"), dir1, dir2)
+	if status != exitDifferent {
+		t.Fatalf("exit status = %d, want %d", status, exitDifferent)
+	}
+}
+
+func TestCommandLineOverridesConfig(t *testing.T) {
+	root := t.TempDir()
+	dir1, dir2 := filepath.Join(root, "a"), filepath.Join(root, "b")
+	files := map[string][2]string{
+		"crlf.txt": {"one\r\ntwo\r\n", "one\ntwo\n"},
+		"x.log":    {"x\n", "y\n"},
+	}
+	for name, contents := range files {
+		for i, dir := range []string{dir1, dir2} {
+			if err := os.MkdirAll(dir, 0755); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(filepath.Join(dir, name), []byte(contents[i]), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	tests := []struct {
+		name   string
+		config string
+		args   []string
+		want   int
+	}{
+		{"config applies", "ignore-eol\nexclude = *.log\n", nil, exitIdentical},
+		{"dashes and quotes", "# comment\n\n--ignore-eol = true\n-exclude = \"*.log\"\n", nil, exitIdentical},
+		{"command line boolean wins", "ignore-eol\nexclude = *.log\n", []string{"-ignore-eol=false"}, exitDifferent},
+		{"command line repeatable flag replaces every line", "ignore-eol\nexclude = *.log\nexclude = *.txt\n", []string{"-exclude", "*.md"}, exitDifferent},
+		{"command line repeatable flag alone", "exclude = *.log\n", []string{"-ignore-eol", "-exclude", "*.log"}, exitIdentical},
+		{"unknown option", "no-such-option = 1\n", nil, exitError},
+		{"value missing", "exclude\n", nil, exitError},
+		{"invalid value", "ignore-eol = maybe\n", nil, exitError},
+		{"config cannot name another", "config = other.conf\n", nil, exitError},
+	}
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := filepath.Join(root, fmt.Sprintf("%d.conf", i))
+			if err := os.WriteFile(config, []byte(tt.config), 0644); err != nil {
+				t.Fatal(err)
+			}
+			args := append([]string{"-config", config, "-out", filepath.Join(root, fmt.Sprint("out", i))}, tt.args...)
+			if status := exitStatus(t, append(args, dir1, dir2)...); status != tt.want {
+				t.Errorf("exit status = %d, want %d", status, tt.want)
+			}
+		})
+	}
+}
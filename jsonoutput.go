@@ -0,0 +1,93 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+
+	"inline-compare/compare"
+)
+
+// jsonSummary is the document printed by -format json.
+type jsonSummary struct {
+	Dir1        string     `json:"dir1"`
+	Dir2        string     `json:"dir2"`
+	OutputDir   string     `json:"outputDir"`
+	Files       []jsonFile `json:"files"`
+	Differences int        `json:"differences"`
+	Identical   int        `json:"identical"`
+	Digest      string     `json:"digest,omitempty"`
+	TreeHash1   string     `json:"treeHash1,omitempty"`
+	TreeHash2   string     `json:"treeHash2,omitempty"`
+	Archive     string     `json:"archive,omitempty"`
+	Error       string     `json:"error,omitempty"`
+	Errors      []string   `json:"errors,omitempty"`
+}
+
+// jsonFile is one row of diff.csv. Sizes are omitted for a missing side.
+type jsonFile struct {
+	Name        string `json:"name"`
+	Status      string `json:"status"`
+	Checksum1   string `json:"checksum1,omitempty"`
+	Checksum2   string `json:"checksum2,omitempty"`
+	Size1       *int64 `json:"size1,omitempty"`
+	Size2       *int64 `json:"size2,omitempty"`
+	RenamedFrom string `json:"renamedFrom,omitempty"`
+	Truncated   bool   `json:"truncated,omitempty"`
+	// Similarity and Change are only set with -similarity-threshold.
+	Similarity *float64 `json:"similarity,omitempty"`
+	Change     string   `json:"change,omitempty"`
+}
+
+// writeJSONSummary prints the outcome of a run as a single JSON document.
+func writeJSONSummary(w io.Writer, dir1, dir2, outputDir string, result compare.Result, runErr error) error {
+	summary := jsonSummary{
+		Dir1:        dir1,
+		Dir2:        dir2,
+		OutputDir:   outputDir,
+		Files:       []jsonFile{},
+		Differences: result.Differences,
+		Identical:   result.Identical,
+		Digest:      result.Digest,
+		TreeHash1:   result.TreeHash1,
+		TreeHash2:   result.TreeHash2,
+		Archive:     result.Archive,
+	}
+
+	if runErr != nil {
+		summary.Error = runErr.Error()
+	} else {
+		for _, file := range result.Files {
+			var similarity *float64
+			if file.Change != "" {
+				similarity = &file.Similarity
+			}
+			summary.Files = append(summary.Files, jsonFile{
+				Name:        file.Name,
+				Status:      file.Status,
+				Checksum1:   file.Checksum1,
+				Checksum2:   file.Checksum2,
+				Size1:       fileSize(file.Size1, file.Checksum1),
+				Size2:       fileSize(file.Size2, file.Checksum2),
+				RenamedFrom: file.RenamedFrom,
+				Truncated:   file.Truncated,
+				Similarity:  similarity,
+				Change:      file.Change,
+			})
+		}
+		for _, fileErr := range result.Errors {
+			summary.Errors = append(summary.Errors, fileErr.Error())
+		}
+	}
+
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(summary)
+}
+
+// fileSize returns size, or nil when the file is absent on that side.
+func fileSize(size int64, checksum string) *int64 {
+	if checksum == "" {
+		return nil
+	}
+	return &size
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"log"
+	"os"
+	"regexp"
+	"sync"
+)
+
+// colorCodes matches the terminal color sequences of -color, which are left
+// out of the -log-file.
+var colorCodes = regexp.MustCompile("\x1b\\[[0-9;]*m")
+
+// runLog is the -log-file, or nil.
+var runLog *log.Logger
+
+// openRunLog opens path for -log-file, appending to it so that a file moved
+// away by log rotation is simply started again.
+func openRunLog(path string) error {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	runLog = log.New(file, "", log.LstdFlags|log.Lmicroseconds)
+	return nil
+}
+
+// logLines copies what is written to it to runLog, a timestamped line at a
+// time. Each stream has its own, since their partial lines must not mix.
+type logLines struct {
+	mu      sync.Mutex
+	partial []byte
+}
+
+// teeRunLog returns w, also copying to the -log-file when there is one.
+func teeRunLog(w io.Writer) io.Writer {
+	if runLog == nil {
+		return w
+	}
+	return io.MultiWriter(w, &logLines{})
+}
+
+func (l *logLines) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.partial = append(l.partial, p...)
+	for {
+		end := bytes.IndexByte(l.partial, '\n')
+		if end < 0 {
+			break
+		}
+		runLog.Print(colorCodes.ReplaceAllString(string(l.partial[:end]), ""))
+		l.partial = l.partial[end+1:]
+	}
+	return len(p), nil
+}
+
+// closeRunLog ends the -log-file with the exit status of the run.
+func closeRunLog(status int) {
+	if runLog == nil {
+		return
+	}
+	runLog.Printf("# Exit status %d", status)
+	runLog.Writer().(*os.File).Close()
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// notification is the payload sent to a -notify webhook.
+type notification struct {
+	Text        string `json:"text"`
+	Status      string `json:"status"`
+	Dir1        string `json:"dir1"`
+	Dir2        string `json:"dir2"`
+	Differences int    `json:"differences"`
+	Error       string `json:"error,omitempty"`
+}
+
+// notifyCompletion reports the outcome of a run to target, which is either a
+// webhook URL or a command. A failing notification is reported but never
+// fails the run itself.
+func notifyCompletion(target, dir1, dir2 string, diffCount int, runErr error) {
+	n := notification{
+		Status:      "ok",
+		Dir1:        dir1,
+		Dir2:        dir2,
+		Differences: diffCount,
+	}
+	if runErr != nil {
+		n.Status = "error"
+		n.Error = runErr.Error()
+		n.Text = fmt.Sprintf("Compare %s and %s failed: %v", dir1, dir2, runErr)
+	} else {
+		n.Text = fmt.Sprintf("Compare %s and %s finished: %d differences", dir1, dir2, diffCount)
+	}
+
+	var err error
+	if strings.HasPrefix(target, "http://") || strings.HasPrefix(target, "https://") {
+		err = postNotification(target, n)
+	} else {
+		err = runNotifyCommand(target, n)
+	}
+	if err != nil {
+		fmt.Fprintf(output, "# Notification failed: %v\n", err)
+		return
+	}
+
+	if verbosity >= 1 {
+		fmt.Fprintf(os.Stderr, "// notification sent to %s\n", target)
+	}
+}
+
+// postNotification sends the payload as JSON, which Slack-style incoming
+// webhooks accept thanks to the text field.
+func postNotification(url string, n notification) error {
+	body, err := json.Marshal(n)
+	if err != nil {
+		return err
+	}
+
+	client := &http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook returned %s", resp.Status)
+	}
+
+	return nil
+}
+
+// runNotifyCommand runs the command with status, dir1, dir2 and the
+// difference count appended as arguments.
+func runNotifyCommand(command string, n notification) error {
+	fields := strings.Fields(command)
+	if len(fields) == 0 {
+		return fmt.Errorf("empty notify command")
+	}
+
+	args := append(fields[1:], n.Status, n.Dir1, n.Dir2, strconv.Itoa(n.Differences))
+	if verbosity >= 3 {
+		fmt.Fprintf(os.Stderr, "// running %s %s\n", fields[0], strings.Join(args, " "))
+	}
+	cmd := exec.Command(fields[0], args...)
+	cmd.Stdout = output
+	cmd.Stderr = os.Stderr
+	cmd.Env = append(os.Environ(), "INLINE_COMPARE_ERROR="+n.Error)
+
+	return cmd.Run()
+}
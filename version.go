@@ -0,0 +1,38 @@
+package main
+
+import (
+	"fmt"
+	buildinfo "runtime/debug"
+)
+
+// Build metadata, set with -ldflags "-X main.version=... -X main.commit=...
+// -X main.date=..." as GoReleaser does by default.
+var (
+	version = "dev"
+	commit  = ""
+	date    = ""
+)
+
+// versionString describes the running build. A plain go build in a git
+// checkout has no -X values, so the commit and date then come from the
+// module build info.
+func versionString() string {
+	rev, built := commit, date
+	if info, ok := buildinfo.ReadBuildInfo(); ok {
+		for _, setting := range info.Settings {
+			switch {
+			case setting.Key == "vcs.revision" && rev == "":
+				rev = setting.Value
+			case setting.Key == "vcs.time" && built == "":
+				built = setting.Value
+			}
+		}
+	}
+	if rev == "" {
+		rev = "unknown"
+	}
+	if built == "" {
+		built = "unknown"
+	}
+	return fmt.Sprintf("inline-compare %s (commit %s, built %s)", version, rev, built)
+}